@@ -1,8 +1,11 @@
 package socks5
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
+	"net"
 )
 
 type AuthMethod = byte
@@ -20,7 +23,12 @@ const (
 	PasswordAuthFailure = 0x01
 )
 
-var ErrPasswordAuthFailure = errors.New("error authenticating password")
+var (
+	ErrPasswordAuthFailure = errors.New("error authenticating password")
+	ErrPasswordTooLong     = errors.New("username or password is longer than 255 bytes")
+	ErrCertificateNoUser   = errors.New("no username in the client certificate")
+	ErrCertificateRevoked  = errors.New("the user of the client certificate is disabled or expired")
+)
 
 type ClientAuthMessage struct {
 	NMethods byte
@@ -64,6 +72,28 @@ func WriteServerAuthMessage(conn io.Writer, method AuthMethod) error {
 	return nil
 }
 
+// WriteClientAuthMessage is used by the client to offer its methods.
+func WriteClientAuthMessage(conn io.Writer, methods []AuthMethod) error {
+	buf := make([]byte, 0, 2+len(methods))
+	buf = append(buf, Socks5Version, byte(len(methods)))
+	buf = append(buf, methods...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// NewServerAuthMessage is used by the client to read the method selected by the server.
+func NewServerAuthMessage(conn io.Reader) (AuthMethod, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return MethodNoAcceptable, err
+	}
+	if buf[0] != Socks5Version {
+		return MethodNoAcceptable, ErrVersionNotSupport
+	}
+	return buf[1], nil
+}
+
 type ClientPasswordAuthMessage struct {
 	Username string
 	Password string
@@ -108,6 +138,33 @@ func NewClientPasswordAuthMessage(conn io.Reader) (*ClientPasswordAuthMessage, e
 	return &clientPasswordAuthMessage, nil
 }
 
+// WriteClientPasswordAuthMessage is used by the client to send username and password.
+func WriteClientPasswordAuthMessage(conn io.Writer, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return ErrPasswordTooLong
+	}
+	buf := make([]byte, 0, 3+len(username)+len(password))
+	buf = append(buf, PasswordAuthVersion, byte(len(username)))
+	buf = append(buf, username...)
+	buf = append(buf, byte(len(password)))
+	buf = append(buf, password...)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// NewServerPasswordMessage is used by the client to read the status of username/password authentication.
+func NewServerPasswordMessage(conn io.Reader) (byte, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return PasswordAuthFailure, err
+	}
+	if buf[0] != PasswordAuthVersion {
+		return PasswordAuthFailure, ErrMethodVersionNotSupported
+	}
+	return buf[1], nil
+}
+
 func WriteServerPasswordMessage(conn io.Writer, status byte) error {
 	_, err := conn.Write([]byte{PasswordAuthVersion, status})
 	if err != nil {
@@ -115,3 +172,213 @@ func WriteServerPasswordMessage(conn io.Writer, status byte) error {
 	}
 	return nil
 }
+
+// Identity is who the client turns out to be after authentication.
+type Identity struct {
+	Method   AuthMethod
+	Username string // empty when the client is anonymous
+}
+
+func (i *Identity) String() string {
+	if i == nil || i.Username == "" {
+		return "anonymous"
+	}
+	return i.Username
+}
+
+// Authenticator is an authentication method which the server can offer.
+type Authenticator interface {
+	// Method returns the method code sent in the method selection message.
+	Method() AuthMethod
+	// Authenticate performs the method-specific sub-negotiation after the method has been selected.
+	Authenticate(conn io.ReadWriter, clientAddr net.Addr) (*Identity, error)
+}
+
+// ClientAcceptor can be implemented by an Authenticator which is only offered to some clients.
+type ClientAcceptor interface {
+	AcceptClient(clientAddr net.Addr) bool
+}
+
+// ConnAcceptor can be implemented by an Authenticator which is only offered on some connections,
+// such as the tls connections with a client certificate.
+type ConnAcceptor interface {
+	AcceptConn(conn net.Conn) bool
+}
+
+// NoAuthAuthenticator lets the client in without authentication.
+type NoAuthAuthenticator struct {
+	// AllowClient restricts the clients which may skip authentication, such as IsLoopbackClient.
+	// nil means all clients.
+	AllowClient func(clientAddr net.Addr) bool
+}
+
+func (a NoAuthAuthenticator) Method() AuthMethod {
+	return MethodNoAuth
+}
+
+func (a NoAuthAuthenticator) AcceptClient(clientAddr net.Addr) bool {
+	return a.AllowClient == nil || a.AllowClient(clientAddr)
+}
+
+func (a NoAuthAuthenticator) Authenticate(conn io.ReadWriter, clientAddr net.Addr) (*Identity, error) {
+	return &Identity{Method: MethodNoAuth}, nil
+}
+
+// PasswordAuthenticator performs username/password authentication (RFC 1929).
+type PasswordAuthenticator struct {
+	PasswordChecker PasswordCheckerFunc
+}
+
+func (a PasswordAuthenticator) Method() AuthMethod {
+	return MethodPassword
+}
+
+func (a PasswordAuthenticator) Authenticate(conn io.ReadWriter, clientAddr net.Addr) (*Identity, error) {
+	if a.PasswordChecker == nil {
+		return nil, ErrPasswordCheckerNotSet
+	}
+	message, err := NewClientPasswordAuthMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	ok := a.PasswordChecker(message.Username, message.Password)
+
+	if !ok {
+		// There is no need to return error because the link will be closed anyway.
+		WriteServerPasswordMessage(conn, PasswordAuthFailure)
+		return nil, ErrPasswordAuthFailure
+	}
+
+	err = WriteServerPasswordMessage(conn, PasswordAuthSuccess)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Method: MethodPassword, Username: message.Username}, nil
+}
+
+// IsLoopbackClient reports whether the client connects from the same host,
+// through a loopback address, a unix socket or net.Pipe.
+func IsLoopbackClient(clientAddr net.Addr) bool {
+	if ip := addrIp(clientAddr); ip != nil {
+		return ip.IsLoopback()
+	}
+	switch clientAddr.Network() {
+	case "unix", "pipe":
+		return true
+	}
+	return false
+}
+
+// selectAuthenticator returns the first authenticator which the client offers and which accepts the client.
+// It returns nil when there is none.
+func selectAuthenticator(authenticators []Authenticator, methods []AuthMethod, conn net.Conn) Authenticator {
+	for _, authenticator := range authenticators {
+		if !acceptAuthenticator(authenticator, conn) {
+			continue
+		}
+		for _, method := range methods {
+			if method == authenticator.Method() {
+				return authenticator
+			}
+		}
+	}
+	return nil
+}
+
+// acceptAuthenticator reports whether the authenticator is offered on conn.
+func acceptAuthenticator(authenticator Authenticator, conn net.Conn) bool {
+	if acceptor, ok := authenticator.(ClientAcceptor); ok && !acceptor.AcceptClient(conn.RemoteAddr()) {
+		return false
+	}
+	if acceptor, ok := authenticator.(ConnAcceptor); ok && !acceptor.AcceptConn(conn) {
+		return false
+	}
+	return true
+}
+
+// CertificateUserField is the field of the client certificate which is used as the username.
+type CertificateUserField string
+
+const (
+	CertificateUserCommonName CertificateUserField = "common_name"
+	CertificateUserDnsSan     CertificateUserField = "dns_san"
+	CertificateUserEmailSan   CertificateUserField = "email_san"
+	CertificateUserUriSan     CertificateUserField = "uri_san"
+)
+
+// CertificateAuthenticator lets in the clients of a tls listener which sent a verified client certificate,
+// and maps the certificate to the username, so the password is skipped.
+// The client selects "no authentication required", and the certificate is verified by the tls.Config
+// of the listener, such as ClientAuth: tls.VerifyClientCertIfGiven with ClientCAs.
+// It is not offered on connections without a verified certificate.
+type CertificateAuthenticator struct {
+	// UserField chooses the username. Empty means CertificateUserCommonName.
+	UserField CertificateUserField
+	// Users rejects the disabled and expired users of the store, and may be nil.
+	// Without it, or for a username which is not in the store, only revoking the certificate removes the access.
+	Users *UserStore
+}
+
+func (a CertificateAuthenticator) Method() AuthMethod {
+	return MethodNoAuth
+}
+
+func (a CertificateAuthenticator) AcceptConn(conn net.Conn) bool {
+	certificate := verifiedClientCertificate(conn)
+	return certificate != nil && certificateUsername(certificate, a.UserField) != ""
+}
+
+func (a CertificateAuthenticator) Authenticate(conn io.ReadWriter, clientAddr net.Addr) (*Identity, error) {
+	certificate := verifiedClientCertificate(conn)
+	if certificate == nil {
+		return nil, ErrAuthMethodNotSupport
+	}
+	username := certificateUsername(certificate, a.UserField)
+	if username == "" {
+		return nil, ErrCertificateNoUser
+	}
+	if a.Users != nil && a.Users.Revoked(username) {
+		return nil, ErrCertificateRevoked
+	}
+	return &Identity{Method: MethodNoAuth, Username: username}, nil
+}
+
+// certificateUsername returns the field of the certificate, or empty when it is not set.
+func certificateUsername(certificate *x509.Certificate, field CertificateUserField) string {
+	switch field {
+	case CertificateUserCommonName, "":
+		return certificate.Subject.CommonName
+	case CertificateUserDnsSan:
+		if len(certificate.DNSNames) > 0 {
+			return certificate.DNSNames[0]
+		}
+	case CertificateUserEmailSan:
+		if len(certificate.EmailAddresses) > 0 {
+			return certificate.EmailAddresses[0]
+		}
+	case CertificateUserUriSan:
+		if len(certificate.URIs) > 0 {
+			return certificate.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// verifiedClientCertificate returns the client certificate of the tls connection under conn,
+// which may be wrapped after peeking. It returns nil unless the certificate has been verified.
+func verifiedClientCertificate(conn io.ReadWriter) *x509.Certificate {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			if !state.HandshakeComplete || len(state.VerifiedChains) == 0 {
+				return nil
+			}
+			return state.VerifiedChains[0][0]
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
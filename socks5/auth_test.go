@@ -2,10 +2,30 @@ package socks5
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
 	"reflect"
 	"testing"
+	"time"
 )
 
+// testAddrConn is a connection which only has the remote address.
+type testAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *testAddrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
 func TestNewClientAuthMessage(t *testing.T) {
 	t.Run("should generate a message", func(t *testing.T) {
 		b := []byte{Socks5Version, 2, MethodNoAuth, MethodGssApi}
@@ -105,3 +125,237 @@ func TestNewClientPasswordAuthMessage(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectAuthenticator(t *testing.T) {
+	localAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	remoteAddr := &net.TCPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 1234}
+	authenticators := []Authenticator{
+		NoAuthAuthenticator{AllowClient: IsLoopbackClient},
+		PasswordAuthenticator{},
+	}
+
+	tests := []struct {
+		name       string
+		methods    []AuthMethod
+		clientAddr net.Addr
+		want       AuthMethod
+	}{
+		{"local client should skip password", []AuthMethod{MethodNoAuth, MethodPassword}, localAddr, MethodNoAuth},
+		{"local client may still use password", []AuthMethod{MethodPassword}, localAddr, MethodPassword},
+		{"remote client should use password", []AuthMethod{MethodNoAuth, MethodPassword}, remoteAddr, MethodPassword},
+		{"remote client without password", []AuthMethod{MethodNoAuth}, remoteAddr, MethodNoAcceptable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := selectAuthenticator(authenticators, test.methods, &testAddrConn{remoteAddr: test.clientAddr})
+			got := MethodNoAcceptable
+			if authenticator != nil {
+				got = authenticator.Method()
+			}
+			if got != test.want {
+				t.Fatalf("want method %d but got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func TestPasswordAuthenticator(t *testing.T) {
+	authenticator := PasswordAuthenticator{
+		PasswordChecker: func(username, password string) bool {
+			return username == "123" && password == "456"
+		},
+	}
+
+	t.Run("should return the identity", func(t *testing.T) {
+		conn := bytes.Buffer{}
+		conn.Write([]byte{PasswordAuthVersion, 3, '1', '2', '3', 3, '4', '5', '6'})
+		identity, err := authenticator.Authenticate(&conn, nil)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		want := Identity{Method: MethodPassword, Username: "123"}
+		if *identity != want {
+			t.Fatalf("want identity %v but got %v", want, *identity)
+		}
+		if !reflect.DeepEqual(conn.Bytes(), []byte{PasswordAuthVersion, PasswordAuthSuccess}) {
+			t.Fatalf("want success reply but got %v", conn.Bytes())
+		}
+	})
+
+	t.Run("wrong password should fail", func(t *testing.T) {
+		conn := bytes.Buffer{}
+		conn.Write([]byte{PasswordAuthVersion, 3, '1', '2', '3', 3, '4', '5', '7'})
+		_, err := authenticator.Authenticate(&conn, nil)
+		if err != ErrPasswordAuthFailure {
+			t.Fatalf("want err = %s but got %v", ErrPasswordAuthFailure, err)
+		}
+		if !reflect.DeepEqual(conn.Bytes(), []byte{PasswordAuthVersion, PasswordAuthFailure}) {
+			t.Fatalf("want failure reply but got %v", conn.Bytes())
+		}
+	})
+
+	t.Run("missing checker should fail", func(t *testing.T) {
+		_, err := PasswordAuthenticator{}.Authenticate(&bytes.Buffer{}, nil)
+		if err != ErrPasswordCheckerNotSet {
+			t.Fatalf("want err = %s but got %v", ErrPasswordCheckerNotSet, err)
+		}
+	})
+}
+
+// newTestCertificate issues a certificate by parent, or a self-signed CA when parent is nil.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertificateAuthenticator(t *testing.T) {
+	ca := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.Leaf)
+	serverCert := newTestCertificate(t, &x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	newClientCert := func(parent *tls.Certificate) tls.Certificate {
+		return newTestCertificate(t, &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "alice"},
+			EmailAddresses: []string{"alice@example.com"},
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, parent)
+	}
+
+	t.Run("should map the fields of the certificate", func(t *testing.T) {
+		uri, _ := url.Parse("spiffe://example.com/alice")
+		certificate := &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "alice"},
+			DNSNames:       []string{"alice.example.com"},
+			EmailAddresses: []string{"alice@example.com"},
+			URIs:           []*url.URL{uri},
+		}
+		tests := map[CertificateUserField]string{
+			"":                        "alice",
+			CertificateUserCommonName: "alice",
+			CertificateUserDnsSan:     "alice.example.com",
+			CertificateUserEmailSan:   "alice@example.com",
+			CertificateUserUriSan:     "spiffe://example.com/alice",
+		}
+		for field, want := range tests {
+			if got := certificateUsername(certificate, field); got != want {
+				t.Fatalf("want %s of %q but got %s", want, field, got)
+			}
+		}
+		if got := certificateUsername(&x509.Certificate{}, CertificateUserEmailSan); got != "" {
+			t.Fatalf("want empty username but got %s", got)
+		}
+	})
+
+	echoAddr := runTestEchoServer(t)
+	// only alice can connect, so the identity must come from the certificate
+	rules, err := NewRuleSet([]Rule{{Action: RuleAllow, Users: []string{"alice"}}}, RuleDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordHash, err := HashPassword("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewUserStore([]User{{Username: "alice", PasswordHash: passwordHash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocks5Server("127.0.0.1", 0, Config{
+		Authenticators: []Authenticator{
+			CertificateAuthenticator{Users: users},
+			PasswordAuthenticator{PasswordChecker: func(username, password string) bool {
+				return username == "alice" && password == "pass"
+			}},
+		},
+		UdpPort: UdpRelayClose,
+		Rules:   rules,
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(tls.NewListener(listener, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    caPool,
+	}))
+	t.Cleanup(func() { server.Close() })
+
+	newClient := func(username, password string, certificates ...tls.Certificate) *Client {
+		client := NewClient(listener.Addr().String(), username, password)
+		client.Forward = &tls.Dialer{Config: &tls.Config{RootCAs: caPool, Certificates: certificates}}
+		return client
+	}
+
+	t.Run("should skip the password with a client certificate", func(t *testing.T) {
+		conn, err := newClient("", "", newClientCert(&ca)).Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+	})
+
+	t.Run("should ask for the password without a client certificate", func(t *testing.T) {
+		conn, err := newClient("alice", "pass").Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+
+		_, err = newClient("", "").Dial("tcp", echoAddr)
+		if err == nil {
+			t.Fatalf("want error without the certificate and the password but got nil")
+		}
+	})
+
+	t.Run("should reject a certificate of another ca", func(t *testing.T) {
+		otherCa := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other ca"}}, nil)
+		_, err := newClient("", "", newClientCert(&otherCa)).Dial("tcp", echoAddr)
+		if err == nil {
+			t.Fatalf("want error with an unknown certificate but got nil")
+		}
+	})
+
+	t.Run("should reject a disabled or expired user of the store", func(t *testing.T) {
+		defer users.SetUsers([]User{{Username: "alice", PasswordHash: passwordHash}})
+		for _, user := range []User{
+			{Username: "alice", PasswordHash: passwordHash, Disabled: true},
+			{Username: "alice", PasswordHash: passwordHash, Expires: time.Now().Add(-time.Hour)},
+		} {
+			if err := users.SetUsers([]User{user}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := newClient("", "", newClientCert(&ca)).Dial("tcp", echoAddr)
+			if err == nil {
+				t.Fatalf("want error with the certificate of %+v but got nil", user)
+			}
+		}
+	})
+}
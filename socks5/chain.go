@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	ErrUpstreamTypeNotSupport    = errors.New("upstream type not supported")
+	ErrUdpNotSupportedByUpstream = errors.New("udp is not supported by the upstream proxy")
+)
+
+type UpstreamType = string
+
+const (
+	UpstreamSocks5 UpstreamType = "socks5"
+	UpstreamHttp   UpstreamType = "http" // HTTP CONNECT
+)
+
+// Upstream is a proxy which outbound connections go through.
+type Upstream struct {
+	Type     UpstreamType
+	Address  string // similar to "x.x.x.x:x"
+	Username string // empty means no authentication
+	Password string
+}
+
+// PacketListener opens a packet connection to reach udp destinations, such as Client.ListenPacket.
+type PacketListener interface {
+	ListenPacket(ctx context.Context) (net.PacketConn, error)
+}
+
+// ProxyChain dials through a list of upstream proxies in order.
+// Every upstream is reached through the ones before it, and the first one is reached by the forward dialer.
+type ProxyChain struct {
+	dialer ContextDialer
+	// udp is not supported when any upstream is not socks5
+	supportsUdp bool
+	// nil means a direct udp socket
+	packetListener PacketListener
+}
+
+// NewProxyChain builds the chain of upstreams.
+// forward is used to reach the first upstream. nil means net.Dialer.
+func NewProxyChain(forward ContextDialer, upstreams []Upstream) (*ProxyChain, error) {
+	if forward == nil {
+		forward = directDialer{}
+	}
+	chain := &ProxyChain{
+		dialer:      forward,
+		supportsUdp: true,
+	}
+	for _, upstream := range upstreams {
+		switch upstream.Type {
+		case UpstreamSocks5:
+			client := &Client{
+				ProxyAddr: upstream.Address,
+				Username:  upstream.Username,
+				Password:  upstream.Password,
+				Forward:   chain.dialer,
+			}
+			if chain.supportsUdp {
+				client.PacketForward = chain.packetListener
+				chain.packetListener = client
+			}
+			chain.dialer = client
+		case UpstreamHttp:
+			chain.dialer = &httpConnectDialer{
+				address:  upstream.Address,
+				username: upstream.Username,
+				password: upstream.Password,
+				forward:  chain.dialer,
+			}
+			chain.supportsUdp = false
+			chain.packetListener = nil
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUpstreamTypeNotSupport, upstream.Type)
+		}
+	}
+	return chain, nil
+}
+
+func (c *ProxyChain) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return c.dialer.DialContext(ctx, network, address)
+}
+
+// ListenPacket opens a udp association through the chain.
+// It returns ErrUdpNotSupportedByUpstream when any upstream is not socks5.
+func (c *ProxyChain) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if !c.supportsUdp {
+		return nil, ErrUdpNotSupportedByUpstream
+	}
+	if c.packetListener == nil {
+		return listenUdp(ctx)
+	}
+	return c.packetListener.ListenPacket(ctx)
+}
+
+// SupportsUdp reports whether udp can go through the chain.
+func (c *ProxyChain) SupportsUdp() bool {
+	return c.supportsUdp
+}
+
+// httpConnectDialer dials through a http proxy by CONNECT.
+type httpConnectDialer struct {
+	address  string
+	username string
+	password string
+	forward  ContextDialer
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrNetworkNotSupport
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader *bufio.Reader
+	err = withContext(ctx, conn, func() error {
+		request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+		if d.username != "" {
+			credential := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+			request += "Proxy-Authorization: Basic " + credential + "\r\n"
+		}
+		request += "\r\n"
+		if _, err := conn.Write([]byte(request)); err != nil {
+			return err
+		}
+
+		reader = bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("http proxy %s: %s", d.address, response.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the proxy may have sent data of the tunnel together with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the buffered data first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// NetConn returns the wrapped connection, the same as tls.Conn.
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// runTestHttpConnectProxy runs a http proxy which only supports CONNECT with user 123 and password 456.
+func runTestHttpConnectProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				username, password, ok := parseTestProxyAuthorization(request)
+				if request.Method != http.MethodConnect || !ok || username != "123" || password != "456" {
+					conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				destConn, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer destConn.Close()
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(destConn, conn)
+				io.Copy(conn, destConn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func parseTestProxyAuthorization(request *http.Request) (string, string, bool) {
+	request.Header.Set("Authorization", request.Header.Get("Proxy-Authorization"))
+	return request.BasicAuth()
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("want ping but got %s", buf)
+	}
+}
+
+func TestProxyChain(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	socksAddr := newTestPasswordServer(t)
+	httpAddr := runTestHttpConnectProxy(t)
+	// a second socks5 server, which is reached through the first one
+	secondSocksAddr := newTestPasswordServer(t)
+
+	t.Run("should dial through socks5 and http upstreams", func(t *testing.T) {
+		chain, err := NewProxyChain(nil, []Upstream{
+			{Type: UpstreamHttp, Address: httpAddr, Username: "123", Password: "456"},
+			{Type: UpstreamSocks5, Address: socksAddr, Username: "123", Password: "456"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := chain.DialContext(context.Background(), "tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+
+		if _, err := chain.ListenPacket(context.Background()); err != ErrUdpNotSupportedByUpstream {
+			t.Fatalf("want err = %s but got %v", ErrUdpNotSupportedByUpstream, err)
+		}
+	})
+
+	t.Run("wrong http credential should fail", func(t *testing.T) {
+		chain, err := NewProxyChain(nil, []Upstream{
+			{Type: UpstreamHttp, Address: httpAddr, Username: "123", Password: "789"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.DialContext(context.Background(), "tcp", echoAddr); err == nil {
+			t.Fatalf("want error but got nil")
+		}
+	})
+
+	t.Run("udp should go through socks5 upstreams", func(t *testing.T) {
+		chain, err := NewProxyChain(nil, []Upstream{
+			{Type: UpstreamSocks5, Address: socksAddr, Username: "123", Password: "456"},
+			{Type: UpstreamSocks5, Address: secondSocksAddr, Username: "123", Password: "456"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := chain.ListenPacket(context.Background())
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+
+		udpAddr, _ := net.ResolveUDPAddr("udp", echoAddr)
+		if _, err := conn.WriteTo([]byte("ping"), udpAddr); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		buf := make([]byte, 100)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Fatalf("want ping but got %s", buf[:n])
+		}
+	})
+
+	t.Run("unknown type should fail", func(t *testing.T) {
+		_, err := NewProxyChain(nil, []Upstream{{Type: "socks4", Address: socksAddr}})
+		if !errors.Is(err, ErrUpstreamTypeNotSupport) {
+			t.Fatalf("want err = %s but got %v", ErrUpstreamTypeNotSupport, err)
+		}
+	})
+
+	t.Run("server should dial through upstreams", func(t *testing.T) {
+		server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+		server.Config.Upstreams = []Upstream{
+			{Type: UpstreamSocks5, Address: socksAddr, Username: "123", Password: "456"},
+		}
+		addr, _ := runTestServer(t, server)
+		defer server.Close()
+
+		conn, err := NewClient(addr, "", "").Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+	})
+}
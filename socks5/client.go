@@ -0,0 +1,435 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNetworkNotSupport = errors.New("network not supported")
+	ErrBindAccepted      = errors.New("bind: the incoming connection has been accepted")
+)
+
+// ContextDialer dials with a context.
+// It is the same as ContextDialer of golang.org/x/net/proxy, so Client can be used there.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Client talks to a socks5 server.
+// It supports CONNECT by Dial and DialContext, BIND by Bind and UDP ASSOCIATE by ListenPacket.
+type Client struct {
+	// ProxyAddr is the address of the socks5 server, similar to "x.x.x.x:x".
+	ProxyAddr string
+	// Username and Password are used for username/password authentication.
+	// When Username is empty, only no-auth is offered.
+	Username string
+	Password string
+	// Forward is used to reach the socks5 server. nil means net.Dialer.
+	Forward ContextDialer
+	// PacketForward opens the packet connection which reaches the udp relay of the server,
+	// such as the Client of the previous proxy in a chain. nil means a udp socket on a random port.
+	PacketForward PacketListener
+}
+
+func NewClient(proxyAddr, username, password string) *Client {
+	return &Client{
+		ProxyAddr: proxyAddr,
+		Username:  username,
+		Password:  password,
+	}
+}
+
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the socks5 server by CONNECT.
+// Only tcp networks are supported.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrNetworkNotSupport
+	}
+
+	conn, _, err := c.request(ctx, CmdConnect, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Bind asks the socks5 server to accept one connection from address by BIND.
+// The returned listener reports the address the peer should connect to, and Accept waits for the peer.
+func (c *Client) Bind(ctx context.Context, address string) (*BindListener, error) {
+	conn, reply, err := c.request(ctx, CmdBind, address)
+	if err != nil {
+		return nil, err
+	}
+	listener := &BindListener{
+		conn: conn,
+		addr: c.replyAddr("tcp", reply),
+	}
+	return listener, nil
+}
+
+// ListenPacket opens a udp association through the socks5 server by UDP ASSOCIATE.
+// The datagrams are encapsulated and sent through the relay of the server.
+// The association ends when the returned connection is closed.
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var packetConn net.PacketConn
+	var err error
+	if c.PacketForward != nil {
+		packetConn, err = c.PacketForward.ListenPacket(ctx)
+	} else {
+		packetConn, err = net.ListenUDP("udp", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+
+	// tell the server where the datagrams will come from
+	// The address is unknown when the datagrams go through another proxy.
+	localIp := addrIp(conn.LocalAddr())
+	localPort := 0
+	if udpAddr, ok := packetConn.LocalAddr().(*net.UDPAddr); ok && c.PacketForward == nil {
+		localPort = udpAddr.Port
+	} else {
+		localIp = nil
+	}
+	if localIp == nil {
+		localIp = net.IPv4zero
+	}
+	reply, err := c.sendRequest(ctx, conn, cmdUdp, net.JoinHostPort(localIp.String(), strconv.Itoa(localPort)))
+	if err != nil {
+		conn.Close()
+		packetConn.Close()
+		return nil, err
+	}
+
+	relayAddr := c.replyAddr("udp", reply)
+	if _, ok := relayAddr.(*hostAddr); ok && c.PacketForward == nil {
+		relayAddr, err = net.ResolveUDPAddr("udp", relayAddr.String())
+		if err != nil {
+			conn.Close()
+			packetConn.Close()
+			return nil, err
+		}
+	}
+
+	udpConn := &udpPacketConn{
+		PacketConn: packetConn,
+		conn:       conn,
+		relayAddr:  relayAddr,
+	}
+	// the association ends when the server closes the tcp connection
+	go func() {
+		io.Copy(io.Discard, conn)
+		udpConn.Close()
+	}()
+	return udpConn, nil
+}
+
+// request connects to the server, negotiates and sends the request.
+func (c *Client) request(ctx context.Context, cmd Command, address string) (net.Conn, *ServerReplyMessage, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := c.sendRequest(ctx, conn, cmd, address)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reply, nil
+}
+
+// connect connects to the server and negotiates the authentication method.
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	var forward ContextDialer = c.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	err = withContext(ctx, conn, func() error {
+		return c.auth(conn)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Client) auth(conn net.Conn) error {
+	methods := []AuthMethod{MethodNoAuth}
+	if c.Username != "" {
+		methods = append(methods, MethodPassword)
+	}
+	err := WriteClientAuthMessage(conn, methods)
+	if err != nil {
+		return err
+	}
+
+	method, err := NewServerAuthMessage(conn)
+	if err != nil {
+		return err
+	}
+	switch {
+	case method == MethodNoAuth:
+		return nil
+	case method == MethodPassword && c.Username != "":
+		err := WriteClientPasswordAuthMessage(conn, c.Username, c.Password)
+		if err != nil {
+			return err
+		}
+		status, err := NewServerPasswordMessage(conn)
+		if err != nil {
+			return err
+		}
+		if status != PasswordAuthSuccess {
+			return ErrPasswordAuthFailure
+		}
+		return nil
+	default:
+		return ErrAuthMethodNotSupport
+	}
+}
+
+func (c *Client) sendRequest(ctx context.Context, conn net.Conn, cmd Command, address string) (*ServerReplyMessage, error) {
+	var reply *ServerReplyMessage
+	err := withContext(ctx, conn, func() error {
+		err := WriteClientRequestMessage(conn, cmd, address)
+		if err != nil {
+			return err
+		}
+		reply, err = NewServerReplyMessage(conn)
+		if err != nil {
+			return err
+		}
+		if reply.Reply != ReplySuccess {
+			return &ReplyError{Reply: reply.Reply}
+		}
+		return nil
+	})
+	return reply, err
+}
+
+// withContext runs f, which talks on conn, until ctx is done.
+func withContext(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// interrupt the blocking read and write
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err := f()
+	close(done)
+	<-stopped
+	conn.SetDeadline(time.Time{})
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// the deadline of conn may pass a moment before ctx is done
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// replyAddr returns the address in the reply.
+// An unspecified address means the address of the socks5 server.
+func (c *Client) replyAddr(network string, reply *ServerReplyMessage) net.Addr {
+	ip := net.ParseIP(reply.Address)
+	if ip != nil && ip.IsUnspecified() {
+		proxyHost, _, err := net.SplitHostPort(c.ProxyAddr)
+		if err == nil {
+			return newAddr(network, net.JoinHostPort(proxyHost, strconv.Itoa(int(reply.Port))))
+		}
+	}
+	return newAddr(network, reply.Host())
+}
+
+// hostAddr is a net.Addr whose host may be a domain name.
+type hostAddr struct {
+	network string
+	host    string
+}
+
+func (a *hostAddr) Network() string {
+	return a.network
+}
+
+func (a *hostAddr) String() string {
+	return a.host
+}
+
+// newAddr returns *net.TCPAddr or *net.UDPAddr when the host of address is an ip, otherwise a hostAddr.
+func newAddr(network, address string) net.Addr {
+	host, port, err := net.SplitHostPort(address)
+	if err == nil {
+		ip := net.ParseIP(host)
+		portInt, err := strconv.Atoi(port)
+		if ip != nil && err == nil {
+			if network == "udp" {
+				return &net.UDPAddr{IP: ip, Port: portInt}
+			}
+			return &net.TCPAddr{IP: ip, Port: portInt}
+		}
+	}
+	return &hostAddr{network: network, host: address}
+}
+
+// BindListener waits for the incoming connection of BIND. It accepts only one connection.
+type BindListener struct {
+	conn     net.Conn
+	addr     net.Addr
+	accepted bool
+	mutex    sync.Mutex
+}
+
+// Addr returns the address the peer should connect to.
+func (l *BindListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Accept waits for the second reply of BIND and returns the connection to the peer.
+func (l *BindListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.accepted {
+		return nil, ErrBindAccepted
+	}
+	l.accepted = true
+
+	reply, err := NewServerReplyMessage(l.conn)
+	if err != nil {
+		l.conn.Close()
+		return nil, err
+	}
+	if reply.Reply != ReplySuccess {
+		l.conn.Close()
+		return nil, &ReplyError{Reply: reply.Reply}
+	}
+	return &bindConn{Conn: l.conn, remoteAddr: newAddr("tcp", reply.Host())}, nil
+}
+
+// Close gives up waiting. It does not close the accepted connection.
+func (l *BindListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.accepted {
+		return nil
+	}
+	l.accepted = true
+	return l.conn.Close()
+}
+
+type bindConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the address of the peer instead of the socks5 server.
+func (c *bindConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// udpPacketConn encapsulates the datagrams of a udp association.
+type udpPacketConn struct {
+	net.PacketConn
+	conn      net.Conn // the tcp connection which keeps the association alive
+	relayAddr net.Addr
+	closeOnce sync.Once
+	closeErr  error
+	readMutex sync.Mutex // guards readBuf
+	readBuf   []byte
+}
+
+func (c *udpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	forwardBytes, err := NewUdpClientForwardBytes(addr.String(), b)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(forwardBytes, c.relayAddr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if c.readBuf == nil {
+		c.readBuf = make([]byte, MaxUdpBufLength)
+	}
+	buf := c.readBuf
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// anyone can send to the local port, but only the relay speaks for the destinations
+		if !c.fromRelay(from) {
+			continue
+		}
+		message, err := NewUdpClientForwardMessage(buf[:n])
+		// the relay never fragments, so a fragment is dropped like a malformed datagram
+		if err != nil || message.FPAG != 0x00 {
+			continue
+		}
+		n = copy(b, message.Data)
+		addr := newAddr("udp", net.JoinHostPort(message.Address, strconv.Itoa(int(message.Port))))
+		return n, addr, nil
+	}
+}
+
+// fromRelay reports whether a datagram from addr was sent by the relay.
+// A relay named by a domain, which is resolved by the PacketForward, is checked by its port only.
+func (c *udpPacketConn) fromRelay(addr net.Addr) bool {
+	relayIp, relayPort := addrIpPort(c.relayAddr)
+	ip, port := addrIpPort(addr)
+	if port != relayPort {
+		return false
+	}
+	return relayIp == nil || relayIp.Equal(ip)
+}
+
+func (c *udpPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		c.closeErr = c.PacketConn.Close()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,210 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// runTestEchoServer runs a tcp and a udp echo server on the same loopback port.
+func runTestEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	udpConn, err := NewUdpConn(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+	go func() {
+		buf := make([]byte, MaxUdpBufLength)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestPasswordServer(t *testing.T) string {
+	server := NewSocks5PasswordAuthServer("127.0.0.1", 0, "123", "456", false)
+	server.Config.UdpPort = UdpRelayRandomPort
+	addr, _ := runTestServer(t, server)
+	t.Cleanup(func() { server.Close() })
+	return addr
+}
+
+func TestClientDial(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	proxyAddr := newTestPasswordServer(t)
+
+	t.Run("should connect with password", func(t *testing.T) {
+		client := NewClient(proxyAddr, "123", "456")
+		conn, err := client.Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("want ping but got %s", buf)
+		}
+	})
+
+	t.Run("wrong password should fail", func(t *testing.T) {
+		client := NewClient(proxyAddr, "123", "789")
+		_, err := client.Dial("tcp", echoAddr)
+		if err != ErrPasswordAuthFailure {
+			t.Fatalf("want err = %s but got %v", ErrPasswordAuthFailure, err)
+		}
+	})
+
+	t.Run("failure reply should return ReplyError", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closedAddr := listener.Addr().String()
+		listener.Close()
+
+		client := NewClient(proxyAddr, "123", "456")
+		_, err = client.DialContext(context.Background(), "tcp", closedAddr)
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) {
+			t.Fatalf("want ReplyError but got %v", err)
+		}
+		if replyErr.Reply != ReplyConnectionRefused {
+			t.Fatalf("want reply %d but got %d", ReplyConnectionRefused, replyErr.Reply)
+		}
+	})
+
+	t.Run("context should stop the handshake", func(t *testing.T) {
+		// a server which never answers
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		client := NewClient(listener.Addr().String(), "", "")
+		_, err = client.DialContext(ctx, "tcp", echoAddr)
+		if err != context.DeadlineExceeded {
+			t.Fatalf("want err = %s but got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+func TestClientBind(t *testing.T) {
+	proxyAddr := newTestPasswordServer(t)
+
+	client := NewClient(proxyAddr, "123", "456")
+	listener, err := client.Bind(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	defer listener.Close()
+
+	peerConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != peerConn.LocalAddr().String() {
+		t.Fatalf("want remote address %s but got %s", peerConn.LocalAddr(), conn.RemoteAddr())
+	}
+
+	peerConn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("want ping but got %s", buf)
+	}
+
+	if _, err := listener.Accept(); err != ErrBindAccepted {
+		t.Fatalf("want err = %s but got %v", ErrBindAccepted, err)
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	proxyAddr := newTestPasswordServer(t)
+
+	client := NewClient(proxyAddr, "123", "456")
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	defer conn.Close()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a datagram which does not come from the relay is dropped
+	forged, err := NewUdpClientForwardBytes(echoAddr, []byte("forged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherConn.Close()
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	if _, err := otherConn.WriteTo(forged, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: localPort}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.WriteTo([]byte("ping"), udpAddr); err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 100)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Fatalf("want ping but got %s", buf[:n])
+	}
+	if addr.String() != echoAddr {
+		t.Fatalf("want address %s but got %s", echoAddr, addr)
+	}
+}
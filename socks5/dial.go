@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// dialTcp resolves the destination, checks the rules and connects to it.
+// Through upstreams, the domain is sent as is and resolved by the last upstream.
+func (c *serverConfig) dialTcp(ctx context.Context, request *RuleRequest) (net.Conn, error) {
+	if len(c.Upstreams) > 0 {
+		allow, outbound := c.Rules.Decide(request)
+		if !allow {
+			return nil, ErrRuleDenied
+		}
+		ctx = contextWithOutbound(ctx, c.outbound(outbound))
+		return c.chain.DialContext(ctx, "tcp", net.JoinHostPort(request.Address, strconv.Itoa(int(request.Port))))
+	}
+
+	ips, outbound, err := c.destIps(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// dial the checked ips instead of the domain, so it can not be resolved to another ip again
+	ctx = contextWithOutbound(ctx, c.outbound(outbound))
+	return c.dialIps(ctx, ips, request.Port)
+}
+
+// udpDestAddr resolves the destination of a datagram and checks the rules.
+func (c *serverConfig) udpDestAddr(ctx context.Context, request *RuleRequest) (net.Addr, error) {
+	port := strconv.Itoa(int(request.Port))
+	if len(c.Upstreams) > 0 {
+		if !c.Rules.Allow(request) {
+			return nil, ErrRuleDenied
+		}
+		return newAddr("udp", net.JoinHostPort(request.Address, port)), nil
+	}
+
+	ips, _, err := c.destIps(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: int(request.Port)}, nil
+}
+
+// destIps resolves the destination, and returns the ips which the rules allow, in the order of DialFamily.
+// It also returns the outbound of the deciding rule.
+// The rules which do not need the ips are checked first, so a denied domain is never resolved.
+func (c *serverConfig) destIps(ctx context.Context, request *RuleRequest) ([]net.IP, *Outbound, error) {
+	decided, allow, outbound := c.Rules.decideByName(request)
+	if decided && !allow {
+		return nil, nil, ErrRuleDenied
+	}
+	ips, err := c.resolveRequest(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !decided {
+		ips, outbound = c.Rules.allowedIps(request, ips)
+		if len(ips) == 0 {
+			return nil, nil, ErrRuleDenied
+		}
+	}
+	ips, err = c.familyIps(request, ips)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ips, outbound, nil
+}
+
+// familyIps orders the ips by DialFamily, and fails when none of them is of the allowed family.
+func (c *serverConfig) familyIps(request *RuleRequest, ips []net.IP) ([]net.IP, error) {
+	ordered := c.orderIps(ips)
+	if len(ordered) == 0 {
+		return nil, &net.DNSError{Err: "no address of " + c.DialFamily, Name: request.Address, IsNotFound: true}
+	}
+	return ordered, nil
+}
+
+// outbound returns the outbound of the rule, or the one of the config.
+func (c *serverConfig) outbound(ruleOutbound *Outbound) *Outbound {
+	if ruleOutbound != nil {
+		return ruleOutbound
+	}
+	return &c.Outbound
+}
+
+// resolveRequest returns the ips of the destination.
+func (c *serverConfig) resolveRequest(ctx context.Context, request *RuleRequest) ([]net.IP, error) {
+	if ip := net.ParseIP(request.Address); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return c.resolver().LookupIP(ctx, request.Address)
+}
+
+// resolver returns the configured resolver, or the system one. c may be nil.
+func (c *serverConfig) resolver() Resolver {
+	if c == nil || c.Resolver == nil {
+		return systemResolver{}
+	}
+	return c.Resolver
+}
@@ -0,0 +1,198 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// The parts of the DNS message format (RFC 1035) which the resolver uses.
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeSOA  uint16 = 6
+	dnsTypeAAAA uint16 = 28
+	dnsClassIN  uint16 = 1
+
+	dnsRcodeSuccess   = 0
+	dnsRcodeNameError = 3
+
+	dnsHeaderLength  = 12
+	dnsMaxNameLength = 255
+)
+
+var (
+	ErrDnsBadMessage = errors.New("dns: bad message")
+	ErrDnsBadName    = errors.New("dns: bad domain name")
+)
+
+// dnsResponse is what the resolver needs from a response.
+type dnsResponse struct {
+	rcode     int
+	truncated bool
+	ips       []net.IP
+	ttl       uint32 // the smallest ttl of ips
+	// the ttl of a negative answer, from the SOA record of the authority section
+	negativeTtl uint32
+	hasSoa      bool
+}
+
+// newDnsQuery builds a recursive query of the question name and qtype.
+func newDnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLength, dnsHeaderLength+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg, err := appendDnsName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+func appendDnsName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > dnsMaxNameLength-2 {
+		return nil, ErrDnsBadName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, ErrDnsBadName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0), nil
+}
+
+// readDnsName reads the name at off, following compression pointers.
+// It returns the name without the trailing dot, and the offset after the name.
+func readDnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, ErrDnsBadMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, ErrDnsBadMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			// a loop of pointers is a bad message
+			jumps++
+			if jumps > 64 {
+				return "", 0, ErrDnsBadMessage
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, ErrDnsBadMessage
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, ErrDnsBadMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// parseDnsResponse parses the response of the query of id, name and qtype.
+// The addresses of qtype are collected from the answer section, so CNAME chains are followed by the upstream.
+func parseDnsResponse(msg []byte, id uint16, name string, qtype uint16) (*dnsResponse, error) {
+	if len(msg) < dnsHeaderLength {
+		return nil, ErrDnsBadMessage
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != id || msg[2]&0x80 == 0 {
+		return nil, ErrDnsBadMessage
+	}
+	response := &dnsResponse{
+		rcode:     int(msg[3] & 0x0f),
+		truncated: msg[2]&0x02 != 0,
+	}
+	qdCount := binary.BigEndian.Uint16(msg[4:6])
+	anCount := binary.BigEndian.Uint16(msg[6:8])
+	nsCount := binary.BigEndian.Uint16(msg[8:10])
+
+	off := dnsHeaderLength
+	if qdCount != 1 {
+		return nil, ErrDnsBadMessage
+	}
+	questionName, off, err := readDnsName(msg, off)
+	if err != nil {
+		return nil, err
+	}
+	if off+4 > len(msg) {
+		return nil, ErrDnsBadMessage
+	}
+	if !strings.EqualFold(questionName, strings.TrimSuffix(name, ".")) || binary.BigEndian.Uint16(msg[off:]) != qtype {
+		return nil, ErrDnsBadMessage
+	}
+	off += 4
+	if response.truncated {
+		return response, nil
+	}
+
+	for i := 0; i < int(anCount)+int(nsCount); i++ {
+		_, off, err = readDnsName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, ErrDnsBadMessage
+		}
+		rrType := binary.BigEndian.Uint16(msg[off:])
+		rrClass := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, ErrDnsBadMessage
+		}
+		data := msg[off : off+length]
+
+		switch {
+		case i < int(anCount) && rrClass == dnsClassIN && rrType == qtype:
+			if (qtype == dnsTypeA && length != net.IPv4len) || (qtype == dnsTypeAAAA && length != net.IPv6len) {
+				return nil, ErrDnsBadMessage
+			}
+			if len(response.ips) == 0 || ttl < response.ttl {
+				response.ttl = ttl
+			}
+			response.ips = append(response.ips, net.IP(append([]byte(nil), data...)))
+		case i >= int(anCount) && rrType == dnsTypeSOA:
+			// RFC 2308: the ttl of a negative answer is the smaller of the SOA ttl and its MINIMUM field
+			_, soaOff, err := readDnsName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			_, soaOff, err = readDnsName(msg, soaOff)
+			if err != nil {
+				return nil, err
+			}
+			if soaOff+20 > off+length {
+				return nil, ErrDnsBadMessage
+			}
+			minimum := binary.BigEndian.Uint32(msg[soaOff+16:])
+			if minimum < ttl {
+				ttl = minimum
+			}
+			response.negativeTtl = ttl
+			response.hasSoa = true
+		}
+		off += length
+	}
+	return response, nil
+}
@@ -10,13 +10,15 @@ import (
 
 var (
 	ErrUdpForwardVersionNotSupported = errors.New("udp forward version not supported")
-	ErrUdpReassembleNotSupported     = errors.New("udp frame reassemble not supported")
+	ErrUdpForwardMessageTooShort     = errors.New("udp forward message too short")
+	// Deprecated: fragments are reassembled by UdpReassembler now.
+	ErrUdpReassembleNotSupported = errors.New("udp frame reassemble not supported")
 )
 
 var UdpForwardVersion = []byte{0, 0}
 
 type UdpClientForwardMessage struct {
-	FPAG        byte // 0x00 means complete. otherwise means
+	FPAG        byte // 0x00 means complete. otherwise means the position of the fragment, see UdpReassembler
 	AddressType AddressType
 	Address     string
 	Port        uint16
@@ -25,15 +27,16 @@ type UdpClientForwardMessage struct {
 
 func NewUdpClientForwardMessage(bytes []byte) (*UdpClientForwardMessage, error) {
 	udpClientForwardMessage := &UdpClientForwardMessage{}
+	// version, fragment number, address type and at least one byte of address
+	if len(bytes) < 5 {
+		return nil, ErrUdpForwardMessageTooShort
+	}
 	version := bytes[:2]
 	if !reflect.DeepEqual(version, UdpForwardVersion) {
 		return nil, ErrUdpForwardVersionNotSupported
 	}
 
-	FPAG := bytes[2] // Current fragment number
-	if FPAG != 0x00 {
-		return nil, ErrUdpReassembleNotSupported
-	}
+	udpClientForwardMessage.FPAG = bytes[2] // Current fragment number
 
 	addressType := bytes[3]
 	if addressType != AddressTypeIpv4 && addressType != AddressTypeIpv6 && addressType != AddressTypeDomain {
@@ -53,6 +56,9 @@ func NewUdpClientForwardMessage(bytes []byte) (*UdpClientForwardMessage, error)
 		startAddrIndex += 1
 		endAddrIndex = startAddrIndex + int(domainLength)
 	}
+	if len(bytes) < endAddrIndex+PortLength {
+		return nil, ErrUdpForwardMessageTooShort
+	}
 	addr := bytes[startAddrIndex:endAddrIndex]
 	switch addressType {
 	case AddressTypeIpv4:
@@ -74,16 +80,23 @@ func NewUdpClientForwardMessage(bytes []byte) (*UdpClientForwardMessage, error)
 }
 
 func NewUdpServerForwardBytes(addr net.Addr, data []byte) ([]byte, error) {
-	hostByte, err := GetHostByteFromString(addr.String())
+	return NewUdpClientForwardBytes(addr.String(), data)
+}
+
+// NewUdpClientForwardBytes is used by the client to encapsulate data sent to host through the udp relay.
+// The header is the same in both directions, so NewUdpClientForwardMessage parses the datagrams from the relay, too.
+// host: similar to "x.x.x.x:x" or "example.com:x"
+func NewUdpClientForwardBytes(host string, data []byte) ([]byte, error) {
+	hostByte, err := GetHostByteFromString(host)
 	if err != nil {
 		return nil, err
 	}
-	var toClientBytes []byte
-	toClientBytes = append(toClientBytes, UdpForwardVersion...)
-	toClientBytes = append(toClientBytes, 0x00)
-	toClientBytes = append(toClientBytes, hostByte...)
-	toClientBytes = append(toClientBytes, data...)
-	return toClientBytes, nil
+	forwardBytes := make([]byte, 0, 3+len(hostByte)+len(data))
+	forwardBytes = append(forwardBytes, UdpForwardVersion...)
+	forwardBytes = append(forwardBytes, 0x00)
+	forwardBytes = append(forwardBytes, hostByte...)
+	forwardBytes = append(forwardBytes, data...)
+	return forwardBytes, nil
 }
 
 // GetHostByteFromString is defined to generate [type, addr, port¬]
@@ -91,7 +104,7 @@ func GetHostByteFromString(hostStr string) ([]byte, error) {
 	var buf []byte
 	addr, port, err := net.SplitHostPort(hostStr)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	if ip := net.ParseIP(addr); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
@@ -103,12 +116,15 @@ func GetHostByteFromString(hostStr string) ([]byte, error) {
 			buf = append(buf, ip...)
 		}
 	} else {
+		if len(addr) > 255 {
+			return nil, ErrUnknownAddr
+		}
 		buf = append(buf, AddressTypeDomain)
 		buf = append(buf, byte(len(addr)))
 		buf = append(buf, []byte(addr)...)
 	}
 
-	portUint, err := strconv.ParseInt(port, 10, 16)
+	portUint, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
 		return nil, err
 	}
@@ -15,3 +15,46 @@ func TestGetHostByteFromString(t *testing.T) {
 		t.Fatalf("want %v, got %v", wantBytes, bytes)
 	}
 }
+
+func TestNewUdpClientForwardMessage(t *testing.T) {
+	t.Run("should keep the fragment number", func(t *testing.T) {
+		b := []byte{0, 0, 0x81, AddressTypeIpv4, 1, 1, 1, 1, 0x00, 0x35, 'a'}
+		message, err := NewUdpClientForwardMessage(b)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if message.FPAG != 0x81 || message.Address != "1.1.1.1" || message.Port != 53 || string(message.Data) != "a" {
+			t.Fatalf("got unexpected message %v", message)
+		}
+	})
+
+	t.Run("truncated message should return error", func(t *testing.T) {
+		tests := [][]byte{
+			{0, 0, 0},
+			{0, 0, 0, AddressTypeIpv4, 1, 1, 1, 1, 0x00},
+			{0, 0, 0, AddressTypeDomain, 10, 'a'},
+		}
+		for _, b := range tests {
+			_, err := NewUdpClientForwardMessage(b)
+			if err != ErrUdpForwardMessageTooShort {
+				t.Fatalf("want err = %s but got %v", ErrUdpForwardMessageTooShort, err)
+			}
+		}
+	})
+}
+
+func TestGetHostByteFromStringHighPort(t *testing.T) {
+	bytes, err := GetHostByteFromString("example.com:65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBytes := append([]byte{AddressTypeDomain, 11}, "example.com"...)
+	wantBytes = append(wantBytes, 0xff, 0xff)
+	if !reflect.DeepEqual(wantBytes, bytes) {
+		t.Fatalf("want %v, got %v", wantBytes, bytes)
+	}
+
+	if _, err := GetHostByteFromString("example.com"); err == nil {
+		t.Fatalf("want error for missing port but got nil")
+	}
+}
@@ -0,0 +1,330 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrHttpProxyAuthRequired = errors.New("http proxy: authentication required")
+	ErrHttpBadRequest        = errors.New("http proxy: bad request")
+)
+
+// hopByHopHeaders are only meaningful for a single connection, so they are never forwarded (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but sent by many clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HttpRelayServer serves a client of the http proxy, with the same config as TcpRelayServer.
+// A CONNECT request turns the connection into a tunnel, and the requests with absolute URIs
+// are forwarded one by one on a kept-alive connection.
+type HttpRelayServer struct {
+	Server   *Socks5Server
+	Conn     net.Conn  // usually *net.TCPConn, but any stream connection works
+	Identity *Identity // set after authentication
+	config   *serverConfig
+	reader   *bufio.Reader
+	// the destination of the last forwarded request, which is reused by the next one to the same host
+	destAddr   string
+	destConn   net.Conn
+	destReader *bufio.Reader
+}
+
+func (h *HttpRelayServer) HandleConnection() error {
+	// keep the configuration through the connection, even when the server is reloaded
+	h.config = h.Server.currentConfig()
+	h.config.Metrics.addTcpRelays(1)
+	defer h.config.Metrics.addTcpRelays(-1)
+	defer h.closeDest()
+
+	h.reader = bufio.NewReader(h.Conn)
+	for {
+		// a kept-alive client has the handshake timeout to send the next request
+		h.Conn.SetDeadline(h.config.handshakeDeadline())
+		request, err := http.ReadRequest(h.reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = h.auth(request)
+		if err != nil {
+			return err
+		}
+
+		err = h.config.checkQuota(h.Identity)
+		if err != nil {
+			h.writeError(request, http.StatusForbidden)
+			return err
+		}
+
+		if request.Method == http.MethodConnect {
+			return h.handleConnect(request)
+		}
+		keepAlive, err := h.handleForward(request)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+// auth authenticates the client by the authenticators of the config, in order.
+// NoAuthAuthenticator and CertificateAuthenticator let the client in, and PasswordAuthenticator checks Proxy-Authorization Basic.
+// Other authenticators only work for socks5, so they are skipped.
+func (h *HttpRelayServer) auth(request *http.Request) error {
+	for _, authenticator := range h.config.Authenticators {
+		if !acceptAuthenticator(authenticator, h.Conn) {
+			continue
+		}
+		switch authenticator := authenticator.(type) {
+		case NoAuthAuthenticator, CertificateAuthenticator:
+			identity, err := authenticator.Authenticate(h.Conn, h.Conn.RemoteAddr())
+			h.config.Metrics.addAuth(MethodNoAuth, err == nil)
+			if err != nil {
+				h.writeError(request, http.StatusProxyAuthRequired)
+				return err
+			}
+			h.Identity = identity
+			return nil
+		case PasswordAuthenticator:
+			username, password, ok := proxyBasicAuth(request)
+			if !ok {
+				continue
+			}
+			if authenticator.PasswordChecker == nil || !authenticator.PasswordChecker(username, password) {
+				h.config.Metrics.addAuth(MethodPassword, false)
+				h.writeError(request, http.StatusProxyAuthRequired)
+				return ErrPasswordAuthFailure
+			}
+			h.Identity = &Identity{Method: MethodPassword, Username: username}
+			h.config.Metrics.addAuth(MethodPassword, true)
+			return nil
+		}
+	}
+	h.config.Metrics.addAuth(MethodNoAcceptable, false)
+	h.writeError(request, http.StatusProxyAuthRequired)
+	return ErrHttpProxyAuthRequired
+}
+
+// proxyBasicAuth returns the username and password of the Proxy-Authorization header.
+func proxyBasicAuth(request *http.Request) (username, password string, ok bool) {
+	scheme, credential, ok := strings.Cut(request.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credential))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// handleConnect dials the destination and relays the tunnel until it is done.
+func (h *HttpRelayServer) handleConnect(request *http.Request) error {
+	destConn, err := h.dial(request, request.Host, "")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(h.Conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err == nil {
+		err = h.Conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		destConn.Close()
+		return err
+	}
+	// the client may have sent data of the tunnel together with the request
+	limiter := h.Server.bandwidthLimiter().acquire(h.Identity, addrIp(h.Conn.RemoteAddr()))
+	defer limiter.release()
+	return relay(&bufferedConn{Conn: h.Conn, reader: h.reader}, destConn, h.config.IdleTimeout, h.meter(limiter))
+}
+
+// handleForward forwards a request with an absolute URI and sends the response back.
+// It reports whether the client connection can be used by the next request.
+func (h *HttpRelayServer) handleForward(request *http.Request) (bool, error) {
+	if request.URL.Scheme != "http" || request.URL.Host == "" {
+		h.writeError(request, http.StatusBadRequest)
+		return false, fmt.Errorf("%w: %s %s", ErrHttpBadRequest, request.Method, request.URL)
+	}
+
+	addr := request.URL.Host
+	if h.destConn == nil || h.destAddr != addr {
+		h.closeDest()
+		destConn, err := h.dial(request, addr, "80")
+		if err != nil {
+			return false, err
+		}
+		h.destAddr = addr
+		h.destConn = destConn
+		h.destReader = bufio.NewReader(destConn)
+	}
+
+	// the destination is reached, and the body may take longer than the handshake,
+	// but not longer than the idle timeout without data
+	h.Conn.SetDeadline(time.Time{})
+	limiter := h.Server.bandwidthLimiter().acquire(h.Identity, addrIp(h.Conn.RemoteAddr()))
+	defer limiter.release()
+	var idle *idleTimer
+	if h.config.IdleTimeout > 0 {
+		destConn := h.destConn
+		idle = newIdleTimer(h.config.IdleTimeout, func() {
+			h.Conn.Close()
+			destConn.Close()
+			limiter.interrupt()
+		})
+		defer idle.stop()
+		if request.Body != nil && request.Body != http.NoBody {
+			request.Body = readCloser{Reader: idle.reader(request.Body), Closer: request.Body}
+		}
+	}
+	removeHopByHopHeaders(request.Header)
+	request.RequestURI = ""
+	meter := h.meter(limiter)
+	err := request.Write(meter.writer(h.destConn, "up"))
+	if err != nil {
+		h.writeError(request, http.StatusBadGateway)
+		return false, h.idleError(idle, err)
+	}
+	response, err := http.ReadResponse(h.destReader, request)
+	if err != nil {
+		h.writeError(request, http.StatusBadGateway)
+		return false, h.idleError(idle, err)
+	}
+	defer response.Body.Close()
+	if idle != nil {
+		response.Body = readCloser{Reader: idle.reader(response.Body), Closer: response.Body}
+	}
+	removeHopByHopHeaders(response.Header)
+	err = response.Write(meter.writer(h.Conn, "down"))
+	if err != nil {
+		return false, h.idleError(idle, err)
+	}
+	if response.Close {
+		// the destination closes the connection, or the length of the body is only known by closing
+		h.closeDest()
+		return false, nil
+	}
+	return !request.Close, nil
+}
+
+// idleError returns ErrRelayIdleTimeout instead of err when idle has closed the connections.
+func (h *HttpRelayServer) idleError(idle *idleTimer, err error) error {
+	if idle != nil && idle.expired.Load() {
+		h.closeDest()
+		return ErrRelayIdleTimeout
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// dial dials the authority of the request, such as "example.com:443", after checking the rules.
+// Failures are answered with 403, 502 or 504.
+func (h *HttpRelayServer) dial(request *http.Request, authority, defaultPort string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(authority)
+	if err != nil && defaultPort != "" {
+		host, portStr, err = strings.Trim(authority, "[]"), defaultPort, nil
+	}
+	port, portErr := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || portErr != nil || host == "" {
+		h.writeError(request, http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: invalid host %q", ErrHttpBadRequest, authority)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	dialStart := time.Now()
+	destConn, err := h.config.dialTcp(ctx, &RuleRequest{
+		Cmd:        CmdConnect,
+		ClientAddr: h.Conn.RemoteAddr(),
+		Identity:   h.Identity,
+		Address:    host,
+		Port:       uint16(port),
+	})
+	if err != ErrRuleDenied {
+		h.config.Metrics.observeDial(time.Since(dialStart), err)
+	}
+	if err != nil {
+		h.writeError(request, httpStatusFromError(err))
+		return nil, err
+	}
+	return destConn, nil
+}
+
+func (h *HttpRelayServer) closeDest() {
+	if h.destConn != nil {
+		h.destConn.Close()
+		h.destConn = nil
+		h.destReader = nil
+	}
+}
+
+func (h *HttpRelayServer) meter(limiter *connRateLimiter) relayMeter {
+	return relayMeter{
+		metrics: h.config.Metrics,
+		limiter: limiter,
+		usage:   h.config.Usage.account(h.Identity),
+	}
+}
+
+// writeError sends an empty response with status, and the connection is closed after it.
+func (h *HttpRelayServer) writeError(request *http.Request, status int) error {
+	response := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    request,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+	if status == http.StatusProxyAuthRequired {
+		response.Header.Set("Proxy-Authenticate", `Basic realm="go-proxy"`)
+	}
+	return response.Write(h.Conn)
+}
+
+// httpStatusFromError chooses the response status of a failed dial.
+func httpStatusFromError(err error) int {
+	switch ReplyFromError(err) {
+	case ReplyConnectionNotAllowed:
+		return http.StatusForbidden
+	case ReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers, and the headers listed by Connection.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
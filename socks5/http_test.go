@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// runTestHttpServer serves the http proxy on a random port and returns its address.
+func runTestHttpServer(t *testing.T, server *Socks5Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeHttp(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return listener.Addr().String()
+}
+
+func TestHttpRelayServer(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"Proxy-Authorization", "Proxy-Connection", "X-Hop"} {
+			if r.Header.Get(name) != "" {
+				t.Errorf("want header %s to be removed but got %q", name, r.Header.Get(name))
+			}
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	rules, err := NewRuleSet([]Rule{{Action: RuleDeny, Ports: []string{"2"}}}, RuleAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocks5Server("127.0.0.1", 0, Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		},
+		UdpPort: UdpRelayClose,
+		Rules:   rules,
+	})
+	proxyAddr := runTestHttpServer(t, server)
+
+	newClient := func(user *url.Userinfo) *http.Client {
+		proxyUrl := &url.URL{Scheme: "http", Host: proxyAddr, User: user}
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	}
+
+	t.Run("should forward requests with absolute URIs", func(t *testing.T) {
+		client := newClient(url.UserPassword("user", "pass"))
+		for i := 0; i < 2; i++ {
+			request, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+			request.Header.Set("Connection", "X-Hop")
+			request.Header.Set("X-Hop", "1")
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK || string(body) != "hello" {
+				t.Fatalf("want 200 hello but got %d %s", response.StatusCode, body)
+			}
+		}
+	})
+
+	t.Run("should tunnel CONNECT requests", func(t *testing.T) {
+		echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echoListener.Close()
+		go func() {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// the data of the tunnel is sent together with the request
+		io.WriteString(conn, "CONNECT "+echoListener.Addr().String()+" HTTP/1.1\r\n"+
+			"Host: "+echoListener.Addr().String()+"\r\n"+
+			"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\nping")
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("want status %d but got %d", http.StatusOK, response.StatusCode)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("want ping but got %s", buf)
+		}
+	})
+
+	statusTests := []struct {
+		name   string
+		user   *url.Userinfo
+		url    string
+		status int
+	}{
+		{"should require authentication", nil, origin.URL, http.StatusProxyAuthRequired},
+		{"should reject a wrong password", url.UserPassword("user", "wrong"), origin.URL, http.StatusProxyAuthRequired},
+		{"should reject denied destinations", url.UserPassword("user", "pass"), "http://127.0.0.1:2/", http.StatusForbidden},
+		{"should reply bad gateway when dial fails", url.UserPassword("user", "pass"), "http://127.0.0.1:1/", http.StatusBadGateway},
+	}
+	for _, test := range statusTests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := newClient(test.user).Get(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != test.status {
+				t.Fatalf("want status %d but got %d", test.status, response.StatusCode)
+			}
+			if test.status == http.StatusProxyAuthRequired && response.Header.Get("Proxy-Authenticate") == "" {
+				t.Fatalf("want Proxy-Authenticate header but got none")
+			}
+		})
+	}
+}
+
+func TestHttpRelayServerIdleTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	server := NewSocks5Server("127.0.0.1", 0, Config{UdpPort: UdpRelayClose, IdleTimeout: time.Millisecond * 300})
+	proxyAddr := runTestHttpServer(t, server)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the body never arrives after its first byte
+	io.WriteString(conn, "POST "+origin.URL+"/ HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+"\r\nContent-Length: 10\r\n\r\nx")
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("want the idle request closed after 300ms but got %s", elapsed)
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Connection", "close, X-Custom")
+	header.Set("X-Custom", "1")
+	header.Set("Keep-Alive", "timeout=5")
+	header.Set("Proxy-Authorization", "Basic eA==")
+	header.Set("Content-Type", "text/plain")
+	removeHopByHopHeaders(header)
+	if len(header) != 1 || header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("want only Content-Type but got %v", header)
+	}
+}
@@ -0,0 +1,276 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDialLatencyBuckets are the upper bounds of the dial latency histogram, in seconds.
+var DefaultDialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the counters and gauges of a server and exposes them in the Prometheus text format.
+// It is an http.Handler, so it can be served on any path, such as "/metrics".
+// All methods can be called on a nil *Metrics, which records nothing.
+type Metrics struct {
+	tcpRelays       int64
+	udpAssociations int64
+	udpExchanges    int64
+
+	bytes       counterVec // direction, protocol
+	auths       counterVec // method, result
+	commands    counterVec // command
+	replies     counterVec // reply
+	udpDrops    counterVec // reason
+	dialLatency histogramVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		dialLatency: histogramVec{buckets: DefaultDialLatencyBuckets},
+	}
+}
+
+func (m *Metrics) addTcpRelays(delta int64) {
+	if m != nil {
+		atomic.AddInt64(&m.tcpRelays, delta)
+	}
+}
+
+func (m *Metrics) addUdpAssociations(delta int64) {
+	if m != nil {
+		atomic.AddInt64(&m.udpAssociations, delta)
+	}
+}
+
+func (m *Metrics) addUdpExchanges(delta int64) {
+	if m != nil {
+		atomic.AddInt64(&m.udpExchanges, delta)
+	}
+}
+
+// addBytes counts relayed payload. direction is "up" (client to destination) or "down".
+func (m *Metrics) addBytes(direction, protocol string, n int) {
+	if m != nil && n > 0 {
+		m.bytes.add(uint64(n), "direction", direction, "protocol", protocol)
+	}
+}
+
+func (m *Metrics) addAuth(method AuthMethod, success bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.auths.add(1, "method", authMethodName(method), "result", result)
+}
+
+func (m *Metrics) addCommand(cmd Command) {
+	if m != nil {
+		m.commands.add(1, "command", commandName(cmd))
+	}
+}
+
+func (m *Metrics) addReply(reply ReplyType) {
+	if m != nil {
+		m.replies.add(1, "reply", replyName(reply))
+	}
+}
+
+// addUdpDrop counts a dropped datagram of a client, such as one without an association.
+func (m *Metrics) addUdpDrop(reason string) {
+	if m != nil {
+		m.udpDrops.add(1, "reason", reason)
+	}
+}
+
+func (m *Metrics) observeDial(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.dialLatency.observe(duration.Seconds(), "result", result)
+}
+
+// meteredWriter counts the bytes written through it.
+func (m *Metrics) meteredWriter(w io.Writer, direction, protocol string) io.Writer {
+	if m == nil {
+		return w
+	}
+	return writerFunc(func(b []byte) (int, error) {
+		n, err := w.Write(b)
+		m.addBytes(direction, protocol, n)
+		return n, err
+	})
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if m != nil {
+		writeGauge(&b, "go_proxy_tcp_relays_active", "Active tcp connections of clients.", atomic.LoadInt64(&m.tcpRelays))
+		writeGauge(&b, "go_proxy_udp_associations_active", "Active udp associations.", atomic.LoadInt64(&m.udpAssociations))
+		writeGauge(&b, "go_proxy_udp_exchanges_active", "Active udp sockets towards destinations.", atomic.LoadInt64(&m.udpExchanges))
+		m.bytes.write(&b, "go_proxy_bytes_total", "Relayed payload bytes.")
+		m.auths.write(&b, "go_proxy_auth_total", "Authentications by method and result.")
+		m.commands.write(&b, "go_proxy_requests_total", "Requests by command.")
+		m.replies.write(&b, "go_proxy_replies_total", "Replies by reply code.")
+		m.udpDrops.write(&b, "go_proxy_udp_dropped_total", "Dropped udp datagrams of clients by reason.")
+		m.dialLatency.write(&b, "go_proxy_dial_duration_seconds", "Latency of dialing destinations.")
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeGauge(b *strings.Builder, name, help string, value int64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// labelString renders pairs of label names and values, such as `method="password",result="success"`.
+func labelString(labels []string) string {
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]uint64 // rendered labels to value
+}
+
+func (c *counterVec) add(delta uint64, labels ...string) {
+	key := labelString(labels)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[key] += delta
+}
+
+func (c *counterVec) write(b *strings.Builder, name, help string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s{%s} %d\n", name, key, c.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogram
+}
+
+func (h *histogramVec) observe(value float64, labels ...string) {
+	key := labelString(labels)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.values == nil {
+		h.values = make(map[string]*histogram)
+	}
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += value
+	hist.count++
+}
+
+func (h *histogramVec) write(b *strings.Builder, name, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(b, "%s_bucket{%s,le=%q} %d\n", name, key, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, key, hist.count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, key, strconv.FormatFloat(hist.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, key, hist.count)
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func authMethodName(method AuthMethod) string {
+	switch method {
+	case MethodNoAuth:
+		return "no_auth"
+	case MethodGssApi:
+		return "gssapi"
+	case MethodPassword:
+		return "password"
+	case MethodNoAcceptable:
+		return "no_acceptable"
+	}
+	return fmt.Sprintf("0x%02x", method)
+}
+
+func commandName(cmd Command) string {
+	switch cmd {
+	case CmdConnect:
+		return "connect"
+	case CmdBind:
+		return "bind"
+	case cmdUdp:
+		return "udp"
+	}
+	return "unknown"
+}
+
+func replyName(reply ReplyType) string {
+	message, ok := replyMessages[reply]
+	if !ok {
+		return fmt.Sprintf("0x%02x", reply)
+	}
+	return message
+}
@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("should write the text format", func(t *testing.T) {
+		metrics := NewMetrics()
+		metrics.addTcpRelays(1)
+		metrics.addAuth(MethodPassword, true)
+		metrics.addAuth(MethodPassword, false)
+		metrics.addReply(ReplyConnectionRefused)
+		metrics.observeDial(time.Millisecond*20, nil)
+
+		var b strings.Builder
+		metrics.WriteTo(&b)
+		lines := []string{
+			"# TYPE go_proxy_tcp_relays_active gauge",
+			"go_proxy_tcp_relays_active 1",
+			`go_proxy_auth_total{method="password",result="failure"} 1`,
+			`go_proxy_auth_total{method="password",result="success"} 1`,
+			`go_proxy_replies_total{reply="connection refused"} 1`,
+			"# TYPE go_proxy_dial_duration_seconds histogram",
+			`go_proxy_dial_duration_seconds_bucket{result="success",le="0.01"} 0`,
+			`go_proxy_dial_duration_seconds_bucket{result="success",le="0.025"} 1`,
+			`go_proxy_dial_duration_seconds_bucket{result="success",le="+Inf"} 1`,
+			`go_proxy_dial_duration_seconds_count{result="success"} 1`,
+		}
+		for _, line := range lines {
+			if !strings.Contains(b.String(), line+"\n") {
+				t.Fatalf("want line %q in\n%s", line, b.String())
+			}
+		}
+	})
+
+	t.Run("nil metrics should record nothing", func(t *testing.T) {
+		var metrics *Metrics
+		metrics.addTcpRelays(1)
+		metrics.addBytes("up", "tcp", 10)
+		var b strings.Builder
+		if _, err := metrics.WriteTo(&b); err != nil || b.Len() != 0 {
+			t.Fatalf("want empty output but got %q, %v", b.String(), err)
+		}
+	})
+
+	t.Run("should be instrumented by the server", func(t *testing.T) {
+		echoAddr := runTestEchoServer(t)
+
+		server := NewSocks5PasswordAuthServer("127.0.0.1", 0, "123", "456", false)
+		server.Config.Metrics = NewMetrics()
+		addr, _ := runTestServer(t, server)
+		t.Cleanup(func() { server.Close() })
+
+		conn, err := NewClient(addr, "123", "456").DialContext(context.Background(), "tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		recorder := httptest.NewRecorder()
+		server.Config.Metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := recorder.Body.String()
+		lines := []string{
+			`go_proxy_auth_total{method="password",result="success"} 1`,
+			`go_proxy_requests_total{command="connect"} 1`,
+			`go_proxy_replies_total{reply="succeeded"} 1`,
+			`go_proxy_bytes_total{direction="up",protocol="tcp"} 4`,
+			`go_proxy_dial_duration_seconds_count{result="success"} 1`,
+		}
+		for _, line := range lines {
+			if !strings.Contains(body, line+"\n") {
+				t.Fatalf("want line %q in\n%s", line, body)
+			}
+		}
+	})
+}
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DialFamily chooses the ip family of outbound connections.
+type DialFamily = string
+
+const (
+	DialPreferIpv4    DialFamily = "prefer_ipv4"
+	DialPreferIpv6    DialFamily = "prefer_ipv6"
+	DialIpv4Only      DialFamily = "ipv4_only"
+	DialIpv6Only      DialFamily = "ipv6_only"
+	DialHappyEyeballs DialFamily = "happy_eyeballs" // RFC 8305
+)
+
+var (
+	ErrUnknownDialFamily = errors.New("unknown dial family")
+	ErrNoSourceAddress   = errors.New("no source address of the ip family")
+)
+
+// Outbound pins the source of outbound connections.
+type Outbound struct {
+	// SourceAddress is the local ip of outbound connections, such as "192.0.2.10".
+	SourceAddress string `mapstructure:"source_address"`
+	// Interface is the network interface whose address is the local ip, such as "eth1".
+	// The address of the family of the destination is chosen.
+	Interface string
+}
+
+func (o *Outbound) isZero() bool {
+	return o == nil || (o.SourceAddress == "" && o.Interface == "")
+}
+
+func (o *Outbound) check() error {
+	if o.SourceAddress != "" && net.ParseIP(o.SourceAddress) == nil {
+		return fmt.Errorf("invalid source address %q", o.SourceAddress)
+	}
+	if o.SourceAddress != "" && o.Interface != "" {
+		return fmt.Errorf("source address and interface can not be set together")
+	}
+	return nil
+}
+
+// localIp returns the source ip to reach remote. remote may be nil when it is a domain, and then ipv4 is preferred.
+func (o *Outbound) localIp(remote net.IP) (net.IP, error) {
+	if o.SourceAddress != "" {
+		return net.ParseIP(o.SourceAddress), nil
+	}
+	iface, err := net.InterfaceByName(o.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isIpv4 := ipNet.IP.To4() != nil
+		if remote == nil {
+			if isIpv4 {
+				return ipNet.IP, nil
+			}
+			if fallback == nil {
+				fallback = ipNet.IP
+			}
+		} else if isIpv4 == (remote.To4() != nil) {
+			return ipNet.IP, nil
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("%w: interface %s", ErrNoSourceAddress, o.Interface)
+}
+
+type outboundKey struct{}
+
+// contextWithOutbound lets the direct dialer and the udp sockets of ctx use outbound.
+func contextWithOutbound(ctx context.Context, outbound *Outbound) context.Context {
+	if outbound.isZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, outboundKey{}, outbound)
+}
+
+func outboundFromContext(ctx context.Context) *Outbound {
+	outbound, _ := ctx.Value(outboundKey{}).(*Outbound)
+	return outbound
+}
+
+// directDialer is net.Dialer with the source of the outbound in the context.
+type directDialer struct{}
+
+func (directDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if outbound := outboundFromContext(ctx); outbound != nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		localIp, err := outbound.localIp(net.ParseIP(host))
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: localIp}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// listenUdp opens a direct udp socket, from the source of the outbound in the context.
+func listenUdp(ctx context.Context) (*net.UDPConn, error) {
+	outbound := outboundFromContext(ctx)
+	if outbound == nil {
+		return NewUdpConn(":0")
+	}
+	localIp, err := outbound.localIp(nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewUdpConn(net.JoinHostPort(localIp.String(), "0"))
+}
+
+// orderIps orders the ips of a destination by the dial family.
+// Without a family, the order of the resolver is kept.
+func (c *serverConfig) orderIps(ips []net.IP) []net.IP {
+	var ipv4s, ipv6s []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4s = append(ipv4s, ip)
+		} else {
+			ipv6s = append(ipv6s, ip)
+		}
+	}
+	switch c.DialFamily {
+	case DialPreferIpv4:
+		return append(ipv4s, ipv6s...)
+	case DialPreferIpv6:
+		return append(ipv6s, ipv4s...)
+	case DialIpv4Only:
+		return ipv4s
+	case DialIpv6Only:
+		return ipv6s
+	case DialHappyEyeballs:
+		// RFC 8305 section 4: interleave the families, starting with the first family of the resolver
+		if len(ips) > 0 && ips[0].To4() != nil {
+			ipv4s, ipv6s = ipv6s, ipv4s
+		}
+		ordered := make([]net.IP, 0, len(ips))
+		for i := 0; i < len(ipv4s) || i < len(ipv6s); i++ {
+			if i < len(ipv6s) {
+				ordered = append(ordered, ipv6s[i])
+			}
+			if i < len(ipv4s) {
+				ordered = append(ordered, ipv4s[i])
+			}
+		}
+		return ordered
+	}
+	return ips
+}
+
+// dialIps connects to the first reachable ip, in order.
+// With happy eyeballs, the next ip is dialed when the last one fails or after FallbackDelay, and the first connection wins.
+func (c *serverConfig) dialIps(ctx context.Context, ips []net.IP, port uint16) (net.Conn, error) {
+	portString := strconv.Itoa(int(port))
+	if c.DialFamily != DialHappyEyeballs || len(ips) == 1 {
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := c.chain.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), portString))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result)
+	pending := 0
+	next := 0
+	var firstErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for pending > 0 || next < len(ips) {
+		var fallback <-chan time.Time
+		if next < len(ips) {
+			fallback = timer.C
+		}
+		select {
+		case <-fallback:
+			address := net.JoinHostPort(ips[next].String(), portString)
+			next++
+			pending++
+			go func() {
+				conn, err := c.chain.DialContext(ctx, "tcp", address)
+				select {
+				case results <- result{conn, err}:
+				case <-ctx.Done():
+					// the race is over
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}()
+			timer.Reset(c.FallbackDelay)
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			// a failed attempt starts the next one at once
+			if next < len(ips) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+			return nil, firstErr
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,247 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFamilyDialer connects every address to target, except that blackholed addresses hang until ctx is done.
+type testFamilyDialer struct {
+	target     string
+	blackholed map[string]bool
+	refused    map[string]bool
+
+	mutex     sync.Mutex
+	addresses []string
+	cancelled int
+}
+
+func (d *testFamilyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.addresses = append(d.addresses, address)
+	d.mutex.Unlock()
+	host, _, _ := net.SplitHostPort(address)
+	if d.blackholed[host] {
+		<-ctx.Done()
+		d.mutex.Lock()
+		d.cancelled++
+		d.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+	if d.refused[host] {
+		return nil, errors.New("refused")
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, d.target)
+}
+
+func (d *testFamilyDialer) dialed() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.addresses...)
+}
+
+func TestOrderIps(t *testing.T) {
+	ipv4a, ipv4b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	ipv6a, ipv6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{ipv4a, ipv4b, ipv6a, ipv6b}
+
+	tests := map[DialFamily][]net.IP{
+		"":                {ipv4a, ipv4b, ipv6a, ipv6b},
+		DialPreferIpv4:    {ipv4a, ipv4b, ipv6a, ipv6b},
+		DialPreferIpv6:    {ipv6a, ipv6b, ipv4a, ipv4b},
+		DialIpv4Only:      {ipv4a, ipv4b},
+		DialIpv6Only:      {ipv6a, ipv6b},
+		DialHappyEyeballs: {ipv4a, ipv6a, ipv4b, ipv6b},
+	}
+	for family, want := range tests {
+		config, err := newServerConfig(Config{DialFamily: family})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := config.orderIps(ips)
+		if len(got) != len(want) {
+			t.Fatalf("%q: want %v but got %v", family, want, got)
+		}
+		for i := range want {
+			if !got[i].Equal(want[i]) {
+				t.Fatalf("%q: want %v but got %v", family, want, got)
+			}
+		}
+	}
+
+	_, err := newServerConfig(Config{DialFamily: "ipv5"})
+	if !errors.Is(err, ErrUnknownDialFamily) {
+		t.Fatalf("want err = %s but got %v", ErrUnknownDialFamily, err)
+	}
+}
+
+func TestDialFamily(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	ipv4, ipv6 := net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")
+	ctx := context.Background()
+
+	t.Run("should race to the next address after the fallback delay", func(t *testing.T) {
+		dialer := &testFamilyDialer{target: echoAddr, blackholed: map[string]bool{ipv6.String(): true}}
+		config, err := newServerConfig(Config{Dialer: dialer, DialFamily: DialHappyEyeballs, FallbackDelay: time.Millisecond * 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		conn, err := config.dialIps(ctx, config.orderIps([]net.IP{ipv6, ipv4}), 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+		if elapsed := time.Since(start); elapsed < time.Millisecond*100 || elapsed > time.Second {
+			t.Fatalf("want the fallback after 100ms but got %s", elapsed)
+		}
+		time.Sleep(time.Millisecond * 50)
+		dialer.mutex.Lock()
+		defer dialer.mutex.Unlock()
+		if dialer.cancelled != 1 {
+			t.Fatalf("want the hanging attempt cancelled but got %d", dialer.cancelled)
+		}
+	})
+
+	t.Run("should start the next attempt at once when one fails", func(t *testing.T) {
+		dialer := &testFamilyDialer{target: echoAddr, refused: map[string]bool{ipv6.String(): true}}
+		config, err := newServerConfig(Config{Dialer: dialer, DialFamily: DialHappyEyeballs, FallbackDelay: time.Second * 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		conn, err := config.dialIps(ctx, []net.IP{ipv6, ipv4}, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("want no fallback delay but got %s", elapsed)
+		}
+	})
+
+	t.Run("should return the first error when every attempt fails", func(t *testing.T) {
+		dialer := &testFamilyDialer{target: echoAddr, refused: map[string]bool{ipv6.String(): true, ipv4.String(): true}}
+		config, err := newServerConfig(Config{Dialer: dialer, DialFamily: DialHappyEyeballs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = config.dialIps(ctx, []net.IP{ipv6, ipv4}, 80)
+		if err == nil || len(dialer.dialed()) != 2 {
+			t.Fatalf("want an error after 2 attempts but got %v after %v", err, dialer.dialed())
+		}
+	})
+
+	t.Run("should dial only the allowed family", func(t *testing.T) {
+		dialer := &testFamilyDialer{target: echoAddr}
+		resolver, err := NewDnsResolver(DnsResolverConfig{Hosts: map[string][]string{"dual.test": {ipv6.String(), ipv4.String()}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := newServerConfig(Config{Dialer: dialer, Resolver: resolver, DialFamily: DialIpv4Only})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Address: "dual.test", Port: 80})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if dialed := dialer.dialed(); len(dialed) != 1 || dialed[0] != "192.0.2.1:80" {
+			t.Fatalf("want 192.0.2.1:80 but got %v", dialed)
+		}
+
+		_, err = config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Address: ipv6.String(), Port: 80})
+		if ReplyFromError(err) != ReplyHostUnreachable {
+			t.Fatalf("want reply %d but got %d of %v", ReplyHostUnreachable, ReplyFromError(err), err)
+		}
+	})
+}
+
+func TestOutbound(t *testing.T) {
+	// the accepted connections report their source
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sources := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			sources <- host
+			conn.Close()
+		}
+	}()
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	alice := &Identity{Method: MethodPassword, Username: "alice"}
+
+	t.Run("should pin the source address of the config and the rules", func(t *testing.T) {
+		rules, err := NewRuleSet([]Rule{
+			{Action: RuleAllow, Users: []string{"alice"}, Outbound: Outbound{SourceAddress: "127.0.0.3"}},
+		}, RuleAllow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := newServerConfig(Config{Rules: rules, Outbound: Outbound{SourceAddress: "127.0.0.2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for identity, want := range map[*Identity]string{nil: "127.0.0.2", alice: "127.0.0.3"} {
+			conn, err := config.dialTcp(context.Background(), &RuleRequest{Cmd: CmdConnect, Identity: identity, Address: "127.0.0.1", Port: port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if source := <-sources; source != want {
+				t.Fatalf("%s: want source %s but got %s", identity, want, source)
+			}
+		}
+	})
+
+	t.Run("should use the address of the interface", func(t *testing.T) {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var loopback string
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagLoopback != 0 {
+				loopback = iface.Name
+			}
+		}
+		if loopback == "" {
+			t.Skip("no loopback interface")
+		}
+		outbound := &Outbound{Interface: loopback}
+		ip, err := outbound.localIp(net.IPv4(127, 0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.IsLoopback() {
+			t.Fatalf("want a loopback ip but got %s", ip)
+		}
+
+		conn, err := directDialer{}.DialContext(contextWithOutbound(context.Background(), outbound), "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		<-sources
+
+		_, err = (&Outbound{Interface: "no-such-interface0"}).localIp(nil)
+		if err == nil {
+			t.Fatal("want an error but got nil")
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a bandwidth limit in bytes per second. 0 means unlimited.
+type RateLimit struct {
+	Upload   int64 // from the clients to the destinations
+	Download int64 // from the destinations to the clients
+}
+
+// RateLimits limits the bandwidth of the tcp relays and the udp exchanges.
+// Every limit is a token bucket whose burst is one second of its rate.
+// Tcp relays wait for the tokens, and udp datagrams over the limit are dropped.
+// A datagram larger than the burst passes a full bucket, and the next ones pay it back.
+// Reload changes the limits of the active relays too.
+type RateLimits struct {
+	// Global is shared by all clients.
+	Global RateLimit
+	// User is the limit of each authenticated user, shared by the connections of the user.
+	User RateLimit
+	// Users overrides User for some usernames.
+	Users map[string]RateLimit
+	// Source is the limit of each client ip, shared by the connections from the ip.
+	Source RateLimit
+}
+
+func (l *RateLimits) isZero() bool {
+	return l == nil || (l.Global == RateLimit{} && l.User == RateLimit{} && len(l.Users) == 0 && l.Source == RateLimit{})
+}
+
+func (l *RateLimits) userLimit(username string) RateLimit {
+	if limit, ok := l.Users[username]; ok {
+		return limit
+	}
+	return l.User
+}
+
+func (l RateLimit) rate(upload bool) int64 {
+	if upload {
+		return l.Upload
+	}
+	return l.Download
+}
+
+// tokenBucket is a token bucket whose rate is given by every call, so a reload changes it at once.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens at rate, and returns how long to wait until they are paid back.
+// The tokens can go below zero, so the waits of the callers sharing the bucket add up.
+func (b *tokenBucket) take(n int, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(rate)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// tryTake takes n tokens at rate when there are enough.
+// n larger than the burst only needs a full bucket, which goes below zero, so such datagrams are never dropped forever.
+func (b *tokenBucket) tryTake(n int, rate int64) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(rate)
+	needed := float64(n)
+	if burst := float64(rate); needed > burst {
+		needed = burst
+	}
+	if b.tokens < needed {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func (b *tokenBucket) refill(rate int64) {
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	b.last = now
+	if burst := float64(rate); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// directionBuckets are the upload and download buckets of a limit.
+type directionBuckets struct {
+	upload, download tokenBucket
+	refs             int // the connections using them
+}
+
+func (d *directionBuckets) bucket(upload bool) *tokenBucket {
+	if upload {
+		return &d.upload
+	}
+	return &d.download
+}
+
+// bandwidthLimiter keeps the buckets of a server across reloads.
+// The buckets of a user or a source ip are removed when their last connection ends.
+type bandwidthLimiter struct {
+	limits  atomic.Pointer[RateLimits]
+	global  directionBuckets
+	mutex   sync.Mutex
+	users   map[string]*directionBuckets
+	sources map[string]*directionBuckets
+	// closed stops the waits of all connections when the server is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (b *bandwidthLimiter) setLimits(limits RateLimits) {
+	b.limits.Store(&limits)
+}
+
+// closedChan returns closed, which is made on the first use. b.mutex must be held.
+func (b *bandwidthLimiter) closedChan() chan struct{} {
+	if b.closed == nil {
+		b.closed = make(chan struct{})
+	}
+	return b.closed
+}
+
+// close stops the waits of all connections. b may be nil.
+func (b *bandwidthLimiter) close() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	closed := b.closedChan()
+	b.closeOnce.Do(func() {
+		close(closed)
+	})
+}
+
+// acquire returns the limiter of a connection from clientIp, which may be nil, by identity, which may be nil.
+// It must be released when the connection ends.
+func (b *bandwidthLimiter) acquire(identity *Identity, clientIp net.IP) *connRateLimiter {
+	if b == nil {
+		return nil
+	}
+	limiter := &connRateLimiter{bandwidth: b, done: make(chan struct{})}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	limiter.serverClosed = b.closedChan()
+	if identity != nil && identity.Username != "" {
+		limiter.username = identity.Username
+		limiter.user = acquireBuckets(&b.users, limiter.username)
+	}
+	if clientIp != nil {
+		limiter.source = clientIp.String()
+		limiter.sourceBuckets = acquireBuckets(&b.sources, limiter.source)
+	}
+	return limiter
+}
+
+func acquireBuckets(buckets *map[string]*directionBuckets, key string) *directionBuckets {
+	if *buckets == nil {
+		*buckets = make(map[string]*directionBuckets)
+	}
+	bucket, ok := (*buckets)[key]
+	if !ok {
+		bucket = &directionBuckets{}
+		(*buckets)[key] = bucket
+	}
+	bucket.refs++
+	return bucket
+}
+
+func releaseBuckets(buckets map[string]*directionBuckets, key string) {
+	bucket, ok := buckets[key]
+	if !ok {
+		return
+	}
+	bucket.refs--
+	if bucket.refs <= 0 {
+		delete(buckets, key)
+	}
+}
+
+// connRateLimiter limits a connection by the global, user and source buckets.
+type connRateLimiter struct {
+	bandwidth     *bandwidthLimiter
+	username      string
+	user          *directionBuckets
+	source        string
+	sourceBuckets *directionBuckets
+	releaseOnce   sync.Once
+	// done stops the waits when the connection is closed
+	done          chan struct{}
+	interruptOnce sync.Once
+	serverClosed  chan struct{}
+}
+
+// interrupt stops the current and the next waits, such as when the connection is closed.
+func (c *connRateLimiter) interrupt() {
+	if c == nil {
+		return
+	}
+	c.interruptOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *connRateLimiter) release() {
+	if c == nil {
+		return
+	}
+	c.interrupt()
+	c.releaseOnce.Do(func() {
+		c.bandwidth.mutex.Lock()
+		defer c.bandwidth.mutex.Unlock()
+		if c.user != nil {
+			releaseBuckets(c.bandwidth.users, c.username)
+		}
+		if c.sourceBuckets != nil {
+			releaseBuckets(c.bandwidth.sources, c.source)
+		}
+	})
+}
+
+// limits returns the buckets of the connection with their current rates. It is empty when nothing is limited.
+func (c *connRateLimiter) limits(upload bool) ([]*tokenBucket, []int64) {
+	if c == nil {
+		return nil, nil
+	}
+	limits := c.bandwidth.limits.Load()
+	if limits.isZero() {
+		return nil, nil
+	}
+	var buckets []*tokenBucket
+	var rates []int64
+	add := func(bucket *directionBuckets, limit RateLimit) {
+		if bucket != nil && limit.rate(upload) > 0 {
+			buckets = append(buckets, bucket.bucket(upload))
+			rates = append(rates, limit.rate(upload))
+		}
+	}
+	add(&c.bandwidth.global, limits.Global)
+	add(c.user, limits.userLimit(c.username))
+	add(c.sourceBuckets, limits.Source)
+	return buckets, rates
+}
+
+// wait blocks until n bytes are allowed in the direction.
+// It returns net.ErrClosed when the connection or the server is closed before that.
+func (c *connRateLimiter) wait(n int, upload bool) error {
+	buckets, rates := c.limits(upload)
+	var delay time.Duration
+	for i, bucket := range buckets {
+		if wait := bucket.take(n, rates[i]); wait > delay {
+			delay = wait
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.done:
+		return net.ErrClosed
+	case <-c.serverClosed:
+		return net.ErrClosed
+	}
+}
+
+// allow reports whether a datagram of n bytes is allowed in the direction. A denied datagram takes no tokens.
+func (c *connRateLimiter) allow(n int, upload bool) bool {
+	buckets, rates := c.limits(upload)
+	for i, bucket := range buckets {
+		if !bucket.tryTake(n, rates[i]) {
+			// give back the tokens of the buckets before
+			for j := 0; j < i; j++ {
+				buckets[j].take(-n, rates[j])
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// writer limits the bytes written to w in the direction.
+// The bytes are written in chunks no larger than the smallest burst, so a chunk never waits for more than a second of tokens.
+func (c *connRateLimiter) writer(w io.Writer, upload bool) io.Writer {
+	if c == nil {
+		return w
+	}
+	return writerFunc(func(b []byte) (int, error) {
+		written := 0
+		for written < len(b) {
+			chunk := b[written:]
+			_, rates := c.limits(upload)
+			for _, rate := range rates {
+				if int64(len(chunk)) > rate {
+					chunk = chunk[:rate]
+				}
+			}
+			if err := c.wait(len(chunk), upload); err != nil {
+				return written, err
+			}
+			n, err := w.Write(chunk)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		return written, nil
+	})
+}
@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("should allow the burst and then wait", func(t *testing.T) {
+		bucket := &tokenBucket{}
+		if wait := bucket.take(1000, 1000); wait != 0 {
+			t.Fatalf("want no wait in the burst but got %s", wait)
+		}
+		wait := bucket.take(500, 1000)
+		if wait < time.Millisecond*400 || wait > time.Millisecond*500 {
+			t.Fatalf("want about 500ms but got %s", wait)
+		}
+	})
+
+	t.Run("should drop the datagrams over the limit without taking tokens", func(t *testing.T) {
+		bandwidth := &bandwidthLimiter{}
+		bandwidth.setLimits(RateLimits{Global: RateLimit{Upload: 1000}, Source: RateLimit{Upload: 100}})
+		limiter := bandwidth.acquire(nil, net.IPv4(127, 0, 0, 1))
+		defer limiter.release()
+
+		if !limiter.allow(100, true) {
+			t.Fatal("want the first datagram allowed")
+		}
+		if limiter.allow(100, true) {
+			t.Fatal("want the datagram over the source limit dropped")
+		}
+		// the global bucket got its tokens back
+		if !bandwidth.global.upload.tryTake(900, 1000) {
+			t.Fatal("want 900 tokens left in the global bucket")
+		}
+		if !limiter.allow(1000, false) {
+			t.Fatal("want download unlimited")
+		}
+	})
+
+	t.Run("should let a datagram larger than the burst overdraw a full bucket", func(t *testing.T) {
+		bandwidth := &bandwidthLimiter{}
+		bandwidth.setLimits(RateLimits{Source: RateLimit{Upload: 1000}})
+		limiter := bandwidth.acquire(nil, net.IPv4(127, 0, 0, 1))
+		defer limiter.release()
+
+		if !limiter.allow(1400, true) {
+			t.Fatal("want the datagram larger than the burst allowed")
+		}
+		if limiter.allow(1, true) {
+			t.Fatal("want the next datagram dropped until the bucket is paid back")
+		}
+	})
+
+	t.Run("should stop waiting when the connection or the server is closed", func(t *testing.T) {
+		for _, stop := range []string{"release", "interrupt", "close"} {
+			bandwidth := &bandwidthLimiter{}
+			bandwidth.setLimits(RateLimits{Source: RateLimit{Download: 100}})
+			limiter := bandwidth.acquire(nil, net.IPv4(127, 0, 0, 1))
+			errCh := make(chan error, 1)
+			go func() {
+				// one second of burst, then nine seconds of tokens
+				_, err := limiter.writer(io.Discard, false).Write(make([]byte, 1000))
+				errCh <- err
+			}()
+			time.Sleep(time.Millisecond * 100)
+			switch stop {
+			case "release":
+				limiter.release()
+			case "interrupt":
+				limiter.interrupt()
+			case "close":
+				bandwidth.close()
+			}
+			select {
+			case err := <-errCh:
+				if err != net.ErrClosed {
+					t.Fatalf("%s: want err = %s but got %v", stop, net.ErrClosed, err)
+				}
+			case <-time.After(time.Second * 3):
+				t.Fatalf("%s: want the wait stopped but it is still waiting", stop)
+			}
+			limiter.release()
+		}
+	})
+
+	t.Run("should share the buckets of a user until the last connection ends", func(t *testing.T) {
+		bandwidth := &bandwidthLimiter{}
+		alice := &Identity{Method: MethodPassword, Username: "alice"}
+		first := bandwidth.acquire(alice, net.IPv4(127, 0, 0, 1))
+		second := bandwidth.acquire(alice, net.IPv4(127, 0, 0, 2))
+		if first.user != second.user || first.sourceBuckets == second.sourceBuckets {
+			t.Fatal("want the user buckets shared and the source buckets separated")
+		}
+		first.release()
+		first.release()
+		if len(bandwidth.users) != 1 || len(bandwidth.sources) != 1 {
+			t.Fatalf("want 1 user and 1 source but got %d and %d", len(bandwidth.users), len(bandwidth.sources))
+		}
+		second.release()
+		if len(bandwidth.users) != 0 || len(bandwidth.sources) != 0 {
+			t.Fatalf("want no buckets but got %d and %d", len(bandwidth.users), len(bandwidth.sources))
+		}
+	})
+
+	t.Run("should use the limit of the username", func(t *testing.T) {
+		limits := &RateLimits{User: RateLimit{Upload: 100}, Users: map[string]RateLimit{"alice": {Upload: 200}}}
+		if limits.userLimit("alice").Upload != 200 || limits.userLimit("bob").Upload != 100 {
+			t.Fatalf("want 200 and 100 but got %d and %d", limits.userLimit("alice").Upload, limits.userLimit("bob").Upload)
+		}
+	})
+}
+
+func TestRateLimitsRelay(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	const rate = 20000
+
+	// echo sends size bytes and returns the time until they are echoed back. reload is called after the first rate bytes.
+	echo := func(t *testing.T, server *Socks5Server, size int, reload func()) time.Duration {
+		addr, _ := runTestServer(t, server)
+		client := &Client{ProxyAddr: addr}
+		conn, err := client.Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		data := bytes.Repeat([]byte("x"), size)
+		start := time.Now()
+		go conn.Write(data)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 20))
+		received := make([]byte, size)
+		if _, err := io.ReadFull(conn, received[:rate]); err != nil {
+			t.Fatal(err)
+		}
+		if reload != nil {
+			reload()
+		}
+		if _, err := io.ReadFull(conn, received[rate:]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, received) {
+			t.Fatal("want the data echoed")
+		}
+		return time.Since(start)
+	}
+
+	t.Run("should limit the download of a relay", func(t *testing.T) {
+		server := NewSocks5Server("127.0.0.1", 0, Config{UdpPort: UdpRelayClose, RateLimits: RateLimits{Source: RateLimit{Download: rate}}})
+		// one second of burst, then two seconds of tokens
+		if elapsed := echo(t, server, rate*3, nil); elapsed < time.Millisecond*1800 {
+			t.Fatalf("want about 2s but got %s", elapsed)
+		}
+	})
+
+	t.Run("should stop the waiting relays on close", func(t *testing.T) {
+		server := NewSocks5Server("127.0.0.1", 0, Config{UdpPort: UdpRelayClose, RateLimits: RateLimits{Source: RateLimit{Download: rate}}})
+		addr, _ := runTestServer(t, server)
+		client := &Client{ProxyAddr: addr}
+		conn, err := client.Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// one second of burst, then nine seconds of tokens
+		go conn.Write(bytes.Repeat([]byte("x"), rate*10))
+		if _, err := io.ReadFull(conn, make([]byte, rate)); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		server.Close()
+		// the handler ends when the relay stops waiting, and a chunk waits up to one second without the close
+		for server.activeConns() > 0 {
+			if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+				t.Fatalf("want the relay stopped at once but it is still running after %s", elapsed)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+
+	t.Run("should change the limit of the active relays on reload", func(t *testing.T) {
+		server := NewSocks5Server("127.0.0.1", 0, Config{UdpPort: UdpRelayClose, RateLimits: RateLimits{Global: RateLimit{Download: rate}}})
+		elapsed := echo(t, server, rate*10, func() {
+			if err := server.Reload(Config{UdpPort: UdpRelayClose}); err != nil {
+				t.Fatal(err)
+			}
+		})
+		// without the reload, it takes 9 seconds
+		if elapsed > time.Second*3 {
+			t.Fatalf("want the limit removed but got %s", elapsed)
+		}
+	})
+}
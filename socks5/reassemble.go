@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// UdpFragEnd is the high-order bit of FRAG, which marks the end of a fragment sequence.
+	UdpFragEnd = 0x80
+	// MaxUdpReassemblyLength caps the payload buffered for one client, which must fit in one udp datagram.
+	MaxUdpReassemblyLength = MaxUdpBufLength
+	// MaxUdpReassemblyQueues caps the number of clients which have fragments pending at the same time.
+	MaxUdpReassemblyQueues = 1024
+)
+
+type udpReassemblyQueue struct {
+	message     *UdpClientForwardMessage // header of the first fragment, Data holds the payload so far
+	position    byte                     // position of the last fragment received
+	expiredTime time.Time
+}
+
+func (q *udpReassemblyQueue) isExpired() bool {
+	return time.Now().After(q.expiredTime)
+}
+
+// UdpReassembler is defined to reassemble fragmented udp datagrams (RFC 1928, section 7).
+// It keeps one reassembly queue for every client address.
+// Fragments must arrive in order: a lower fragment number, a gap or another destination drops the queue.
+// The queue is also dropped when the reassembly timer expires or it grows over MaxUdpReassemblyLength.
+type UdpReassembler struct {
+	Timeout time.Duration // the reassembly timer, which starts with the first fragment
+	queues  map[string]*udpReassemblyQueue
+	mutex   sync.Mutex
+}
+
+func NewUdpReassembler(timeout time.Duration) *UdpReassembler {
+	return &UdpReassembler{
+		Timeout: timeout,
+		queues:  make(map[string]*udpReassemblyQueue),
+	}
+}
+
+// Add returns the complete message when message is standalone or ends a fragment sequence.
+// Otherwise, it buffers the fragment and returns nil.
+// A standalone message (FRAG is 0x00) also drops the pending queue of the client.
+func (r *UdpReassembler) Add(clientHost string, message *UdpClientForwardMessage) *UdpClientForwardMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if message.FPAG == 0x00 {
+		delete(r.queues, clientHost)
+		return message
+	}
+
+	position := message.FPAG &^ UdpFragEnd
+	end := message.FPAG&UdpFragEnd != 0
+
+	queue, ok := r.queues[clientHost]
+	if ok && (queue.isExpired() || !queue.accept(position, message)) {
+		delete(r.queues, clientHost)
+		ok = false
+	}
+
+	if !ok {
+		// the beginning of the sequence is lost, wait for a new one
+		if position != 1 {
+			return nil
+		}
+		if end {
+			message.FPAG = 0x00
+			return message
+		}
+		if len(r.queues) >= MaxUdpReassemblyQueues {
+			return nil
+		}
+		// message.Data points to the read buffer of the caller, so it must be copied
+		first := *message
+		first.Data = append([]byte{}, message.Data...)
+		r.queues[clientHost] = &udpReassemblyQueue{
+			message:     &first,
+			position:    position,
+			expiredTime: time.Now().Add(r.Timeout),
+		}
+		return nil
+	}
+
+	if len(queue.message.Data)+len(message.Data) > MaxUdpReassemblyLength {
+		delete(r.queues, clientHost)
+		return nil
+	}
+	queue.message.Data = append(queue.message.Data, message.Data...)
+	queue.position = position
+
+	if end {
+		delete(r.queues, clientHost)
+		queue.message.FPAG = 0x00
+		return queue.message
+	}
+	return nil
+}
+
+// accept reports whether the fragment continues the sequence of the queue.
+func (q *udpReassemblyQueue) accept(position byte, message *UdpClientForwardMessage) bool {
+	return position == q.position+1 &&
+		message.AddressType == q.message.AddressType &&
+		message.Address == q.message.Address &&
+		message.Port == q.message.Port
+}
+
+// RemoveExpired drops the queues whose reassembly timer has expired.
+func (r *UdpReassembler) RemoveExpired() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for host, queue := range r.queues {
+		if queue.isExpired() {
+			delete(r.queues, host)
+		}
+	}
+}
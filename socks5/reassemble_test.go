@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newTestFragment(frag byte, port uint16, data string) *UdpClientForwardMessage {
+	return &UdpClientForwardMessage{
+		FPAG:        frag,
+		AddressType: AddressTypeIpv4,
+		Address:     "1.1.1.1",
+		Port:        port,
+		Data:        []byte(data),
+	}
+}
+
+func TestUdpReassembler(t *testing.T) {
+	const client = "127.0.0.1:5000"
+
+	t.Run("standalone message should pass through", func(t *testing.T) {
+		r := NewUdpReassembler(time.Second * 5)
+		message := r.Add(client, newTestFragment(0x00, 53, "abc"))
+		if message == nil || string(message.Data) != "abc" {
+			t.Fatalf("want data abc but got %v", message)
+		}
+	})
+
+	t.Run("should reassemble fragments in order", func(t *testing.T) {
+		r := NewUdpReassembler(time.Second * 5)
+		// the caller reuses its read buffer for every datagram
+		buf := make([]byte, 3)
+		add := func(frag byte, data string) *UdpClientForwardMessage {
+			copy(buf, data)
+			fragment := newTestFragment(frag, 53, "")
+			fragment.Data = buf
+			return r.Add(client, fragment)
+		}
+		if message := add(0x01, "abc"); message != nil {
+			t.Fatalf("want nil but got %v", message)
+		}
+		if message := add(0x02, "def"); message != nil {
+			t.Fatalf("want nil but got %v", message)
+		}
+		message := add(0x03|UdpFragEnd, "ghi")
+		if message == nil {
+			t.Fatalf("want a message but got nil")
+		}
+		copy(buf, "xyz")
+		if !bytes.Equal(message.Data, []byte("abcdefghi")) {
+			t.Fatalf("want data abcdefghi but got %s", message.Data)
+		}
+		if message.FPAG != 0x00 || message.Port != 53 {
+			t.Fatalf("want FPAG 0 and port 53 but got %d and %d", message.FPAG, message.Port)
+		}
+	})
+
+	tests := []struct {
+		name      string
+		fragments []*UdpClientForwardMessage
+	}{
+		{
+			"lower fragment number should drop the queue",
+			[]*UdpClientForwardMessage{
+				newTestFragment(0x01, 53, "a"),
+				newTestFragment(0x02, 53, "b"),
+				newTestFragment(0x02, 53, "b"),
+				newTestFragment(0x03|UdpFragEnd, 53, "c"),
+			},
+		},
+		{
+			"end bit out of order should drop the queue",
+			[]*UdpClientForwardMessage{
+				newTestFragment(0x01, 53, "a"),
+				newTestFragment(0x03|UdpFragEnd, 53, "c"),
+			},
+		},
+		{
+			"another destination should drop the queue",
+			[]*UdpClientForwardMessage{
+				newTestFragment(0x01, 53, "a"),
+				newTestFragment(0x02|UdpFragEnd, 54, "b"),
+			},
+		},
+		{
+			"standalone message should drop the queue",
+			[]*UdpClientForwardMessage{
+				newTestFragment(0x01, 53, "a"),
+				newTestFragment(0x00, 53, "standalone"),
+				newTestFragment(0x02|UdpFragEnd, 53, "b"),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewUdpReassembler(time.Second * 5)
+			var message *UdpClientForwardMessage
+			for _, fragment := range test.fragments {
+				message = r.Add(client, fragment)
+			}
+			if message != nil {
+				t.Fatalf("want nil but got %v", message)
+			}
+		})
+	}
+
+	t.Run("expired queue should be dropped", func(t *testing.T) {
+		r := NewUdpReassembler(time.Millisecond * 10)
+		r.Add(client, newTestFragment(0x01, 53, "a"))
+		time.Sleep(time.Millisecond * 20)
+		if message := r.Add(client, newTestFragment(0x02|UdpFragEnd, 53, "b")); message != nil {
+			t.Fatalf("want nil but got %v", message)
+		}
+	})
+
+	t.Run("queue of the largest udp payload should be reassembled", func(t *testing.T) {
+		r := NewUdpReassembler(time.Second * 5)
+		data := string(make([]byte, MaxUdpBufLength/2))
+		r.Add(client, newTestFragment(0x01, 53, data))
+		r.Add(client, newTestFragment(0x02, 53, data))
+		message := r.Add(client, newTestFragment(0x03|UdpFragEnd, 53, "c"))
+		if message == nil || len(message.Data) != MaxUdpBufLength {
+			t.Fatalf("want %d bytes reassembled but got %v", MaxUdpBufLength, message)
+		}
+		r.Add(client, newTestFragment(0x01, 53, data))
+		r.Add(client, newTestFragment(0x02, 53, data))
+		if message := r.Add(client, newTestFragment(0x03|UdpFragEnd, 53, "cd")); message != nil {
+			t.Fatalf("want the payload larger than a udp datagram dropped but got %d bytes", len(message.Data))
+		}
+	})
+
+	t.Run("queue over the size limit should be dropped", func(t *testing.T) {
+		r := NewUdpReassembler(time.Second * 5)
+		data := string(make([]byte, MaxUdpReassemblyLength/2+1))
+		r.Add(client, newTestFragment(0x01, 53, data))
+		r.Add(client, newTestFragment(0x02, 53, data))
+		if message := r.Add(client, newTestFragment(0x03|UdpFragEnd, 53, "c")); message != nil {
+			t.Fatalf("want nil but got %v", message)
+		}
+	})
+}
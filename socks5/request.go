@@ -1,9 +1,15 @@
 package socks5
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
+	"syscall"
 )
 
 const (
@@ -26,6 +32,68 @@ const (
 	ReplyAddressTypeNotSupported
 )
 
+var replyMessages = map[ReplyType]string{
+	ReplySuccess:                 "succeeded",
+	ReplyServerFailure:           "general SOCKS server failure",
+	ReplyConnectionNotAllowed:    "connection not allowed by ruleset",
+	ReplyNetworkUnreachable:      "network unreachable",
+	ReplyHostUnreachable:         "host unreachable",
+	ReplyConnectionRefused:       "connection refused",
+	ReplyTTLExpired:              "TTL expired",
+	ReplyCommandNotSupported:     "command not supported",
+	ReplyAddressTypeNotSupported: "address type not supported",
+}
+
+// ReplyError is a failure reply of a request.
+type ReplyError struct {
+	Reply ReplyType
+}
+
+func (e *ReplyError) Error() string {
+	message, ok := replyMessages[e.Reply]
+	if !ok {
+		message = fmt.Sprintf("unknown reply %d", e.Reply)
+	}
+	return "socks5 server reply: " + message
+}
+
+// ReplyFromError classifies the error of dialing a destination into a failure reply.
+// A custom dialer can return a *ReplyError, which may be wrapped, to choose the reply itself.
+// Errors which are not recognized get ReplyServerFailure.
+func ReplyFromError(err error) ReplyType {
+	if err == nil {
+		return ReplySuccess
+	}
+
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Reply
+	}
+	if errors.Is(err, ErrRuleDenied) || errors.Is(err, ErrQuotaExceeded) {
+		return ReplyConnectionNotAllowed
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ReplyHostUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return ReplyHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ReplyTTLExpired
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ReplyTTLExpired
+	}
+	return ReplyServerFailure
+}
+
 type ClientRequestMessage struct {
 	Cmd         Command
 	Address     string
@@ -69,46 +137,107 @@ func NewClientRequestMessage(conn io.ReadWriter) (*ClientRequestMessage, error)
 		Cmd:         command,
 		AddressType: addressType,
 	}
-	// read address
+	message.Address, message.Port, err = readAddress(conn, addressType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// readAddress reads ADDR and PORT, which follow ATYP in requests and replies.
+func readAddress(conn io.Reader, addressType AddressType) (string, uint16, error) {
+	var address string
+	var buf []byte
 	switch addressType {
+	case AddressTypeIpv4:
+		buf = make([]byte, Ipv4Length)
 	case AddressTypeIpv6:
 		buf = make([]byte, Ipv6Length)
-		fallthrough
-	case AddressTypeIpv4:
-		if _, err = io.ReadFull(conn, buf); err != nil {
-			return nil, err
-		}
-		ip := net.IP(buf)
-		message.Address = ip.String()
 	case AddressTypeDomain:
-		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
-			return nil, err
-		}
-		domainLength := buf[0]
-		if domainLength > Ipv4Length {
-			buf = make([]byte, domainLength)
-		}
-		_, err = io.ReadFull(conn, buf[:domainLength])
-		if err != nil {
-			return nil, err
+		buf = make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return "", 0, err
 		}
-		message.Address = string(buf[:domainLength])
+		buf = make([]byte, buf[0])
+	default:
+		return "", 0, ErrAddressTypeNotSupport
+	}
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", 0, err
+	}
+	if addressType == AddressTypeDomain {
+		address = string(buf)
+	} else {
+		address = net.IP(buf).String()
 	}
 
 	// read port
-	if _, err = io.ReadFull(conn, buf[:PortLength]); err != nil {
+	buf = make([]byte, PortLength)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", 0, err
+	}
+	return address, binary.BigEndian.Uint16(buf), nil
+}
+
+// WriteClientRequestMessage is used by the client to send a request.
+// host: similar to "x.x.x.x:x" or "example.com:x"
+func WriteClientRequestMessage(conn io.Writer, cmd Command, host string) error {
+	hostByte, err := GetHostByteFromString(host)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 3+len(hostByte))
+	buf = append(buf, Socks5Version, cmd, ReversedField)
+	buf = append(buf, hostByte...)
+	_, err = conn.Write(buf)
+	return err
+}
+
+// ServerReplyMessage is the reply of a request, read by the client.
+type ServerReplyMessage struct {
+	Reply       ReplyType
+	AddressType AddressType
+	Address     string
+	Port        uint16
+}
+
+func NewServerReplyMessage(conn io.Reader) (*ServerReplyMessage, error) {
+	// Read version, reply, reserved, address type
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
 		return nil, err
 	}
-	message.Port = (uint16(buf[0]) << 8) + uint16(buf[1])
+	if buf[0] != Socks5Version {
+		return nil, ErrVersionNotSupport
+	}
 
+	message := ServerReplyMessage{
+		Reply:       buf[1],
+		AddressType: buf[3],
+	}
+	message.Address, message.Port, err = readAddress(conn, message.AddressType)
+	if err != nil {
+		return nil, err
+	}
 	return &message, nil
 }
 
+// Host returns the address of the reply, similar to "x.x.x.x:x".
+func (m *ServerReplyMessage) Host() string {
+	return net.JoinHostPort(m.Address, strconv.Itoa(int(m.Port)))
+}
+
 func WriteRequestSuccessReply(conn io.Writer, ip net.IP, port uint16) error {
 	// There must create connBuf to avoid "Packet Fragmentation"
 	// When Packet Fragmentation occurs, error may be happened in ss-tap.
 	// 22: response length when there is ipv6
 	connBuf := make([]byte, 0, 22)
+	if ip == nil {
+		// the address is unknown, such as when the client comes from a unix socket
+		ip = net.IPv4zero
+	}
 	connBuf = append(connBuf, Socks5Version)
 	connBuf = append(connBuf, ReplySuccess)
 	connBuf = append(connBuf, ReversedField)
@@ -2,8 +2,13 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"os"
 	"reflect"
+	"syscall"
 	"testing"
 )
 
@@ -150,3 +155,62 @@ func TestWriteRequestFailureReply(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteClientRequestMessage(t *testing.T) {
+	buf := bytes.Buffer{}
+	err := WriteClientRequestMessage(&buf, CmdConnect, "example.com:443")
+	if err != nil {
+		t.Fatalf("error should be nil, but got %s", err)
+	}
+	message, err := NewClientRequestMessage(&buf)
+	if err != nil {
+		t.Fatalf("error should be nil, but got %s", err)
+	}
+	want := ClientRequestMessage{CmdConnect, "example.com", 443, AddressTypeDomain}
+	if *message != want {
+		t.Fatalf("message should be %v, but got %v", want, *message)
+	}
+}
+
+func TestNewServerReplyMessage(t *testing.T) {
+	buf := bytes.Buffer{}
+	WriteRequestSuccessReply(&buf, net.IPv4(1, 2, 3, 4), 1080)
+	message, err := NewServerReplyMessage(&buf)
+	if err != nil {
+		t.Fatalf("error should be nil, but got %s", err)
+	}
+	want := ServerReplyMessage{ReplySuccess, AddressTypeIpv4, "1.2.3.4", 1080}
+	if *message != want {
+		t.Fatalf("message should be %v, but got %v", want, *message)
+	}
+	if message.Host() != "1.2.3.4:1080" {
+		t.Fatalf("host should be 1.2.3.4:1080, but got %s", message.Host())
+	}
+}
+
+func TestReplyFromError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		reply ReplyType
+	}{
+		{"nil", nil, ReplySuccess},
+		{"reply error", &ReplyError{Reply: ReplyHostUnreachable}, ReplyHostUnreachable},
+		{"wrapped reply error", fmt.Errorf("dial: %w", &ReplyError{Reply: ReplyNetworkUnreachable}), ReplyNetworkUnreachable},
+		{"rule denied", ErrRuleDenied, ReplyConnectionNotAllowed},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ReplyConnectionRefused},
+		{"network unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, ReplyNetworkUnreachable},
+		{"host unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, ReplyHostUnreachable},
+		{"dns error", &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, ReplyHostUnreachable},
+		{"context deadline", context.DeadlineExceeded, ReplyTTLExpired},
+		{"i/o timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, ReplyTTLExpired},
+		{"unknown", errors.New("something wrong"), ReplyServerFailure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reply := ReplyFromError(test.err); reply != test.reply {
+				t.Fatalf("want reply %d but got %d", test.reply, reply)
+			}
+		})
+	}
+}
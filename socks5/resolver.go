@@ -0,0 +1,484 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves the domain destinations of CONNECT, BIND and UDP datagrams.
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// systemResolver is the resolver of the operating system, used when Config.Resolver is nil.
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+type DnsUpstreamType = string
+
+const (
+	DnsUpstreamUdp   DnsUpstreamType = "udp"
+	DnsUpstreamTcp   DnsUpstreamType = "tcp"
+	DnsUpstreamTls   DnsUpstreamType = "tls"   // DNS over TLS, RFC 7858
+	DnsUpstreamHttps DnsUpstreamType = "https" // DNS over HTTPS, RFC 8484
+)
+
+// IpFamily chooses ipv4 or ipv6.
+type IpFamily = string
+
+const (
+	IpFamilyIpv4 IpFamily = "ipv4"
+	IpFamilyIpv6 IpFamily = "ipv6"
+)
+
+var (
+	ErrDnsUnknownUpstream = errors.New("dns: unknown upstream type")
+	ErrDnsUnknownFamily   = errors.New("dns: unknown ip family")
+	ErrDnsServerFailure   = errors.New("dns: server failure")
+)
+
+// DnsUpstream is a dns server which the resolver asks.
+type DnsUpstream struct {
+	Type DnsUpstreamType
+	// Address is similar to "1.1.1.1:53" or "dns.google:853". The port is 53, or 853 for tls, by default.
+	// For https, it is the URL, such as "https://dns.google/dns-query".
+	Address string
+	// ServerName verifies the certificate of tls and https. Empty means the host of Address.
+	ServerName string `mapstructure:"server_name"`
+}
+
+// DnsResolverConfig is the config of NewDnsResolver.
+type DnsResolverConfig struct {
+	// Upstreams are asked in order, and the next one is asked when one fails.
+	// Empty means the resolver of the operating system, whose answers are not cached.
+	Upstreams []DnsUpstream
+	// Hosts answers the domains before the cache and the upstreams, such as "example.internal": ["10.0.0.5"].
+	Hosts map[string][]string
+	// PreferFamily puts the ips of the family first. Empty means ipv4 first.
+	PreferFamily IpFamily
+	// Timeout of a query to an upstream. Default is 5 seconds.
+	Timeout time.Duration
+	// NegativeTtl caches "no such host" and empty answers when the upstream does not send a SOA record.
+	// Default is 30 seconds.
+	NegativeTtl time.Duration
+	// MaxTtl limits the ttl of the answers. Default is 1 hour.
+	MaxTtl time.Duration
+	// CacheSize is the maximum number of cached answers. Default is 4096, and a negative value disables the cache.
+	CacheSize int
+	// Dialer reaches the upstreams. nil means net.Dialer.
+	Dialer ContextDialer
+	// TLSConfig is used by tls and https upstreams, such as for RootCAs. nil means the defaults.
+	TLSConfig *tls.Config
+}
+
+// DnsResolver is a Resolver which asks its own dns servers, with a cache.
+type DnsResolver struct {
+	config DnsResolverConfig
+	hosts  map[string][]net.IP
+	// the clients of the https upstreams, by their address
+	httpClients map[string]*http.Client
+
+	cacheMutex sync.Mutex
+	cache      map[dnsCacheKey]*dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP // empty for a negative answer
+	expires time.Time
+}
+
+// NewDnsResolver checks the config and applies its defaults.
+func NewDnsResolver(config DnsResolverConfig) (*DnsResolver, error) {
+	if config.Timeout == 0 {
+		config.Timeout = time.Second * 5
+	}
+	if config.NegativeTtl == 0 {
+		config.NegativeTtl = time.Second * 30
+	}
+	if config.MaxTtl == 0 {
+		config.MaxTtl = time.Hour
+	}
+	if config.CacheSize == 0 {
+		config.CacheSize = 4096
+	}
+	if config.Dialer == nil {
+		config.Dialer = &net.Dialer{}
+	}
+	switch config.PreferFamily {
+	case "", IpFamilyIpv4, IpFamilyIpv6:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrDnsUnknownFamily, config.PreferFamily)
+	}
+
+	resolver := &DnsResolver{
+		config:      config,
+		hosts:       make(map[string][]net.IP),
+		httpClients: make(map[string]*http.Client),
+		cache:       make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+	for host, addresses := range config.Hosts {
+		name := canonicalDnsName(host)
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, fmt.Errorf("dns: hosts: invalid ip %q of %s", address, host)
+			}
+			resolver.hosts[name] = append(resolver.hosts[name], ip)
+		}
+	}
+
+	for i, upstream := range config.Upstreams {
+		switch upstream.Type {
+		case DnsUpstreamUdp, DnsUpstreamTcp, DnsUpstreamTls:
+			_, err := dnsUpstreamAddress(upstream)
+			if err != nil {
+				return nil, fmt.Errorf("dns: upstream %d: %w", i, err)
+			}
+		case DnsUpstreamHttps:
+			upstreamUrl, err := url.Parse(upstream.Address)
+			if err != nil || upstreamUrl.Scheme != "https" || upstreamUrl.Host == "" {
+				return nil, fmt.Errorf("dns: upstream %d: want a https URL but got %q", i, upstream.Address)
+			}
+			resolver.httpClients[upstream.Address] = &http.Client{Transport: &http.Transport{
+				DialContext:       config.Dialer.DialContext,
+				TLSClientConfig:   resolver.tlsConfig(upstream, upstreamUrl.Host),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   time.Second * 90,
+			}}
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrDnsUnknownUpstream, upstream.Type)
+		}
+	}
+	return resolver, nil
+}
+
+// CloseIdleConnections closes the kept-alive connections of the https upstreams, such as when the resolver is replaced.
+// The resolver still works, and dials again when it is used.
+func (r *DnsResolver) CloseIdleConnections() {
+	for _, client := range r.httpClients {
+		client.CloseIdleConnections()
+	}
+}
+
+// dnsUpstreamAddress returns the address of an udp, tcp or tls upstream, with the default port.
+func dnsUpstreamAddress(upstream DnsUpstream) (string, error) {
+	port := "53"
+	if upstream.Type == DnsUpstreamTls {
+		port = "853"
+	}
+	if _, _, err := net.SplitHostPort(upstream.Address); err == nil {
+		return upstream.Address, nil
+	}
+	host := strings.Trim(upstream.Address, "[]")
+	if host == "" {
+		return "", fmt.Errorf("invalid address %q", upstream.Address)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func canonicalDnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// LookupIP returns the ips of host, with the preferred family first.
+// The ipv4 and ipv6 answers are asked and cached separately.
+func (r *DnsResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name := canonicalDnsName(host)
+	if ips, ok := r.hosts[name]; ok {
+		return r.sortIps(append([]net.IP(nil), ips...)), nil
+	}
+	if len(r.config.Upstreams) == 0 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		return r.sortIps(ips), nil
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	qtypes := []uint16{dnsTypeA, dnsTypeAAAA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			ips, err := r.lookup(ctx, name, qtype)
+			results[i] = result{ips, err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var err error
+	for _, result := range results {
+		ips = append(ips, result.ips...)
+		if result.err != nil && err == nil {
+			err = result.err
+		}
+	}
+	if len(ips) > 0 {
+		return r.sortIps(ips), nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+// sortIps puts the ips of the preferred family first, and keeps the order of each family.
+func (r *DnsResolver) sortIps(ips []net.IP) []net.IP {
+	preferIpv6 := r.config.PreferFamily == IpFamilyIpv6
+	sorted := make([]net.IP, 0, len(ips))
+	for _, first := range []bool{true, false} {
+		for _, ip := range ips {
+			isIpv6 := ip.To4() == nil
+			if (isIpv6 == preferIpv6) == first {
+				sorted = append(sorted, ip)
+			}
+		}
+	}
+	return sorted
+}
+
+// lookup returns the ips of name and qtype from the cache or the upstreams.
+// An empty answer is not an error.
+func (r *DnsResolver) lookup(ctx context.Context, name string, qtype uint16) ([]net.IP, error) {
+	key := dnsCacheKey{name, qtype}
+	if ips, ok := r.cached(key); ok {
+		return ips, nil
+	}
+
+	var firstErr error
+	for _, upstream := range r.config.Upstreams {
+		response, err := r.query(ctx, upstream, name, qtype)
+		if err == nil && response.rcode != dnsRcodeSuccess && response.rcode != dnsRcodeNameError {
+			err = fmt.Errorf("%w: rcode %d from %s", ErrDnsServerFailure, response.rcode, upstream.Address)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		ttl := time.Duration(response.ttl) * time.Second
+		if len(response.ips) == 0 {
+			ttl = r.config.NegativeTtl
+			if response.hasSoa {
+				ttl = time.Duration(response.negativeTtl) * time.Second
+			}
+		}
+		r.store(key, response.ips, ttl)
+		return response.ips, nil
+	}
+	return nil, &net.DNSError{Err: firstErr.Error(), Name: name, IsTemporary: true}
+}
+
+func (r *DnsResolver) cached(key dnsCacheKey) ([]net.IP, bool) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry.ips, true
+}
+
+func (r *DnsResolver) store(key dnsCacheKey, ips []net.IP, ttl time.Duration) {
+	if r.config.CacheSize < 0 || ttl <= 0 {
+		return
+	}
+	if ttl > r.config.MaxTtl {
+		ttl = r.config.MaxTtl
+	}
+	now := time.Now()
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+	if len(r.cache) >= r.config.CacheSize {
+		for cacheKey, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, cacheKey)
+			}
+		}
+		// still full, so an arbitrary answer makes room
+		for cacheKey := range r.cache {
+			if len(r.cache) < r.config.CacheSize {
+				break
+			}
+			delete(r.cache, cacheKey)
+		}
+	}
+	r.cache[key] = &dnsCacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+// query asks a single upstream.
+func (r *DnsResolver) query(ctx context.Context, upstream DnsUpstream, name string, qtype uint16) (*dnsResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	// DoH uses id 0 for http caches
+	var id uint16
+	if upstream.Type != DnsUpstreamHttps {
+		idBytes := make([]byte, 2)
+		if _, err := rand.Read(idBytes); err != nil {
+			return nil, err
+		}
+		id = binary.BigEndian.Uint16(idBytes)
+	}
+	query, err := newDnsQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	switch upstream.Type {
+	case DnsUpstreamUdp:
+		response, err := r.exchangeUdp(ctx, upstream, query, id, name, qtype)
+		if err != nil || !response.truncated {
+			return response, err
+		}
+		// the answer does not fit in a datagram
+		upstream.Type = DnsUpstreamTcp
+		return r.exchangeStream(ctx, upstream, query, id, name, qtype)
+	case DnsUpstreamTcp, DnsUpstreamTls:
+		return r.exchangeStream(ctx, upstream, query, id, name, qtype)
+	case DnsUpstreamHttps:
+		return r.exchangeHttps(ctx, upstream, query, id, name, qtype)
+	}
+	return nil, ErrDnsUnknownUpstream
+}
+
+func (r *DnsResolver) exchangeUdp(ctx context.Context, upstream DnsUpstream, query []byte, id uint16, name string, qtype uint16) (*dnsResponse, error) {
+	address, _ := dnsUpstreamAddress(upstream)
+	conn, err := r.config.Dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// a datagram which is not the answer, such as a late or spoofed one, is skipped
+		response, err := parseDnsResponse(buf[:n], id, name, qtype)
+		if err == nil {
+			return response, nil
+		}
+	}
+}
+
+// exchangeStream sends the query over tcp or tls, with the 2 bytes length prefix.
+func (r *DnsResolver) exchangeStream(ctx context.Context, upstream DnsUpstream, query []byte, id uint16, name string, qtype uint16) (*dnsResponse, error) {
+	address, _ := dnsUpstreamAddress(upstream)
+	conn, err := r.config.Dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if upstream.Type == DnsUpstreamTls {
+		tlsConn := tls.Client(conn, r.tlsConfig(upstream, address))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	message := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, err
+	}
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return parseDnsResponse(buf, id, name, qtype)
+}
+
+func (r *DnsResolver) exchangeHttps(ctx context.Context, upstream DnsUpstream, query []byte, id uint16, name string, qtype uint16) (*dnsResponse, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.Address, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := r.httpClients[upstream.Address].Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: http status %d from %s", ErrDnsServerFailure, response.StatusCode, upstream.Address)
+	}
+	buf, err := io.ReadAll(io.LimitReader(response.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	return parseDnsResponse(buf, id, name, qtype)
+}
+
+// tlsConfig verifies ServerName, or the host of address.
+func (r *DnsResolver) tlsConfig(upstream DnsUpstream, address string) *tls.Config {
+	var config *tls.Config
+	if r.config.TLSConfig != nil {
+		config = r.config.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	config.ServerName = upstream.ServerName
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		} else {
+			config.ServerName = strings.Trim(address, "[]")
+		}
+	}
+	return config
+}
@@ -0,0 +1,485 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDnsServer is a stand-in dns server which answers from records.
+type testDnsServer struct {
+	mutex   sync.Mutex
+	records map[string][]net.IP
+	ttl     uint32
+	// soaMinimum is sent in the SOA record of negative answers, and 0 means no SOA record
+	soaMinimum uint32
+	rcode      byte
+	// truncateUdp sets TC on the answers over udp
+	truncateUdp bool
+	queries     atomic.Int64
+}
+
+func newTestDnsServer(records map[string][]net.IP) *testDnsServer {
+	return &testDnsServer{records: records, ttl: 60}
+}
+
+func (s *testDnsServer) setRecords(records map[string][]net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = records
+}
+
+// answer returns the response of query.
+func (s *testDnsServer) answer(query []byte, udp bool) []byte {
+	s.queries.Add(1)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, off, err := readDnsName(query, dnsHeaderLength)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	response := append([]byte(nil), query[:off+4]...)
+	response[2] = 0x81
+	response[3] = 0x80 | s.rcode
+	if udp && s.truncateUdp {
+		response[2] |= 0x02
+		return response
+	}
+
+	var answers []net.IP
+	for _, ip := range s.records[name] {
+		if (ip.To4() != nil) == (qtype == dnsTypeA) {
+			answers = append(answers, ip)
+		}
+	}
+	if s.rcode != dnsRcodeSuccess {
+		answers = nil
+	}
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+	for _, ip := range answers {
+		if qtype == dnsTypeA {
+			ip = ip.To4()
+		}
+		response = append(response, 0xc0, dnsHeaderLength)
+		response = binary.BigEndian.AppendUint16(response, qtype)
+		response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+		response = binary.BigEndian.AppendUint32(response, s.ttl)
+		response = binary.BigEndian.AppendUint16(response, uint16(len(ip)))
+		response = append(response, ip...)
+	}
+	if len(answers) == 0 && s.soaMinimum > 0 {
+		binary.BigEndian.PutUint16(response[8:10], 1)
+		response = append(response, 0xc0, dnsHeaderLength)
+		response = binary.BigEndian.AppendUint16(response, dnsTypeSOA)
+		response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+		response = binary.BigEndian.AppendUint32(response, 3600)
+		response = binary.BigEndian.AppendUint16(response, 22)
+		// root mname and rname, then serial, refresh, retry, expire and minimum
+		response = append(response, 0, 0)
+		response = append(response, make([]byte, 16)...)
+		response = binary.BigEndian.AppendUint32(response, s.soaMinimum)
+	}
+	return response
+}
+
+// serveUdp answers on a local udp port and returns its address.
+func (s *testDnsServer) serveUdp(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(s.answer(buf[:n], true), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// serveStream answers on listener with the length prefix of tcp.
+func (s *testDnsServer) serveStream(t *testing.T, listener net.Listener) string {
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					response := s.answer(query, false)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (s *testDnsServer) serveTcp(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.serveStream(t, listener)
+}
+
+func TestDnsMessage(t *testing.T) {
+	t.Run("should parse the answer of the query", func(t *testing.T) {
+		server := newTestDnsServer(map[string][]net.IP{"example.com": {net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8)}})
+		query, err := newDnsQuery(1234, "example.com.", dnsTypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := parseDnsResponse(server.answer(query, false), 1234, "Example.com", dnsTypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.ips) != 2 || !response.ips[1].Equal(net.IPv4(5, 6, 7, 8)) || response.ttl != 60 {
+			t.Fatalf("want 2 ips with ttl 60 but got %v with ttl %d", response.ips, response.ttl)
+		}
+	})
+
+	t.Run("should read the negative ttl from the SOA record", func(t *testing.T) {
+		server := newTestDnsServer(nil)
+		server.soaMinimum = 7
+		server.rcode = dnsRcodeNameError
+		query, _ := newDnsQuery(1, "missing.example.com", dnsTypeAAAA)
+		response, err := parseDnsResponse(server.answer(query, false), 1, "missing.example.com", dnsTypeAAAA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.rcode != dnsRcodeNameError || !response.hasSoa || response.negativeTtl != 7 {
+			t.Fatalf("want NXDOMAIN with negative ttl 7 but got %+v", response)
+		}
+	})
+
+	t.Run("should reject a response of another query", func(t *testing.T) {
+		server := newTestDnsServer(nil)
+		query, _ := newDnsQuery(1, "example.com", dnsTypeA)
+		response := server.answer(query, false)
+		tests := map[string]func() error{
+			"id": func() error {
+				_, err := parseDnsResponse(response, 2, "example.com", dnsTypeA)
+				return err
+			},
+			"name": func() error {
+				_, err := parseDnsResponse(response, 1, "example.org", dnsTypeA)
+				return err
+			},
+			"type": func() error {
+				_, err := parseDnsResponse(response, 1, "example.com", dnsTypeAAAA)
+				return err
+			},
+			"query": func() error {
+				_, err := parseDnsResponse(query, 1, "example.com", dnsTypeA)
+				return err
+			},
+			"truncated": func() error {
+				_, err := parseDnsResponse(response[:len(response)-1], 1, "example.com", dnsTypeA)
+				return err
+			},
+		}
+		for name, test := range tests {
+			if err := test(); err != ErrDnsBadMessage {
+				t.Fatalf("%s: want err = %s but got %v", name, ErrDnsBadMessage, err)
+			}
+		}
+	})
+
+	t.Run("should reject a loop of pointers", func(t *testing.T) {
+		msg := append(make([]byte, dnsHeaderLength), 0xc0, dnsHeaderLength)
+		_, _, err := readDnsName(msg, dnsHeaderLength)
+		if err != ErrDnsBadMessage {
+			t.Fatalf("want err = %s but got %v", ErrDnsBadMessage, err)
+		}
+	})
+
+	t.Run("should reject an invalid name", func(t *testing.T) {
+		for _, name := range []string{"", "a..b", string(make([]byte, 64)) + ".com"} {
+			if _, err := newDnsQuery(1, name, dnsTypeA); err != ErrDnsBadName {
+				t.Fatalf("%q: want err = %s but got %v", name, ErrDnsBadName, err)
+			}
+		}
+	})
+}
+
+func TestDnsResolver(t *testing.T) {
+	ipv4, ipv6 := net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")
+	records := map[string][]net.IP{"example.com": {ipv4, ipv6}}
+	ctx := context.Background()
+
+	newResolver := func(t *testing.T, config DnsResolverConfig) *DnsResolver {
+		resolver, err := NewDnsResolver(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolver
+	}
+	lookup := func(t *testing.T, resolver Resolver, host string, want ...net.IP) {
+		ips, err := resolver.LookupIP(ctx, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != len(want) {
+			t.Fatalf("want %v but got %v", want, ips)
+		}
+		for i := range want {
+			if !ips[i].Equal(want[i]) {
+				t.Fatalf("want %v but got %v", want, ips)
+			}
+		}
+	}
+
+	t.Run("should resolve over udp and tcp", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		for _, upstream := range []DnsUpstream{
+			{Type: DnsUpstreamUdp, Address: server.serveUdp(t)},
+			{Type: DnsUpstreamTcp, Address: server.serveTcp(t)},
+		} {
+			resolver := newResolver(t, DnsResolverConfig{Upstreams: []DnsUpstream{upstream}})
+			lookup(t, resolver, "example.com", ipv4, ipv6)
+		}
+	})
+
+	t.Run("should retry a truncated answer over tcp", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		server.truncateUdp = true
+		udpAddr := server.serveUdp(t)
+		_, port, _ := net.SplitHostPort(udpAddr)
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Skip("the tcp port of the udp server is in use:", err)
+		}
+		server.serveStream(t, listener)
+
+		resolver := newResolver(t, DnsResolverConfig{Upstreams: []DnsUpstream{{Type: DnsUpstreamUdp, Address: udpAddr}}})
+		lookup(t, resolver, "example.com", ipv4, ipv6)
+	})
+
+	t.Run("should resolve over tls and https", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		ca := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "test ca"}}, nil)
+		serverCert := newTestCertificate(t, &x509.Certificate{
+			DNSNames:    []string{"dns.test"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, &ca)
+		rootCas := x509.NewCertPool()
+		rootCas.AddCert(ca.Leaf)
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsAddr := server.serveStream(t, listener)
+
+		httpsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			query, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(server.answer(query, false))
+		}))
+		httpsServer.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+		var closedConns atomic.Int32
+		httpsServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				closedConns.Add(1)
+			}
+		}
+		httpsServer.StartTLS()
+		defer httpsServer.Close()
+
+		for _, upstream := range []DnsUpstream{
+			{Type: DnsUpstreamTls, Address: tlsAddr, ServerName: "dns.test"},
+			{Type: DnsUpstreamHttps, Address: httpsServer.URL + "/dns-query", ServerName: "dns.test"},
+		} {
+			resolver := newResolver(t, DnsResolverConfig{
+				Upstreams: []DnsUpstream{upstream},
+				TLSConfig: &tls.Config{RootCAs: rootCas},
+			})
+			lookup(t, resolver, "example.com", ipv4, ipv6)
+		}
+
+		t.Run("should close the idle https connections", func(t *testing.T) {
+			resolver := newResolver(t, DnsResolverConfig{
+				Upstreams: []DnsUpstream{{Type: DnsUpstreamHttps, Address: httpsServer.URL + "/dns-query", ServerName: "dns.test"}},
+				TLSConfig: &tls.Config{RootCAs: rootCas},
+			})
+			lookup(t, resolver, "example.com", ipv4, ipv6)
+			closed := closedConns.Load()
+			resolver.CloseIdleConnections()
+			deadline := time.Now().Add(time.Second * 2)
+			for closedConns.Load() == closed {
+				if time.Now().After(deadline) {
+					t.Fatal("want the kept-alive connection closed")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		})
+
+		t.Run("should refuse an untrusted certificate", func(t *testing.T) {
+			resolver := newResolver(t, DnsResolverConfig{
+				Upstreams: []DnsUpstream{{Type: DnsUpstreamTls, Address: tlsAddr, ServerName: "dns.test"}},
+			})
+			_, err := resolver.LookupIP(ctx, "example.com")
+			if err == nil {
+				t.Fatal("want an error but got nil")
+			}
+		})
+	})
+
+	t.Run("should cache the answers until the ttl expires", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		server.ttl = 1
+		resolver := newResolver(t, DnsResolverConfig{Upstreams: []DnsUpstream{{Type: DnsUpstreamUdp, Address: server.serveUdp(t)}}})
+
+		lookup(t, resolver, "example.com", ipv4, ipv6)
+		lookup(t, resolver, "EXAMPLE.com.", ipv4, ipv6)
+		if queries := server.queries.Load(); queries != 2 {
+			t.Fatalf("want 2 queries but got %d", queries)
+		}
+
+		server.setRecords(map[string][]net.IP{"example.com": {net.IPv4(192, 0, 2, 2)}})
+		time.Sleep(time.Millisecond * 1100)
+		lookup(t, resolver, "example.com", net.IPv4(192, 0, 2, 2))
+		if queries := server.queries.Load(); queries != 4 {
+			t.Fatalf("want 4 queries but got %d", queries)
+		}
+	})
+
+	t.Run("should cache the negative answers", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		server.rcode = dnsRcodeNameError
+		server.soaMinimum = 1
+		resolver := newResolver(t, DnsResolverConfig{
+			Upstreams:   []DnsUpstream{{Type: DnsUpstreamUdp, Address: server.serveUdp(t)}},
+			NegativeTtl: time.Hour,
+		})
+
+		for i := 0; i < 2; i++ {
+			_, err := resolver.LookupIP(ctx, "example.com")
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Fatalf("want a not found error but got %v", err)
+			}
+			if ReplyFromError(err) != ReplyHostUnreachable {
+				t.Fatalf("want reply %d but got %d", ReplyHostUnreachable, ReplyFromError(err))
+			}
+		}
+		if queries := server.queries.Load(); queries != 2 {
+			t.Fatalf("want 2 queries but got %d", queries)
+		}
+
+		// the SOA record limits the negative ttl to 1 second
+		server.mutex.Lock()
+		server.rcode = dnsRcodeSuccess
+		server.mutex.Unlock()
+		time.Sleep(time.Millisecond * 1100)
+		lookup(t, resolver, "example.com", ipv4, ipv6)
+	})
+
+	t.Run("should ask the next upstream when one fails", func(t *testing.T) {
+		failing := newTestDnsServer(records)
+		failing.rcode = 2 // SERVFAIL
+		server := newTestDnsServer(records)
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed.Close()
+
+		resolver := newResolver(t, DnsResolverConfig{Upstreams: []DnsUpstream{
+			{Type: DnsUpstreamTcp, Address: closed.Addr().String()},
+			{Type: DnsUpstreamUdp, Address: failing.serveUdp(t)},
+			{Type: DnsUpstreamUdp, Address: server.serveUdp(t)},
+		}})
+		lookup(t, resolver, "example.com", ipv4, ipv6)
+		if queries := failing.queries.Load(); queries != 2 {
+			t.Fatalf("want 2 queries to the failing upstream but got %d", queries)
+		}
+	})
+
+	t.Run("should answer from hosts and prefer the family", func(t *testing.T) {
+		server := newTestDnsServer(records)
+		resolver := newResolver(t, DnsResolverConfig{
+			Upstreams:    []DnsUpstream{{Type: DnsUpstreamUdp, Address: server.serveUdp(t)}},
+			Hosts:        map[string][]string{"Internal.Example.": {"10.0.0.5", "fd00::5"}},
+			PreferFamily: IpFamilyIpv6,
+		})
+		lookup(t, resolver, "internal.example", net.ParseIP("fd00::5"), net.IPv4(10, 0, 0, 5))
+		lookup(t, resolver, "example.com", ipv6, ipv4)
+		lookup(t, resolver, "192.0.2.9", net.IPv4(192, 0, 2, 9))
+		if queries := server.queries.Load(); queries != 2 {
+			t.Fatalf("want 2 queries but got %d", queries)
+		}
+	})
+
+	t.Run("should reject an invalid config", func(t *testing.T) {
+		tests := map[string]DnsResolverConfig{
+			"type":   {Upstreams: []DnsUpstream{{Type: "quic", Address: "127.0.0.1"}}},
+			"https":  {Upstreams: []DnsUpstream{{Type: DnsUpstreamHttps, Address: "127.0.0.1"}}},
+			"hosts":  {Hosts: map[string][]string{"example.com": {"not an ip"}}},
+			"family": {PreferFamily: "ipv5"},
+		}
+		for name, config := range tests {
+			if _, err := NewDnsResolver(config); err == nil {
+				t.Fatalf("%s: want an error but got nil", name)
+			}
+		}
+	})
+}
+
+func TestServerResolver(t *testing.T) {
+	t.Run("should dial the ips of the resolver", func(t *testing.T) {
+		echoAddr := runTestEchoServer(t)
+		_, port, _ := net.SplitHostPort(echoAddr)
+		resolver, err := NewDnsResolver(DnsResolverConfig{
+			Upstreams: []DnsUpstream{{Type: DnsUpstreamUdp, Address: newTestDnsServer(nil).serveUdp(t)}},
+			Hosts:     map[string][]string{"echo.test": {"127.0.0.1"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewSocks5Server("127.0.0.1", 0, Config{Resolver: resolver})
+		addr, _ := runTestServer(t, server)
+
+		client := &Client{ProxyAddr: addr}
+		conn, err := client.Dial("tcp", net.JoinHostPort("echo.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+	})
+}
@@ -0,0 +1,370 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrRuleDenied  = errors.New("request denied by rules")
+	ErrInvalidRule = errors.New("invalid rule")
+)
+
+type RuleAction = string
+
+const (
+	RuleAllow RuleAction = "allow"
+	RuleDeny  RuleAction = "deny"
+)
+
+// Rule decides whether a request is allowed.
+// It matches a request when all of its non-empty fields match, and a field matches when any of its entries matches.
+type Rule struct {
+	Action RuleAction
+	// Sources are the ips or CIDRs of clients, such as "192.168.1.0/24".
+	Sources []string
+	// Users are the usernames of authenticated clients.
+	Users []string
+	// Destinations are the ips or CIDRs of destinations.
+	// A domain destination matches by its resolved ips, which are unknown when it goes through upstreams.
+	// The server checks every resolved ip alone, and only connects to the allowed ones.
+	Destinations []string
+	// Domains match domain destinations:
+	// "example.com" matches example.com and its subdomains,
+	// "*.example.com" is a wildcard pattern, and "regexp:^api[0-9]+\.example\.com$" is a regular expression.
+	Domains []string
+	// Ports are the ports or port ranges of destinations, such as "443" or "8000-9000".
+	Ports []string
+	// Commands are "connect", "bind" and "udp".
+	Commands []string
+	// Outbound pins the source of the tcp connections which an allow rule decides, such as per user.
+	Outbound `mapstructure:",squash"`
+}
+
+// RuleRequest is what rules are evaluated against.
+type RuleRequest struct {
+	Cmd        Command
+	ClientAddr net.Addr
+	Identity   *Identity // nil when the client is anonymous
+	Address    string    // destination ip or domain
+	Port       uint16
+	Ips        []net.IP // resolved ips of a domain destination, may be empty
+}
+
+var ruleCommands = map[string]Command{
+	"connect": CmdConnect,
+	"bind":    CmdBind,
+	"udp":     cmdUdp,
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+type compiledRule struct {
+	action       RuleAction
+	sources      []*net.IPNet
+	users        map[string]bool
+	destinations []*net.IPNet
+	domains      []func(domain string) bool
+	ports        []portRange
+	commands     map[Command]bool
+	outbound     *Outbound
+}
+
+// RuleSet evaluates rules in order. The first matching rule decides, and DefaultAction decides when none matches.
+type RuleSet struct {
+	DefaultAction RuleAction
+	rules         []compiledRule
+}
+
+func NewRuleSet(rules []Rule, defaultAction RuleAction) (*RuleSet, error) {
+	if defaultAction == "" {
+		defaultAction = RuleAllow
+	}
+	if defaultAction != RuleAllow && defaultAction != RuleDeny {
+		return nil, fmt.Errorf("%w: unknown default action %q", ErrInvalidRule, defaultAction)
+	}
+	ruleSet := &RuleSet{DefaultAction: defaultAction}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rule %d: %s", ErrInvalidRule, i+1, err)
+		}
+		ruleSet.rules = append(ruleSet.rules, compiled)
+	}
+	return ruleSet, nil
+}
+
+// Allow reports whether the request is allowed. A nil RuleSet allows everything.
+func (r *RuleSet) Allow(request *RuleRequest) bool {
+	allow, _ := r.Decide(request)
+	return allow
+}
+
+// Decide reports whether the request is allowed, and returns the outbound of the deciding rule.
+// The outbound is nil when the rule has none, or when the default action decides.
+func (r *RuleSet) Decide(request *RuleRequest) (bool, *Outbound) {
+	if r == nil {
+		return true, nil
+	}
+	for i := range r.rules {
+		if r.rules[i].match(request) {
+			return r.rules[i].action == RuleAllow, r.rules[i].outbound
+		}
+	}
+	return r.DefaultAction == RuleAllow, nil
+}
+
+// decideByName decides the request of a domain destination before it is resolved, so a denied domain is never resolved.
+// It reports decided = false when a rule with destinations may match the request, which needs the resolved ips.
+func (r *RuleSet) decideByName(request *RuleRequest) (decided, allow bool, outbound *Outbound) {
+	if r == nil {
+		return true, true, nil
+	}
+	isIp := net.ParseIP(request.Address) != nil
+	for i := range r.rules {
+		rule := r.rules[i]
+		if rule.destinations != nil && !isIp {
+			// the other fields tell whether the ips are needed
+			rule.destinations = nil
+			if rule.match(request) {
+				return false, false, nil
+			}
+			continue
+		}
+		if rule.match(request) {
+			return true, rule.action == RuleAllow, rule.outbound
+		}
+	}
+	return true, r.DefaultAction == RuleAllow, nil
+}
+
+// allowedIps checks every resolved ip of a domain destination alone, and returns the allowed ones,
+// so a domain which resolves to an allowed and a denied ip can only reach the allowed one.
+// The outbound is the one of the rule which allows the first ip, and the ips allowed with another outbound are left out.
+func (r *RuleSet) allowedIps(request *RuleRequest, ips []net.IP) ([]net.IP, *Outbound) {
+	var allowedIps []net.IP
+	var allowedOutbound *Outbound
+	single := *request
+	for _, ip := range ips {
+		single.Ips = []net.IP{ip}
+		allow, outbound := r.Decide(&single)
+		if !allow || (allowedIps != nil && outbound != allowedOutbound) {
+			continue
+		}
+		allowedIps = append(allowedIps, ip)
+		allowedOutbound = outbound
+	}
+	return allowedIps, allowedOutbound
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{action: strings.ToLower(rule.Action)}
+	if compiled.action != RuleAllow && compiled.action != RuleDeny {
+		return compiled, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	var err error
+	compiled.sources, err = parseCidrs(rule.Sources)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.destinations, err = parseCidrs(rule.Destinations)
+	if err != nil {
+		return compiled, err
+	}
+
+	if len(rule.Users) > 0 {
+		compiled.users = make(map[string]bool)
+		for _, user := range rule.Users {
+			compiled.users[user] = true
+		}
+	}
+
+	for _, domain := range rule.Domains {
+		matcher, err := compileDomain(domain)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.domains = append(compiled.domains, matcher)
+	}
+
+	for _, port := range rule.Ports {
+		portRange, err := parsePortRange(port)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.ports = append(compiled.ports, portRange)
+	}
+
+	if !rule.Outbound.isZero() {
+		if compiled.action != RuleAllow {
+			return compiled, fmt.Errorf("source address and interface need action allow")
+		}
+		if err := rule.Outbound.check(); err != nil {
+			return compiled, err
+		}
+		outbound := rule.Outbound
+		compiled.outbound = &outbound
+	}
+
+	if len(rule.Commands) > 0 {
+		compiled.commands = make(map[Command]bool)
+		for _, command := range rule.Commands {
+			cmd, ok := ruleCommands[strings.ToLower(command)]
+			if !ok {
+				return compiled, fmt.Errorf("unknown command %q", command)
+			}
+			compiled.commands[cmd] = true
+		}
+	}
+	return compiled, nil
+}
+
+// parseCidrs parses CIDRs. A single ip is the same as a CIDR with the full mask.
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", cidr)
+			}
+			bits := Ipv6Length * 8
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = Ipv4Length * 8
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+func compileDomain(domain string) (func(string) bool, error) {
+	if strings.HasPrefix(domain, "regexp:") {
+		re, err := regexp.Compile(strings.TrimPrefix(domain, "regexp:"))
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	domain = normalizeDomain(domain)
+	if strings.Contains(domain, "*") {
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(domain), `\*`, ".*")
+		re := regexp.MustCompile("^" + pattern + "$")
+		return re.MatchString, nil
+	}
+	return func(destination string) bool {
+		return destination == domain || strings.HasSuffix(destination, "."+domain)
+	}, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+func parsePortRange(port string) (portRange, error) {
+	minStr, maxStr, isRange := strings.Cut(port, "-")
+	if !isRange {
+		maxStr = minStr
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(minStr), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", port)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(maxStr), 10, 16)
+	if err != nil || max < min {
+		return portRange{}, fmt.Errorf("invalid port %q", port)
+	}
+	return portRange{uint16(min), uint16(max)}, nil
+}
+
+func (c *compiledRule) match(request *RuleRequest) bool {
+	if c.sources != nil {
+		ip := addrIp(request.ClientAddr)
+		if ip == nil || !containsIp(c.sources, ip) {
+			return false
+		}
+	}
+
+	if c.users != nil {
+		if request.Identity == nil || !c.users[request.Identity.Username] {
+			return false
+		}
+	}
+
+	ip := net.ParseIP(request.Address)
+	if c.destinations != nil {
+		ips := request.Ips
+		if ip != nil {
+			ips = []net.IP{ip}
+		}
+		matched := false
+		for _, ip := range ips {
+			if containsIp(c.destinations, ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if c.domains != nil {
+		if ip != nil {
+			return false
+		}
+		domain := normalizeDomain(request.Address)
+		matched := false
+		for _, matcher := range c.domains {
+			if matcher(domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if c.ports != nil {
+		matched := false
+		for _, portRange := range c.ports {
+			if request.Port >= portRange.min && request.Port <= portRange.max {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if c.commands != nil && !c.commands[request.Cmd] {
+		return false
+	}
+	return true
+}
+
+func containsIp(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
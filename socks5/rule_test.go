@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRuleSetAllow(t *testing.T) {
+	client := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 50000}
+	otherClient := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	alice := &Identity{Method: MethodPassword, Username: "alice"}
+
+	tests := []struct {
+		name    string
+		rule    Rule
+		request RuleRequest
+		matched bool
+	}{
+		{"source cidr", Rule{Sources: []string{"192.168.1.0/24"}}, RuleRequest{ClientAddr: client}, true},
+		{"source cidr mismatch", Rule{Sources: []string{"192.168.1.0/24"}}, RuleRequest{ClientAddr: otherClient}, false},
+		{"single source ip", Rule{Sources: []string{"192.168.1.10"}}, RuleRequest{ClientAddr: client}, true},
+		{"user", Rule{Users: []string{"alice"}}, RuleRequest{Identity: alice}, true},
+		{"anonymous user", Rule{Users: []string{"alice"}}, RuleRequest{}, false},
+		{"destination ip", Rule{Destinations: []string{"10.0.0.0/8"}}, RuleRequest{Address: "10.1.2.3"}, true},
+		{"destination resolved ip", Rule{Destinations: []string{"10.0.0.0/8"}}, RuleRequest{Address: "internal.example.com", Ips: []net.IP{net.IPv4(10, 1, 2, 3)}}, true},
+		{"destination unresolved domain", Rule{Destinations: []string{"10.0.0.0/8"}}, RuleRequest{Address: "internal.example.com"}, false},
+		{"destination ipv6", Rule{Destinations: []string{"fd00::/8"}}, RuleRequest{Address: "fd00::1"}, true},
+		{"domain itself", Rule{Domains: []string{"example.com"}}, RuleRequest{Address: "example.com"}, true},
+		{"domain suffix", Rule{Domains: []string{"example.com"}}, RuleRequest{Address: "WWW.Example.com."}, true},
+		{"domain suffix mismatch", Rule{Domains: []string{"example.com"}}, RuleRequest{Address: "badexample.com"}, false},
+		{"domain wildcard", Rule{Domains: []string{"*.example.com"}}, RuleRequest{Address: "a.example.com"}, true},
+		{"domain wildcard mismatch", Rule{Domains: []string{"*.example.com"}}, RuleRequest{Address: "example.com"}, false},
+		{"domain regexp", Rule{Domains: []string{`regexp:^api[0-9]+\.example\.com$`}}, RuleRequest{Address: "api12.example.com"}, true},
+		{"domain with ip destination", Rule{Domains: []string{"example.com"}}, RuleRequest{Address: "1.2.3.4"}, false},
+		{"port", Rule{Ports: []string{"443"}}, RuleRequest{Port: 443}, true},
+		{"port range", Rule{Ports: []string{"8000-9000"}}, RuleRequest{Port: 8080}, true},
+		{"port range mismatch", Rule{Ports: []string{"8000-9000"}}, RuleRequest{Port: 9001}, false},
+		{"command", Rule{Commands: []string{"udp"}}, RuleRequest{Cmd: cmdUdp}, true},
+		{"command mismatch", Rule{Commands: []string{"connect", "bind"}}, RuleRequest{Cmd: cmdUdp}, false},
+		{"all fields", Rule{Users: []string{"alice"}, Domains: []string{"example.com"}, Ports: []string{"443"}}, RuleRequest{Identity: alice, Address: "example.com", Port: 443}, true},
+		{"one field mismatch", Rule{Users: []string{"alice"}, Domains: []string{"example.com"}, Ports: []string{"443"}}, RuleRequest{Identity: alice, Address: "example.com", Port: 80}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := test.rule
+			rule.Action = RuleDeny
+			ruleSet, err := NewRuleSet([]Rule{rule}, RuleAllow)
+			if err != nil {
+				t.Fatalf("want err = nil but got %s", err)
+			}
+			if allowed := ruleSet.Allow(&test.request); allowed == test.matched {
+				t.Fatalf("want matched = %t but got %t", test.matched, !allowed)
+			}
+		})
+	}
+
+	t.Run("the first matching rule decides", func(t *testing.T) {
+		ruleSet, err := NewRuleSet([]Rule{
+			{Action: RuleAllow, Domains: []string{"good.example.com"}},
+			{Action: RuleDeny, Domains: []string{"example.com"}},
+		}, RuleAllow)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if !ruleSet.Allow(&RuleRequest{Address: "good.example.com"}) {
+			t.Fatalf("want good.example.com allowed")
+		}
+		if ruleSet.Allow(&RuleRequest{Address: "bad.example.com"}) {
+			t.Fatalf("want bad.example.com denied")
+		}
+	})
+
+	t.Run("the default action decides without matching rule", func(t *testing.T) {
+		ruleSet, err := NewRuleSet([]Rule{{Action: RuleAllow, Ports: []string{"443"}}}, RuleDeny)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if ruleSet.Allow(&RuleRequest{Port: 80}) {
+			t.Fatalf("want port 80 denied")
+		}
+	})
+
+	t.Run("nil rule set allows everything", func(t *testing.T) {
+		var ruleSet *RuleSet
+		if !ruleSet.Allow(&RuleRequest{}) {
+			t.Fatalf("want allowed")
+		}
+	})
+}
+
+func TestDialRules(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	ctx := context.Background()
+	// the denied ip comes first, so it would be dialed first
+	resolver, err := NewDnsResolver(DnsResolverConfig{Hosts: map[string][]string{
+		"mixed.test":    {"127.0.0.1", "203.0.113.5"},
+		"loopback.test": {"127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowList := []Rule{{Action: RuleAllow, Destinations: []string{"203.0.113.0/24"}}}
+	denyList := []Rule{{Action: RuleDeny, Destinations: []string{"127.0.0.0/8"}}}
+
+	for _, test := range []struct {
+		name          string
+		rules         []Rule
+		defaultAction RuleAction
+	}{
+		{"allow list", allowList, RuleDeny},
+		{"deny list", denyList, RuleAllow},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := NewRuleSet(test.rules, test.defaultAction)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dialer := &testFamilyDialer{target: echoAddr}
+			config, err := newServerConfig(Config{Dialer: dialer, Resolver: resolver, Rules: rules})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Address: "mixed.test", Port: 80})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if dialed := dialer.dialed(); len(dialed) != 1 || dialed[0] != "203.0.113.5:80" {
+				t.Fatalf("want only 203.0.113.5:80 dialed but got %v", dialed)
+			}
+
+			addr, err := config.udpDestAddr(ctx, &RuleRequest{Cmd: cmdUdp, Address: "mixed.test", Port: 53})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != "203.0.113.5:53" {
+				t.Fatalf("want 203.0.113.5:53 but got %s", addr)
+			}
+
+			if _, err := config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Address: "loopback.test", Port: 80}); err != ErrRuleDenied {
+				t.Fatalf("want err = %s but got %v", ErrRuleDenied, err)
+			}
+			if _, err := config.udpDestAddr(ctx, &RuleRequest{Cmd: cmdUdp, Address: "loopback.test", Port: 53}); err != ErrRuleDenied {
+				t.Fatalf("want err = %s but got %v", ErrRuleDenied, err)
+			}
+		})
+	}
+}
+
+func TestDialRulesBeforeLookup(t *testing.T) {
+	ctx := context.Background()
+	// the rule of bob needs the ips, but it can not match the other clients
+	rules, err := NewRuleSet([]Rule{
+		{Action: RuleAllow, Users: []string{"bob"}, Destinations: []string{"10.0.0.0/8"}},
+		{Action: RuleDeny, Domains: []string{"blocked.test"}},
+	}, RuleAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &testCountingResolver{}
+	config, err := newServerConfig(Config{Resolver: resolver, Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Address: "blocked.test", Port: 80}); err != ErrRuleDenied {
+		t.Fatalf("want err = %s but got %v", ErrRuleDenied, err)
+	}
+	if _, err := config.udpDestAddr(ctx, &RuleRequest{Cmd: cmdUdp, Address: "blocked.test", Port: 53}); err != ErrRuleDenied {
+		t.Fatalf("want err = %s but got %v", ErrRuleDenied, err)
+	}
+	if lookups := resolver.lookups.Load(); lookups != 0 {
+		t.Fatalf("want the denied domain not resolved but got %d lookups", lookups)
+	}
+
+	bob := &Identity{Method: MethodPassword, Username: "bob"}
+	if _, err := config.dialTcp(ctx, &RuleRequest{Cmd: CmdConnect, Identity: bob, Address: "blocked.test", Port: 80}); ReplyFromError(err) != ReplyHostUnreachable {
+		t.Fatalf("want reply %d but got %d of %v", ReplyHostUnreachable, ReplyFromError(err), err)
+	}
+	if lookups := resolver.lookups.Load(); lookups != 1 {
+		t.Fatalf("want the domain of bob resolved for the rule but got %d lookups", lookups)
+	}
+}
+
+func TestNewRuleSet(t *testing.T) {
+	invalidRules := []Rule{
+		{Action: "reject"},
+		{Action: RuleDeny, Sources: []string{"192.168.1.0/33"}},
+		{Action: RuleDeny, Destinations: []string{"not an ip"}},
+		{Action: RuleDeny, Domains: []string{"regexp:("}},
+		{Action: RuleDeny, Ports: []string{"9000-8000"}},
+		{Action: RuleDeny, Ports: []string{"65536"}},
+		{Action: RuleDeny, Commands: []string{"listen"}},
+		{Action: RuleDeny, Outbound: Outbound{SourceAddress: "192.0.2.10"}},
+		{Action: RuleAllow, Outbound: Outbound{SourceAddress: "not an ip"}},
+		{Action: RuleAllow, Outbound: Outbound{SourceAddress: "192.0.2.10", Interface: "eth1"}},
+	}
+	for _, rule := range invalidRules {
+		_, err := NewRuleSet([]Rule{rule}, RuleAllow)
+		if !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("rule %+v: want err = %s but got %v", rule, ErrInvalidRule, err)
+		}
+	}
+
+	_, err := NewRuleSet(nil, "reject")
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("want err = %s but got %v", ErrInvalidRule, err)
+	}
+}
+
+func TestUdpRelayServerRules(t *testing.T) {
+	deniedAddr := runTestEchoServer(t)
+	allowedAddr := runTestEchoServer(t)
+	_, deniedPort, _ := net.SplitHostPort(deniedAddr)
+
+	server := NewSocks5Server("127.0.0.1", 0, Config{UdpPort: UdpRelayRandomPort})
+	rules, err := NewRuleSet([]Rule{{Action: RuleDeny, Ports: []string{deniedPort}, Commands: []string{"udp"}}}, RuleAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.Rules = rules
+	proxyAddr, _ := runTestServer(t, server)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := NewClient(proxyAddr, "", "").ListenPacket(context.Background())
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	defer conn.Close()
+
+	// the denied datagram is dropped, and the association keeps working
+	for _, addr := range []string{deniedAddr, allowedAddr} {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteTo([]byte("ping"), udpAddr); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, 100)
+	_, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	if addr.String() != allowedAddr {
+		t.Fatalf("want address %s but got %s", allowedAddr, addr)
+	}
+}
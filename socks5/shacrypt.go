@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ and $6$) of https://www.akkadia.org/drepper/SHA-crypt.txt,
+// which is used by /etc/shadow and "openssl passwd -5/-6".
+
+var ErrInvalidShaCrypt = errors.New("invalid sha-crypt hash")
+
+const (
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shaCryptMaxSalt       = 16
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+)
+
+type shaCryptVariant struct {
+	prefix  string
+	newHash func() hash.Hash
+	// groups of 3 bytes of the digest, in the order of the encoding
+	groups [][3]int
+}
+
+var shaCrypt256 = shaCryptVariant{
+	prefix:  "$5$",
+	newHash: sha256.New,
+	groups: [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	},
+}
+
+var shaCrypt512 = shaCryptVariant{
+	prefix:  "$6$",
+	newHash: sha512.New,
+	groups: [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	},
+}
+
+// shaCrypt parses the settings of hashed, such as "$6$rounds=10000$salt$...", and hashes password with them.
+func shaCrypt(variant shaCryptVariant, password, hashed string) (string, error) {
+	settings := strings.TrimPrefix(hashed, variant.prefix)
+	rounds := shaCryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(settings, "rounds=") {
+		roundsStr, rest, ok := strings.Cut(strings.TrimPrefix(settings, "rounds="), "$")
+		if !ok {
+			return "", ErrInvalidShaCrypt
+		}
+		n, err := strconv.ParseUint(roundsStr, 10, 32)
+		if err != nil {
+			return "", ErrInvalidShaCrypt
+		}
+		rounds = int(n)
+		if rounds < shaCryptMinRounds {
+			rounds = shaCryptMinRounds
+		} else if rounds > shaCryptMaxRounds {
+			rounds = shaCryptMaxRounds
+		}
+		customRounds = true
+		settings = rest
+	}
+	salt, _, _ := strings.Cut(settings, "$")
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	digest := shaCryptDigest(variant.newHash, []byte(password), []byte(salt), rounds)
+
+	var b strings.Builder
+	b.WriteString(variant.prefix)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt + "$")
+	for _, group := range variant.groups {
+		shaCryptEncode(&b, digest[group[0]], digest[group[1]], digest[group[2]], 4)
+	}
+	if len(digest) == sha256.Size {
+		shaCryptEncode(&b, 0, digest[31], digest[30], 3)
+	} else {
+		shaCryptEncode(&b, 0, 0, digest[63], 2)
+	}
+	return b.String(), nil
+}
+
+func shaCryptDigest(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	alternate := h.Sum(nil)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(alternate, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(alternate)
+		} else {
+			h.Write(password)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	pBytes := repeatBytes(h.Sum(nil), len(password))
+
+	h.Reset()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		h.Write(salt)
+	}
+	sBytes := repeatBytes(h.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(digest)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i%2 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(pBytes)
+		}
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+// repeatBytes repeats b until it is n bytes long.
+func repeatBytes(b []byte, n int) []byte {
+	result := make([]byte, 0, n)
+	for len(result) < n {
+		rest := b
+		if len(rest) > n-len(result) {
+			rest = rest[:n-len(result)]
+		}
+		result = append(result, rest...)
+	}
+	return result
+}
+
+func shaCryptEncode(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		b.WriteByte(shaCryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
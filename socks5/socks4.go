@@ -0,0 +1,157 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// SOCKS4 (https://www.openssh.com/txt/socks4.protocol) and its 4a extension
+// (https://www.openssh.com/txt/socks4a.protocol), for legacy clients.
+
+const Socks4Version = 0x04
+
+// Socks4ReplyType is CD of a socks4 reply.
+type Socks4ReplyType = byte
+
+const (
+	Socks4ReplyGranted           Socks4ReplyType = 0x5a
+	Socks4ReplyRejected          Socks4ReplyType = 0x5b
+	Socks4ReplyIdentdUnreachable Socks4ReplyType = 0x5c
+	Socks4ReplyIdentdMismatch    Socks4ReplyType = 0x5d
+)
+
+// socks4ReplyVersion is VN of a reply, which is 0 rather than 4.
+const socks4ReplyVersion = 0x00
+
+// socks4MaxFieldLength limits USERID and the domain of socks4a, which end with NULL.
+const socks4MaxFieldLength = 255
+
+var ErrSocks4FieldTooLong = errors.New("socks4 userid or domain is too long")
+
+// Socks4RequestMessage is a CONNECT or BIND request of socks4 or socks4a.
+type Socks4RequestMessage struct {
+	Cmd     Command
+	Port    uint16
+	Address string // an ipv4 address, or the domain of socks4a
+	UserId  string
+}
+
+// NewSocks4RequestMessage reads a request. DSTIP 0.0.0.x with x != 0 means the domain of socks4a follows USERID.
+func NewSocks4RequestMessage(conn io.Reader) (*Socks4RequestMessage, error) {
+	// read version, command, port and ip
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != Socks4Version {
+		return nil, ErrVersionNotSupport
+	}
+	command := buf[1]
+	if command != CmdConnect && command != CmdBind {
+		return nil, ErrCommandNotSupport
+	}
+
+	message := Socks4RequestMessage{
+		Cmd:     command,
+		Port:    binary.BigEndian.Uint16(buf[2:4]),
+		Address: net.IP(buf[4:8]).String(),
+	}
+	message.UserId, err = readNullTerminated(conn)
+	if err != nil {
+		return nil, err
+	}
+	if buf[4] == 0 && buf[5] == 0 && buf[6] == 0 && buf[7] != 0 {
+		message.Address, err = readNullTerminated(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
+}
+
+// readNullTerminated reads a string which ends with NULL, one byte at a time,
+// so nothing after it is consumed.
+func readNullTerminated(conn io.Reader) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxFieldLength {
+			return "", ErrSocks4FieldTooLong
+		}
+		field = append(field, b[0])
+	}
+}
+
+// clientRequestMessage converts the request, so it is handled the same as a socks5 one.
+func (m *Socks4RequestMessage) clientRequestMessage() *ClientRequestMessage {
+	addressType := AddressTypeIpv4
+	if net.ParseIP(m.Address) == nil {
+		addressType = AddressTypeDomain
+	}
+	return &ClientRequestMessage{
+		Cmd:         m.Cmd,
+		Address:     m.Address,
+		Port:        m.Port,
+		AddressType: addressType,
+	}
+}
+
+// WriteSocks4RequestMessage is used by the client to send a request.
+// A domain address is sent by the socks4a extension.
+func WriteSocks4RequestMessage(conn io.Writer, message *Socks4RequestMessage) error {
+	if len(message.UserId) > socks4MaxFieldLength || len(message.Address) > socks4MaxFieldLength {
+		return ErrSocks4FieldTooLong
+	}
+	buf := []byte{Socks4Version, message.Cmd}
+	buf = binary.BigEndian.AppendUint16(buf, message.Port)
+	ip := net.ParseIP(message.Address).To4()
+	if ip != nil {
+		buf = append(buf, ip...)
+	} else {
+		buf = append(buf, 0, 0, 0, 1)
+	}
+	buf = append(buf, message.UserId...)
+	buf = append(buf, 0)
+	if ip == nil {
+		buf = append(buf, message.Address...)
+		buf = append(buf, 0)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// WriteSocks4Reply sends a reply. Only ipv4 fits in it, so other ips are sent as 0.0.0.0.
+func WriteSocks4Reply(conn io.Writer, reply Socks4ReplyType, ip net.IP, port uint16) error {
+	buf := []byte{socks4ReplyVersion, reply}
+	buf = binary.BigEndian.AppendUint16(buf, port)
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, 0, 0, 0, 0)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// NewSocks4ReplyMessage is used by the client to read a reply.
+func NewSocks4ReplyMessage(conn io.Reader) (Socks4ReplyType, net.IP, uint16, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return Socks4ReplyRejected, nil, 0, err
+	}
+	if buf[0] != socks4ReplyVersion {
+		return Socks4ReplyRejected, nil, 0, ErrVersionNotSupport
+	}
+	return buf[1], net.IP(buf[4:8]), binary.BigEndian.Uint16(buf[2:4]), nil
+}
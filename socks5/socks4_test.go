@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSocks4RequestMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		message *Socks4RequestMessage
+		err     error
+	}{
+		{
+			"should parse socks4 connect",
+			[]byte{Socks4Version, CmdConnect, 0x00, 0x50, 1, 2, 3, 4, 'u', 's', 'e', 'r', 0},
+			&Socks4RequestMessage{Cmd: CmdConnect, Port: 80, Address: "1.2.3.4", UserId: "user"},
+			nil,
+		},
+		{
+			"should parse socks4a bind with a domain",
+			[]byte{Socks4Version, CmdBind, 0x01, 0xbb, 0, 0, 0, 1, 0, 'a', '.', 'c', 'o', 'm', 0},
+			&Socks4RequestMessage{Cmd: CmdBind, Port: 443, Address: "a.com"},
+			nil,
+		},
+		{
+			"should reject other versions",
+			[]byte{Socks5Version, CmdConnect, 0x00, 0x50, 1, 2, 3, 4, 0},
+			nil,
+			ErrVersionNotSupport,
+		},
+		{
+			"should reject other commands",
+			[]byte{Socks4Version, cmdUdp, 0x00, 0x50, 1, 2, 3, 4, 0},
+			nil,
+			ErrCommandNotSupport,
+		},
+		{
+			"should reject a userid longer than 255 bytes",
+			append([]byte{Socks4Version, CmdConnect, 0x00, 0x50, 1, 2, 3, 4}, append(bytes.Repeat([]byte{'u'}, 256), 0)...),
+			nil,
+			ErrSocks4FieldTooLong,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := NewSocks4RequestMessage(bytes.NewReader(test.data))
+			if err != test.err {
+				t.Fatalf("want error %v but got %v", test.err, err)
+			}
+			if !reflect.DeepEqual(message, test.message) {
+				t.Fatalf("want %#v but got %#v", test.message, message)
+			}
+		})
+	}
+
+	t.Run("should accept a userid of 255 bytes", func(t *testing.T) {
+		userId := strings.Repeat("u", socks4MaxFieldLength)
+		var buf bytes.Buffer
+		err := WriteSocks4RequestMessage(&buf, &Socks4RequestMessage{Cmd: CmdConnect, Port: 80, Address: "1.2.3.4", UserId: userId})
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := NewSocks4RequestMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.UserId != userId {
+			t.Fatalf("want a userid of %d bytes but got %d", len(userId), len(message.UserId))
+		}
+	})
+}
+
+func TestWriteSocks4RequestMessage(t *testing.T) {
+	t.Run("should send a domain by socks4a", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := WriteSocks4RequestMessage(&buf, &Socks4RequestMessage{Cmd: CmdConnect, Port: 80, Address: "a.com", UserId: "u"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []byte{Socks4Version, CmdConnect, 0x00, 0x50, 0, 0, 0, 1, 'u', 0, 'a', '.', 'c', 'o', 'm', 0}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("want %v but got %v", want, buf.Bytes())
+		}
+	})
+}
+
+func TestWriteSocks4Reply(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+		want []byte
+	}{
+		{"should write an ipv4 address", net.ParseIP("1.2.3.4"), []byte{0x00, Socks4ReplyGranted, 0x04, 0x38, 1, 2, 3, 4}},
+		{"should write 0.0.0.0 for ipv6", net.ParseIP("::1"), []byte{0x00, Socks4ReplyGranted, 0x04, 0x38, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteSocks4Reply(&buf, Socks4ReplyGranted, test.ip, 1080); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), test.want) {
+				t.Fatalf("want %v but got %v", test.want, buf.Bytes())
+			}
+			reply, ip, port, err := NewSocks4ReplyMessage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply != Socks4ReplyGranted || !ip.Equal(net.IP(test.want[4:8])) || port != 1080 {
+				t.Fatalf("want granted %v:1080 but got 0x%02x %v:%d", net.IP(test.want[4:8]), reply, ip, port)
+			}
+		})
+	}
+}
+
+func TestSocks4Server(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	echoHost, echoPortStr, _ := net.SplitHostPort(echoAddr)
+	echoPort, _ := strconv.Atoi(echoPortStr)
+
+	rules, err := NewRuleSet([]Rule{{Action: RuleDeny, Ports: []string{"2"}}}, RuleAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	server.Config.Socks4 = true
+	server.Config.Rules = rules
+	addr, _ := runTestServer(t, server)
+	t.Cleanup(func() { server.Close() })
+
+	request := func(t *testing.T, addr string, message *Socks4RequestMessage) (net.Conn, Socks4ReplyType) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		if err := WriteSocks4RequestMessage(conn, message); err != nil {
+			t.Fatal(err)
+		}
+		reply, _, _, err := NewSocks4ReplyMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply
+	}
+
+	t.Run("should connect by socks4", func(t *testing.T) {
+		conn, reply := request(t, addr, &Socks4RequestMessage{Cmd: CmdConnect, Port: uint16(echoPort), Address: echoHost, UserId: "user"})
+		if reply != Socks4ReplyGranted {
+			t.Fatalf("want reply 0x%02x but got 0x%02x", Socks4ReplyGranted, reply)
+		}
+		testEcho(t, conn)
+	})
+
+	t.Run("should connect to a domain by socks4a", func(t *testing.T) {
+		conn, reply := request(t, addr, &Socks4RequestMessage{Cmd: CmdConnect, Port: uint16(echoPort), Address: "localhost"})
+		if reply != Socks4ReplyGranted {
+			t.Fatalf("want reply 0x%02x but got 0x%02x", Socks4ReplyGranted, reply)
+		}
+		testEcho(t, conn)
+	})
+
+	t.Run("should reject denied destinations", func(t *testing.T) {
+		_, reply := request(t, addr, &Socks4RequestMessage{Cmd: CmdConnect, Port: 2, Address: "127.0.0.1"})
+		if reply != Socks4ReplyRejected {
+			t.Fatalf("want reply 0x%02x but got 0x%02x", Socks4ReplyRejected, reply)
+		}
+	})
+
+	t.Run("should still serve socks5", func(t *testing.T) {
+		conn, err := NewClient(addr, "", "").Dial("tcp", echoAddr)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		defer conn.Close()
+		testEcho(t, conn)
+	})
+
+	t.Run("should reject socks4 when a password is required", func(t *testing.T) {
+		passwordServer := NewSocks5PasswordAuthServer("127.0.0.1", 0, "123", "456", false)
+		passwordServer.Config.Socks4 = true
+		passwordAddr, _ := runTestServer(t, passwordServer)
+		t.Cleanup(func() { passwordServer.Close() })
+		_, reply := request(t, passwordAddr, &Socks4RequestMessage{Cmd: CmdConnect, Port: uint16(echoPort), Address: echoHost, UserId: "123"})
+		if reply != Socks4ReplyRejected {
+			t.Fatalf("want reply 0x%02x but got 0x%02x", Socks4ReplyRejected, reply)
+		}
+	})
+}
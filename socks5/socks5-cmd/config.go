@@ -2,34 +2,49 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/NingYuanLin/go-proxy/socks5"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var configCmd = &cobra.Command{
 	Use:   "config",
 	Short: "The operations about config file",
-	Run: func(cmd *cobra.Command, args []string) {
+	// the errors of creating are not about the usage
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		if create, _ := cmd.Flags().GetBool("create"); create == true {
 			// create config file
-			err := createConfigFile()
-			if err != nil {
-				log.Println(err)
-			}
-			return
+			return createConfigFile(cmd)
 		}
+		return nil
 	},
 }
 
 func init() {
 	configCmd.Flags().Bool("create", false, "create config file")
 	configCmd.MarkFlagRequired("create")
+	// the fields of the config file, which are not prompted when they are set
+	configCmd.Flags().String("ip", "", "listen ip (default: 0.0.0.0)")
+	configCmd.Flags().Int("port", 0, "listen port (default: 1080)")
+	configCmd.Flags().String("username", "", "username of password auth")
+	configCmd.Flags().String("password", "", "password of password auth")
+	configCmd.Flags().String("udp-relay-server-ip", "", "udp relay server ip (default: auto)")
+	configCmd.Flags().Int("udp-port", 0, "udp listen port. -1: close udp relay. 0: random port. 1~65535: fixed port (default: same as port)")
+	configCmd.Flags().Int64("timeout", 0, "timeout of tcp dial in seconds (default: 3)")
+	configCmd.Flags().Int64("udp-conn-lifetime", 0, "lifetime of udp exchange socket in seconds (default: 60)")
+	configCmd.Flags().Bool("non-interactive", false, "do not prompt, use the defaults for the fields without flags")
+
+	configCmd.AddCommand(configValidateCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -50,8 +65,10 @@ func initConfig() {
 		viper.SetConfigName("go-proxy")
 	}
 
-	//viper.AutomaticEnv() // read in environment variables that match
-
+	// GO_PROXY_PORT overrides port, GO_PROXY_UDP_PORT overrides udp_port, GO_PROXY_TLS_LISTEN overrides tls.listen and so on
+	viper.SetEnvPrefix("GO_PROXY")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
 }
 
 func readConfigToViper() (configFileUsed string, err error) {
@@ -64,7 +81,7 @@ func readConfigToViper() (configFileUsed string, err error) {
 	return
 }
 
-func createConfigFile() error {
+func createConfigFile(cmd *cobra.Command) error {
 	// check if the config file exist and read to viper
 	configFile, err := readConfigToViper()
 	exist := false
@@ -77,177 +94,146 @@ func createConfigFile() error {
 		log.Printf("Warning: Config file is existed in %s, and the following operation will rewrite the config file.\n", configFile)
 	}
 
-	fmt.Print("Please input listen ip(default: 0.0.0.0): ")
-	reader := bufio.NewReader(os.Stdin)
-	ip, err := reader.ReadString('\n')
+	nonInteractive, _ := cmd.Flags().GetBool("non-interactive")
+	prompter := &configPrompter{
+		flags:          cmd.Flags(),
+		reader:         bufio.NewReader(os.Stdin),
+		nonInteractive: nonInteractive,
+	}
+
+	ip, err := prompter.value("ip", "Please input listen ip(default: 0.0.0.0): ", "0.0.0.0")
 	if err != nil {
 		return err
 	}
-	ip = strings.TrimSpace(ip)
-	if ip == "" {
-		ip = "0.0.0.0"
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid listen ip %q", ip)
 	}
 
-	fmt.Print("Please input listen port(default: 1080): ")
-	port, err := reader.ReadString('\n')
+	port, err := prompter.value("port", "Please input listen port(default: 1080): ", "1080")
 	if err != nil {
 		return err
 	}
-	port = strings.TrimSpace(port)
-	portInt := 1080
-	if port != "" {
-		portInt64, err := strconv.ParseInt(port, 10, 16)
-		if err != nil {
-			return err
-		}
-		portInt = int(portInt64)
+	portInt, err := parsePort(port)
+	if err != nil {
+		return err
 	}
 
-	usePasswordAuth := false
-	for {
-		fmt.Print("Do you want to set username and password? (Y/n) (default: n): ")
-		state, err := reader.ReadString('\n')
+	// a username or a password from the flags means password auth
+	usePasswordAuth := prompter.flags.Changed("username") || prompter.flags.Changed("password")
+	if !usePasswordAuth {
+		usePasswordAuth, err = prompter.confirm("Do you want to set username and password? (Y/n) (default: n): ")
 		if err != nil {
 			return err
 		}
-		state = strings.TrimSpace(state)
-		state = strings.ToLower(state)
-		if state == "" || state == "n" {
-			break
-		}
-		if state == "y" {
-			usePasswordAuth = true
-			break
-		}
 	}
 
 	var username string
 	var password string
 	if usePasswordAuth == true {
 		for username == "" {
-			fmt.Print("Please input username: ")
-			username, err = reader.ReadString('\n')
+			username, err = prompter.value("username", "Please input username: ", "")
 			if err != nil {
 				return err
 			}
-			username = strings.TrimSpace(username)
+			if username == "" && (prompter.nonInteractive || prompter.flags.Changed("username")) {
+				return errors.New("username and password must be set together")
+			}
 		}
 
 		for password == "" {
-			fmt.Print("Please input password: ")
-			password, err = reader.ReadString('\n')
+			password, err = prompter.value("password", "Please input password: ", "")
 			if err != nil {
 				return err
 			}
-			password = strings.TrimSpace(password)
+			if password == "" && (prompter.nonInteractive || prompter.flags.Changed("password")) {
+				return errors.New("username and password must be set together")
+			}
 		}
 	}
 
-	openUdpRelay := false
-	for {
-		fmt.Print("Do you want to open udp relay? (Y/n) (default:n): ")
-		state, err := reader.ReadString('\n')
+	// udp flags mean the udp relay, unless --udp-port closes it
+	openUdpRelay := prompter.flags.Changed("udp-port") || prompter.flags.Changed("udp-relay-server-ip")
+	if udpPortFlag, _ := prompter.flags.GetInt("udp-port"); prompter.flags.Changed("udp-port") && udpPortFlag == socks5.UdpRelayClose {
+		if prompter.flags.Changed("udp-relay-server-ip") {
+			return errors.New("--udp-relay-server-ip needs the udp relay, but --udp-port is -1")
+		}
+		openUdpRelay = false
+	} else if !openUdpRelay {
+		openUdpRelay, err = prompter.confirm("Do you want to open udp relay? (Y/n) (default:n): ")
 		if err != nil {
 			return err
 		}
-		state = strings.TrimSpace(state)
-		state = strings.ToLower(state)
-		if state == "" || state == "n" {
-			break
-		}
-		if state == "y" {
-			openUdpRelay = true
-			break
-		}
 	}
 
 	var udpRelayServerIp string
 	var udpPort socks5.UdpRelayPort = socks5.UdpRelayClose
 	if openUdpRelay == true {
-		fmt.Println("By default, the udp relay server ip will be detected automatically.")
-		fmt.Println("If your relay server is under NAT, you may need to set udp relay server ip as your server's public ip manually.")
-		fmt.Print("Please input your server ip (default: auto): ")
-		udpIp, err := reader.ReadString('\n')
+		udpRelayServerIp, err = prompter.value("udp-relay-server-ip",
+			"By default, the udp relay server ip will be detected automatically.\n"+
+				"If your relay server is under NAT, you may need to set udp relay server ip as your server's public ip manually.\n"+
+				"Please input your server ip (default: auto): ", "")
 		if err != nil {
 			return err
 		}
-		udpRelayServerIp = strings.TrimSpace(udpIp)
+		if udpRelayServerIp != "" && net.ParseIP(udpRelayServerIp) == nil {
+			return fmt.Errorf("invalid udp relay server ip %q", udpRelayServerIp)
+		}
 
 		for {
-			fmt.Println("You can set a fixed port as udp listen port, such as same as tcp port you set before. However, it is not safe. The attacker can jump username-password auth process and access it directly.")
-			fmt.Println("We strongly suggest you to use random udp port. Don't forget to open your firewall to allow all udp access from any ports.")
-			fmt.Printf("Please input your udp listen port (default: same as tcp port(%d). 0: random port. 1~65535: fixed port.)", portInt)
-			udpPortStr, err := reader.ReadString('\n')
+			udpPortStr, err := prompter.value("udp-port",
+				"You can set a fixed port as udp listen port, such as same as tcp port you set before. It is shared by all clients, and only accepts datagrams from the address of an authenticated udp associate.\n"+
+					"We still suggest you to use random udp port, which is not shared. Don't forget to open your firewall to allow all udp access from any ports.\n"+
+					fmt.Sprintf("Please input your udp listen port (default: same as tcp port(%d). 0: random port. 1~65535: fixed port.)", portInt),
+				strconv.Itoa(portInt))
 			if err != nil {
 				return err
 			}
-			udpPortStr = strings.TrimSpace(udpPortStr)
-			if udpPortStr == "" {
-				udpPort = portInt
-			} else if udpPortStr == "0" {
+			if udpPortStr == "0" {
 				udpPort = socks5.UdpRelayRandomPort
 			} else {
-				parseInt, err := strconv.ParseInt(udpPortStr, 10, 16)
+				udpPort, err = parsePort(udpPortStr)
 				if err != nil {
+					if prompter.nonInteractive || prompter.flags.Changed("udp-port") {
+						return err
+					}
 					log.Println(err)
 					continue
 				}
-				udpPort = int(parseInt)
 			}
 			break
 		}
 
 	}
 
-	advancedSetting := false
-	for {
-		fmt.Print("Do you want to perform advanced setting? (Y/n) (default:n): ")
-		state, err := reader.ReadString('\n')
+	advancedSetting := prompter.flags.Changed("timeout") || prompter.flags.Changed("udp-conn-lifetime")
+	if !advancedSetting {
+		advancedSetting, err = prompter.confirm("Do you want to perform advanced setting? (Y/n) (default:n): ")
 		if err != nil {
 			return err
 		}
-		state = strings.TrimSpace(state)
-		state = strings.ToLower(state)
-		if state == "" || state == "n" {
-			break
-		}
-		if state == "y" {
-			advancedSetting = true
-			break
-		}
 	}
 
 	// unit: seconds
 	var timeout int64 = 3
 	var udpConnLifetime int64 = 60
 	if advancedSetting == true {
-		fmt.Print("Please input the timeout of tcp dial (unit: seconds) (default: 3): ")
-		timeoutStr, err := reader.ReadString('\n')
+		timeoutStr, err := prompter.value("timeout", "Please input the timeout of tcp dial (unit: seconds) (default: 3): ", "3")
 		if err != nil {
 			return err
 		}
-		timeoutStr = strings.TrimSpace(timeoutStr)
-		if timeoutStr != "" {
-			parseInt, err := strconv.ParseInt(timeoutStr, 10, 64)
-			if err != nil {
-				return err
-			}
-			timeout = parseInt
+		timeout, err = parseSeconds(timeoutStr)
+		if err != nil {
+			return err
 		}
 
 		if openUdpRelay == true {
-			fmt.Print("please input the lifetime of udp exchange socket (unit: seconds) (default: 60): ")
-			udpLifeTimeStr, err := reader.ReadString('\n')
+			udpLifeTimeStr, err := prompter.value("udp-conn-lifetime", "please input the lifetime of udp exchange socket (unit: seconds) (default: 60): ", "60")
 			if err != nil {
 				return err
 			}
-			udpLifeTimeStr = strings.TrimSpace(udpLifeTimeStr)
-			if udpLifeTimeStr != "" {
-				parseInt, err := strconv.ParseInt(udpLifeTimeStr, 10, 64)
-				if err != nil {
-					return err
-				}
-				udpConnLifetime = parseInt
+			udpConnLifetime, err = parseSeconds(udpLifeTimeStr)
+			if err != nil {
+				return err
 			}
 		}
 	}
@@ -263,6 +249,9 @@ func createConfigFile() error {
 
 	if exist == true {
 		err = viper.WriteConfig()
+	} else if cfgFile != "" {
+		// SafeWriteConfig only works with the config paths of the search
+		err = viper.SafeWriteConfigAs(cfgFile)
 	} else {
 		err = viper.SafeWriteConfig()
 	}
@@ -273,6 +262,74 @@ func createConfigFile() error {
 	return nil
 }
 
+// configPrompter reads the answers of createConfigFile.
+// A field given by its flag is not prompted, and with --non-interactive the default is used.
+type configPrompter struct {
+	flags          *pflag.FlagSet
+	reader         *bufio.Reader
+	nonInteractive bool
+}
+
+// value returns the value of flag, or prompts for it. An empty answer means def.
+func (p *configPrompter) value(flag, prompt, def string) (string, error) {
+	if p.flags.Changed(flag) {
+		return strings.TrimSpace(p.flags.Lookup(flag).Value.String()), nil
+	}
+	if p.nonInteractive {
+		return def, nil
+	}
+	fmt.Print(prompt)
+	answer, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// confirm asks a (Y/n) question, whose default is n.
+func (p *configPrompter) confirm(prompt string) (bool, error) {
+	if p.nonInteractive {
+		return false, nil
+	}
+	for {
+		fmt.Print(prompt)
+		state, err := p.reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		state = strings.TrimSpace(state)
+		state = strings.ToLower(state)
+		if state == "" || state == "n" {
+			return false, nil
+		}
+		if state == "y" {
+			return true, nil
+		}
+	}
+}
+
+// parsePort parses a port between 1 and 65535.
+func parsePort(port string) (int, error) {
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || portInt == 0 {
+		return 0, fmt.Errorf("invalid port %q: want 1~65535", port)
+	}
+	return int(portInt), nil
+}
+
+// parseSeconds parses a non-negative number of seconds.
+func parseSeconds(seconds string) (int64, error) {
+	secondsInt, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil || secondsInt < 0 {
+		return 0, fmt.Errorf("invalid seconds %q", seconds)
+	}
+	return secondsInt, nil
+}
+
 type ConfigFileStruct struct {
 	Ip                  string
 	port                int
@@ -282,14 +339,76 @@ type ConfigFileStruct struct {
 	udp_port            int
 	timeout             int64
 	udp_conn_lifetime   int64
+	handshake_timeout   int64
+	idle_timeout        int64
+	loopback_no_auth    bool
+	upstreams           []socks5.Upstream
+	rules               []socks5.Rule
+	rules_default       string
+	metrics_listen      string
+	users               []userConfig
+	user_file           string
+	http_listen         string
+	mixed_listen        string
+	socks4              bool
+	tls                 tlsFileConfig
+	dns                 dnsFileConfig
+	outbound            outboundFileConfig
+	rate_limit          socks5.RateLimits
+	usage               usageFileConfig
+}
+
+// outboundFileConfig is the outbound section of the config file.
+type outboundFileConfig struct {
+	family        string
+	fallbackDelay int64
+	socks5.Outbound
+}
+
+// rateLimitUserConfig is an item of users in the rate_limit section.
+type rateLimitUserConfig struct {
+	Username string
+	Upload   int64
+	Download int64
+}
+
+// usageFileConfig is the usage section of the config file.
+type usageFileConfig struct {
+	file         string
+	saveInterval int64
+	quotas       socks5.Quotas
+}
+
+// quotaUserConfig is an item of users in the usage section.
+type quotaUserConfig struct {
+	Username string
+	Daily    int64
+	Monthly  int64
+}
+
+// userConfig is a user in the users section of the config file.
+type userConfig struct {
+	Username     string
+	PasswordHash string `mapstructure:"password_hash"`
+	Disabled     bool
+	// such as "2006-01-02" or a RFC 3339 time. YAML decodes unquoted ones to time.Time.
+	Expires interface{}
 }
 
+// parseConfigFromFile reads the config from the config file, the environment variables and the flags of start.
+// Without a config file in the home directory, the port must be given by a flag or an environment variable.
 func parseConfigFromFile() (*ConfigFileStruct, error) {
 	configFile, err := readConfigToViper()
-	if err != nil {
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) && viper.IsSet("port") {
+		log.Println("No config file, using flags and environment variables")
+	} else if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("%w, and the port is not set by --port or GO_PROXY_PORT", err)
+	} else if err != nil {
 		return nil, err
+	} else {
+		log.Println("Using config file:", configFile)
 	}
-	log.Println("Using config file:", configFile)
 
 	configFileStruct := &ConfigFileStruct{}
 	configFileStruct.Ip = viper.GetString("ip")
@@ -300,6 +419,163 @@ func parseConfigFromFile() (*ConfigFileStruct, error) {
 	configFileStruct.udp_port = viper.GetInt("udp_port")
 	configFileStruct.timeout = viper.GetInt64("timeout")
 	configFileStruct.udp_conn_lifetime = viper.GetInt64("udp_conn_lifetime")
+	// handshake_timeout: 13 # seconds from the connection to the reply, including the dial. 0: timeout + 10, -1: none
+	configFileStruct.handshake_timeout = viper.GetInt64("handshake_timeout")
+	// idle_timeout: 300 # seconds without data in either direction before a relay is closed. 0: never
+	configFileStruct.idle_timeout = viper.GetInt64("idle_timeout")
+	configFileStruct.loopback_no_auth = viper.GetBool("loopback_no_auth")
+	// upstreams:
+	//   - type: socks5 # or http
+	//     address: 1.2.3.4:1080
+	//     username: ""
+	//     password: ""
+	err = viper.UnmarshalKey("upstreams", &configFileStruct.upstreams)
+	if err != nil {
+		return nil, err
+	}
+	// rules:
+	//   - action: deny # or allow
+	//     sources: ["192.168.1.0/24"]
+	//     users: ["alice"]
+	//     destinations: ["10.0.0.0/8"]
+	//     domains: ["example.com", "*.example.org", "regexp:^api[0-9]+\\.example\\.net$"]
+	//     ports: ["25", "8000-9000"]
+	//     commands: ["connect", "bind", "udp"]
+	//     source_address: 192.0.2.10 # or interface: eth1, the source of the connections which an allow rule decides
+	// rules_default: allow # or deny
+	err = viper.UnmarshalKey("rules", &configFileStruct.rules)
+	if err != nil {
+		return nil, err
+	}
+	configFileStruct.rules_default = viper.GetString("rules_default")
+	// metrics_listen: 127.0.0.1:9100 # serves /metrics, empty means disabled
+	configFileStruct.metrics_listen = viper.GetString("metrics_listen")
+	// users:
+	//   - username: alice
+	//     password_hash: $2y$10$... # bcrypt, argon2id or SHA-crypt
+	//     disabled: false
+	//     expires: "2030-01-01"
+	// user_file: /etc/go-proxy/users # htpasswd style, username:hash[:disabled[:expires]]
+	err = viper.UnmarshalKey("users", &configFileStruct.users)
+	if err != nil {
+		return nil, err
+	}
+	configFileStruct.user_file = viper.GetString("user_file")
+	// http_listen: 0.0.0.0:8080 # http proxy with the same users and rules, empty means disabled
+	configFileStruct.http_listen = viper.GetString("http_listen")
+	// mixed_listen: 0.0.0.0:1081 # socks5, socks4 and http on the same port, chosen by the first byte of the client
+	configFileStruct.mixed_listen = viper.GetString("mixed_listen")
+	// socks4: true # also serve socks4 and socks4a clients on port, only without password
+	configFileStruct.socks4 = viper.GetBool("socks4")
+	// tls:
+	//   listen: 0.0.0.0:1443 # socks5 over tls, empty means disabled
+	//   cert_file: /etc/go-proxy/server.crt
+	//   key_file: /etc/go-proxy/server.key
+	//   min_version: "1.2" # 1.0, 1.1, 1.2 or 1.3
+	//   cipher_suites: ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"] # tls 1.2 and lower, empty means the defaults of go
+	//   client_ca_file: /etc/go-proxy/ca.crt # verifies client certificates, which skip the password
+	//   client_cert_required: false
+	//   client_cert_user: common_name # or dns_san, email_san, uri_san
+	configFileStruct.tls = tlsFileConfig{
+		listen:             viper.GetString("tls.listen"),
+		certFile:           viper.GetString("tls.cert_file"),
+		keyFile:            viper.GetString("tls.key_file"),
+		minVersion:         viper.GetString("tls.min_version"),
+		cipherSuites:       viper.GetStringSlice("tls.cipher_suites"),
+		clientCaFile:       viper.GetString("tls.client_ca_file"),
+		clientCertRequired: viper.GetBool("tls.client_cert_required"),
+		clientCertUser:     viper.GetString("tls.client_cert_user"),
+	}
+	// dns: # empty means the resolver of the operating system
+	//   upstreams: # asked in order
+	//     - type: udp # or tcp, tls (DNS over TLS), https (DNS over HTTPS)
+	//       address: 1.1.1.1:53 # https: https://cloudflare-dns.com/dns-query
+	//       server_name: "" # verifies the certificate of tls and https
+	//   hosts:
+	//     - domain: example.internal
+	//       ips: ["10.0.0.5"]
+	//   prefer_family: ipv4 # or ipv6
+	//   timeout: 5 # seconds of a query
+	//   negative_ttl: 30 # seconds to cache "no such host" without a SOA record
+	//   cache_size: 4096 # -1 disables the cache
+	err = viper.UnmarshalKey("dns.upstreams", &configFileStruct.dns.upstreams)
+	if err != nil {
+		return nil, err
+	}
+	err = viper.UnmarshalKey("dns.hosts", &configFileStruct.dns.hosts)
+	if err != nil {
+		return nil, err
+	}
+	configFileStruct.dns.preferFamily = viper.GetString("dns.prefer_family")
+	configFileStruct.dns.timeout = viper.GetInt64("dns.timeout")
+	configFileStruct.dns.negativeTtl = viper.GetInt64("dns.negative_ttl")
+	configFileStruct.dns.cacheSize = viper.GetInt("dns.cache_size")
+	// outbound:
+	//   family: happy_eyeballs # prefer_ipv4, prefer_ipv6, ipv4_only, ipv6_only or happy_eyeballs. empty: the order of dns
+	//   fallback_delay: 250 # milliseconds of happy_eyeballs before the next address is dialed
+	//   source_address: 192.0.2.10 # local ip of outbound connections
+	//   interface: eth1 # or the address of this interface
+	configFileStruct.outbound = outboundFileConfig{
+		family:        viper.GetString("outbound.family"),
+		fallbackDelay: viper.GetInt64("outbound.fallback_delay"),
+		Outbound: socks5.Outbound{
+			SourceAddress: viper.GetString("outbound.source_address"),
+			Interface:     viper.GetString("outbound.interface"),
+		},
+	}
+	// rate_limit: # bytes per second, 0 means unlimited
+	//   global: {upload: 0, download: 10485760} # all clients together
+	//   user: {upload: 0, download: 1048576} # each user
+	//   source: {upload: 0, download: 0} # each client ip
+	//   users: # instead of user for some users
+	//     - username: alice
+	//       upload: 0
+	//       download: 5242880
+	configFileStruct.rate_limit = socks5.RateLimits{
+		Global: rateLimitFromViper("rate_limit.global"),
+		User:   rateLimitFromViper("rate_limit.user"),
+		Source: rateLimitFromViper("rate_limit.source"),
+	}
+	var rateLimitUsers []rateLimitUserConfig
+	err = viper.UnmarshalKey("rate_limit.users", &rateLimitUsers)
+	if err != nil {
+		return nil, err
+	}
+	if len(rateLimitUsers) > 0 {
+		configFileStruct.rate_limit.Users = make(map[string]socks5.RateLimit)
+		for _, user := range rateLimitUsers {
+			configFileStruct.rate_limit.Users[user.Username] = socks5.RateLimit{Upload: user.Upload, Download: user.Download}
+		}
+	}
+	// usage: # traffic of the authenticated users
+	//   file: /var/lib/go-proxy/usage.json # empty keeps the usage in memory
+	//   save_interval: 60 # seconds between the saves of the file
+	//   quota: {daily: 0, monthly: 107374182400} # bytes up and down of each user, 0 means unlimited
+	//   users: # instead of quota for some users
+	//     - username: alice
+	//       daily: 1073741824
+	//       monthly: 0
+	configFileStruct.usage = usageFileConfig{
+		file:         viper.GetString("usage.file"),
+		saveInterval: viper.GetInt64("usage.save_interval"),
+		quotas: socks5.Quotas{
+			User: socks5.Quota{
+				Daily:   viper.GetInt64("usage.quota.daily"),
+				Monthly: viper.GetInt64("usage.quota.monthly"),
+			},
+		},
+	}
+	var quotaUsers []quotaUserConfig
+	err = viper.UnmarshalKey("usage.users", &quotaUsers)
+	if err != nil {
+		return nil, err
+	}
+	if len(quotaUsers) > 0 {
+		configFileStruct.usage.quotas.Users = make(map[string]socks5.Quota)
+		for _, user := range quotaUsers {
+			configFileStruct.usage.quotas.Users[user.Username] = socks5.Quota{Daily: user.Daily, Monthly: user.Monthly}
+		}
+	}
 
 	//err = viper.Unmarshal(configFileStruct)
 	//if err != nil {
@@ -308,3 +584,53 @@ func parseConfigFromFile() (*ConfigFileStruct, error) {
 
 	return configFileStruct, nil
 }
+
+func rateLimitFromViper(key string) socks5.RateLimit {
+	return socks5.RateLimit{
+		Upload:   viper.GetInt64(key + ".upload"),
+		Download: viper.GetInt64(key + ".download"),
+	}
+}
+
+// loadUsers returns the users of the config file and the user file.
+func loadUsers(configFileStruct *ConfigFileStruct) ([]socks5.User, error) {
+	var users []socks5.User
+	for _, userConfig := range configFileStruct.users {
+		user := socks5.User{
+			Username:     userConfig.Username,
+			PasswordHash: userConfig.PasswordHash,
+			Disabled:     userConfig.Disabled,
+		}
+		switch expires := userConfig.Expires.(type) {
+		case nil:
+		case time.Time:
+			// a date expires at the end of the day, the same as ParseUserExpires
+			if expires.Equal(expires.Truncate(time.Hour * 24)) {
+				expires = expires.AddDate(0, 0, 1)
+			}
+			user.Expires = expires
+		case string:
+			if expires != "" {
+				parsed, err := socks5.ParseUserExpires(expires)
+				if err != nil {
+					return nil, err
+				}
+				user.Expires = parsed
+			}
+		default:
+			return nil, fmt.Errorf("user %q: invalid expires %v", userConfig.Username, expires)
+		}
+		users = append(users, user)
+	}
+	if configFileStruct.user_file != "" {
+		fileUsers, err := socks5.ReadUserFile(configFileStruct.user_file)
+		if errors.Is(err, os.ErrNotExist) {
+			// the file is created by the first "user add"
+			log.Println("user file not found:", configFileStruct.user_file)
+		} else if err != nil {
+			return nil, err
+		}
+		users = append(users, fileUsers...)
+	}
+	return users, nil
+}
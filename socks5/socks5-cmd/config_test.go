@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestConfigEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "go-proxy.yaml")
+	content := "port: 1080\ntls:\n  listen: 127.0.0.1:1443\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	cfgFile = path
+	t.Cleanup(func() { cfgFile = "" })
+
+	t.Setenv("GO_PROXY_PORT", "1081")
+	t.Setenv("GO_PROXY_TLS_LISTEN", "127.0.0.1:2443")
+	initConfig()
+	configFromFile, err := parseConfigFromFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configFromFile.port != 1081 {
+		t.Fatalf("want port 1081 but got %d", configFromFile.port)
+	}
+	if configFromFile.tls.listen != "127.0.0.1:2443" {
+		t.Fatalf("want tls.listen 127.0.0.1:2443 but got %s", configFromFile.tls.listen)
+	}
+}
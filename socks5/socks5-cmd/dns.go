@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+)
+
+// dnsFileConfig is the dns section of the config file.
+type dnsFileConfig struct {
+	upstreams    []socks5.DnsUpstream
+	hosts        []dnsHostConfig
+	preferFamily string
+	timeout      int64
+	negativeTtl  int64
+	cacheSize    int
+}
+
+// dnsHostConfig is an item of hosts. Viper splits the keys on dots, so the domains are values instead of keys.
+type dnsHostConfig struct {
+	Domain string
+	Ips    []string
+}
+
+// newResolver builds the resolver of the dns section. It returns nil when the section is empty,
+// so the resolver of the operating system is used.
+func newResolver(config dnsFileConfig) (socks5.Resolver, error) {
+	if len(config.upstreams) == 0 && len(config.hosts) == 0 && config.preferFamily == "" {
+		return nil, nil
+	}
+	hosts := make(map[string][]string)
+	for _, host := range config.hosts {
+		hosts[host.Domain] = append(hosts[host.Domain], host.Ips...)
+	}
+	return socks5.NewDnsResolver(socks5.DnsResolverConfig{
+		Upstreams:    config.upstreams,
+		Hosts:        hosts,
+		PreferFamily: config.preferFamily,
+		Timeout:      time.Second * time.Duration(config.timeout),
+		NegativeTtl:  time.Second * time.Duration(config.negativeTtl),
+		CacheSize:    config.cacheSize,
+	})
+}
+
+// resolverCache keeps the resolver across reloads, so its cache and its connections survive them.
+// The resolver is rebuilt only when the dns section changes. It is used by a single goroutine.
+type resolverCache struct {
+	config   dnsFileConfig
+	resolver socks5.Resolver
+	built    bool
+}
+
+// get returns the resolver of config. A nil cache builds a new one every time.
+func (c *resolverCache) get(config dnsFileConfig) (socks5.Resolver, error) {
+	if c == nil {
+		return newResolver(config)
+	}
+	if c.built && reflect.DeepEqual(c.config, config) {
+		return c.resolver, nil
+	}
+	resolver, err := newResolver(config)
+	if err != nil {
+		return nil, err
+	}
+	// the new connections use the new resolver, so the kept-alive connections of the old one are not needed
+	if old, ok := c.resolver.(*socks5.DnsResolver); ok {
+		old.CloseIdleConnections()
+	}
+	c.config, c.resolver, c.built = config, resolver, true
+	return resolver, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolverCache(t *testing.T) {
+	resolvers := &resolverCache{}
+	config := dnsFileConfig{hosts: []dnsHostConfig{{Domain: "example.internal", Ips: []string{"10.0.0.5"}}}}
+	first, err := resolvers.get(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a reload with the same section, such as after "user add", keeps the resolver and its cache
+	same := dnsFileConfig{hosts: []dnsHostConfig{{Domain: "example.internal", Ips: []string{"10.0.0.5"}}}}
+	if resolver, _ := resolvers.get(same); resolver != first {
+		t.Fatal("want the same resolver for the same dns section")
+	}
+	changed := dnsFileConfig{hosts: []dnsHostConfig{{Domain: "example.internal", Ips: []string{"10.0.0.6"}}}}
+	if resolver, _ := resolvers.get(changed); resolver == first {
+		t.Fatal("want a new resolver after the dns section changes")
+	}
+}
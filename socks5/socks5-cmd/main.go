@@ -1,5 +1,10 @@
 package main
 
+import (
+	"errors"
+	"os"
+)
+
 func main() {
 	//server := socks5.NewSocks5PasswordAuthServer("0.0.0.0", 1080, "123", "456", true)
 	//server.SetTimeout(time.Second * 10)
@@ -8,5 +13,11 @@ func main() {
 	//if err != nil {
 	//	log.Fatal(err)
 	//}
-	Execute()
+	if err := Execute(); err != nil {
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+	"github.com/spf13/viper"
+)
+
+// reloader applies the changes of the config file to a running server.
+// New connections use the new config, and the active relays keep the old one.
+// A listener is replaced only when its address has changed.
+// It is used by a single goroutine.
+type reloader struct {
+	server    *socks5.Socks5Server
+	metrics   *socks5.Metrics
+	usage     *socks5.UsageStore
+	resolvers *resolverCache
+	listeners []*serverListener
+	// serveErr receives the errors which stop the server, such as a failure of the udp relay
+	serveErr chan error
+	// the tls config of new tls connections
+	tlsConfig atomic.Pointer[tls.Config]
+	// the user file and the certificates
+	files []string
+	// the config file and the files, with their modification time
+	modTimes map[string]time.Time
+}
+
+// serverListener is a listener of the server, such as the socks5 one, the http one and the mixed one.
+type serverListener struct {
+	name string
+	// address returns the listen address in the config, and empty means disabled
+	address  func(configFromFile *ConfigFileStruct) string
+	serve    func(server *socks5.Socks5Server, l net.Listener) error
+	addr     string
+	listener net.Listener
+}
+
+func newReloader(server *socks5.Socks5Server, metrics *socks5.Metrics, usage *socks5.UsageStore, resolvers *resolverCache, configFromFile *ConfigFileStruct) *reloader {
+	r := &reloader{
+		server:    server,
+		metrics:   metrics,
+		usage:     usage,
+		resolvers: resolvers,
+		listeners: []*serverListener{
+			{name: "socks5", address: listenAddress, serve: (*socks5.Socks5Server).Serve},
+			{name: "http", address: httpListenAddress, serve: (*socks5.Socks5Server).ServeHttp},
+			{name: "mixed", address: mixedListenAddress, serve: (*socks5.Socks5Server).ServeMixed},
+		},
+		serveErr: make(chan error, 1),
+	}
+	r.listeners = append(r.listeners, &serverListener{name: "tls", address: tlsListenAddress, serve: r.serveTLS})
+	r.watch(watchedFiles(configFromFile))
+	return r
+}
+
+// listen opens the listeners of the config, and serves them in the background.
+func (r *reloader) listen(configFromFile *ConfigFileStruct) error {
+	tlsConfig, err := newTLSConfig(configFromFile.tls)
+	if err != nil {
+		return err
+	}
+	r.tlsConfig.Store(tlsConfig)
+	addrs, listeners, err := r.openListeners(configFromFile)
+	if err != nil {
+		return err
+	}
+	r.swapListeners(addrs, listeners)
+	return nil
+}
+
+// openListeners opens the listeners whose address has changed, and returns the new addresses.
+// A nil listener means unchanged or disabled. All are closed when any fails.
+func (r *reloader) openListeners(configFromFile *ConfigFileStruct) ([]string, []net.Listener, error) {
+	addrs := make([]string, len(r.listeners))
+	listeners := make([]net.Listener, len(r.listeners))
+	for i, serverListener := range r.listeners {
+		addrs[i] = serverListener.address(configFromFile)
+		if addrs[i] == serverListener.addr || addrs[i] == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", addrs[i])
+		if err != nil {
+			closeListeners(listeners)
+			return nil, nil, err
+		}
+		listeners[i] = listener
+	}
+	return addrs, listeners, nil
+}
+
+// swapListeners serves the new listeners, and closes the old ones which are changed or disabled.
+func (r *reloader) swapListeners(addrs []string, listeners []net.Listener) {
+	for i, serverListener := range r.listeners {
+		if addrs[i] == serverListener.addr {
+			continue
+		}
+		if serverListener.listener != nil {
+			serverListener.listener.Close()
+		}
+		serverListener.addr = addrs[i]
+		serverListener.listener = listeners[i]
+		if listeners[i] != nil {
+			r.serve(serverListener.serve, listeners[i])
+			log.Printf("%s listen on %s", serverListener.name, addrs[i])
+		}
+	}
+}
+
+// serve serves listener in the background.
+func (r *reloader) serve(serve func(server *socks5.Socks5Server, l net.Listener) error, listener net.Listener) {
+	go func() {
+		err := serve(r.server, listener)
+		// a replaced listener is closed, and the server keeps running
+		if err == socks5.ErrServerClosed || errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case r.serveErr <- err:
+		default:
+		}
+	}()
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+// watchedFiles are the files of the config which are reloaded when they change.
+func watchedFiles(configFromFile *ConfigFileStruct) []string {
+	return []string{
+		configFromFile.user_file,
+		configFromFile.tls.certFile,
+		configFromFile.tls.keyFile,
+		configFromFile.tls.clientCaFile,
+	}
+}
+
+// watch records the modification time of the config file and files.
+func (r *reloader) watch(files []string) {
+	r.files = files
+	r.modTimes = make(map[string]time.Time)
+	for _, path := range append([]string{viper.ConfigFileUsed()}, files...) {
+		if path == "" {
+			continue
+		}
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+		r.modTimes[path] = modTime
+	}
+}
+
+// filesChanged reports whether the config file, the user file or a certificate has changed since the last reload.
+func (r *reloader) filesChanged() bool {
+	for path, modTime := range r.modTimes {
+		var newModTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			newModTime = info.ModTime()
+		}
+		if !newModTime.Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload reads the config file again and applies it.
+// An invalid config is logged, and the old config keeps working.
+func (r *reloader) reload() {
+	err := r.apply()
+	if err != nil {
+		log.Println("reload config failure, keep the old config:", err)
+		return
+	}
+	log.Println("reloaded config")
+}
+
+func (r *reloader) apply() error {
+	configFromFile, err := parseConfigFromFile()
+	if err != nil {
+		// do not retry a broken file until it changes again
+		r.watch(r.files)
+		return err
+	}
+	r.watch(watchedFiles(configFromFile))
+	// the metrics endpoint can not be moved, so the metrics are kept, and so are the usage and the resolver
+	config, err := newSocks5Config(configFromFile, r.metrics, r.usage, r.resolvers)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := newTLSConfig(configFromFile.tls)
+	if err != nil {
+		return err
+	}
+
+	addrs, listeners, err := r.openListeners(configFromFile)
+	if err != nil {
+		return err
+	}
+	err = r.server.Reload(config)
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+	r.tlsConfig.Store(tlsConfig)
+	r.swapListeners(addrs, listeners)
+	return nil
+}
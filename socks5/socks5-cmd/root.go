@@ -22,4 +22,6 @@ func init() {
 
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(usageCmd)
 }
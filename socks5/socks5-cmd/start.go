@@ -1,63 +1,284 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/NingYuanLin/go-proxy/socks5"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var startCmd = &cobra.Command{
-	Use: "start",
+	Use:   "start",
 	Short: "To start socks5 server",
 	Run: func(cmd *cobra.Command, args []string) {
+		err := bindStartFlags(cmd)
+		if err != nil {
+			log.Panicln(err)
+		}
 		configFromFile, err := parseConfigFromFile()
 
 		if err != nil {
 			log.Panicln(err)
 		}
-		ip := configFromFile.Ip
-		port := configFromFile.port
-		username := configFromFile.username
-		password := configFromFile.password
-		udpRelayServerIp := configFromFile.udp_relay_server_ip
-		udpPort := configFromFile.udp_port
-		timeout := configFromFile.timeout
-		udpConnLifetime := configFromFile.udp_conn_lifetime
-
-		var passwordChecker socks5.PasswordCheckerFunc
-		if username != "" && password != "" {
-			passwordChecker = func(uname, pwd string) bool {
-				if username == uname && password == pwd {
-					return true
+
+		var metrics *socks5.Metrics
+		var metricsServer *http.Server
+		if configFromFile.metrics_listen != "" {
+			metrics = socks5.NewMetrics()
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			metricsServer = &http.Server{Addr: configFromFile.metrics_listen, Handler: mux}
+			go func() {
+				log.Println("serve metrics on", configFromFile.metrics_listen)
+				err := metricsServer.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
+					log.Println("metrics server failure:", err)
 				}
-				return false
-			}
+			}()
 		}
 
-		var authMethod socks5.AuthMethod = socks5.MethodNoAuth
-		if passwordChecker != nil {
-			authMethod = socks5.MethodPassword
+		// the usage file is loaded once, and the counters go on across reloads
+		usage, err := socks5.NewUsageStore(configFromFile.usage.file)
+		if err != nil {
+			log.Panicln(err)
+		}
+		saveInterval := time.Second * time.Duration(configFromFile.usage.saveInterval)
+		if saveInterval <= 0 {
+			saveInterval = time.Minute
 		}
+		usageCtx, stopUsage := context.WithCancel(context.Background())
+		usageDone := make(chan struct{})
+		go func() {
+			defer close(usageDone)
+			usage.Run(usageCtx, saveInterval, func(err error) {
+				log.Println("save usage failure:", err)
+			})
+		}()
+		// save the usage for the last time on exit
+		defer func() {
+			stopUsage()
+			<-usageDone
+		}()
 
-		socks5Server := socks5.Socks5Server{
-			Ip:   ip,
-			Port: port,
-			Config: socks5.Config{
-				AuthMethod:       authMethod,
-				Timeout:          time.Second * time.Duration(timeout),
-				PasswordChecker:  passwordChecker,
-				UdpRelayServerIp: net.ParseIP(udpRelayServerIp),
-				UdpPort:          udpPort,
-				UdpConnLifetime:  time.Second * time.Duration(udpConnLifetime),
-			},
+		resolvers := &resolverCache{}
+		config, err := newSocks5Config(configFromFile, metrics, usage, resolvers)
+		if err != nil {
+			log.Panicln(err)
+		}
+		socks5Server := &socks5.Socks5Server{
+			Ip:     configFromFile.Ip,
+			Port:   configFromFile.port,
+			Config: config,
 		}
 
+		reloader := newReloader(socks5Server, metrics, usage, resolvers, configFromFile)
 		log.Println("start server")
-		err = socks5Server.Run()
+		err = reloader.listen(configFromFile)
 		if err != nil {
 			log.Println(err)
+			return
+		}
+
+		// stop gracefully on ctrl-c or kill, and reload the config on SIGHUP
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		ticker := time.NewTicker(time.Second * 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case err := <-reloader.serveErr:
+				log.Println(err)
+				socks5Server.Close()
+				return
+			case <-ticker.C:
+				// pick up the changes of the config file and user commands without a restart
+				if reloader.filesChanged() {
+					reloader.reload()
+				}
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					reloader.reload()
+					continue
+				}
+				log.Println("shutting down server")
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+				err := socks5Server.Shutdown(ctx)
+				cancel()
+				if err != nil {
+					log.Println(err)
+				}
+				if metricsServer != nil {
+					metricsServer.Close()
+				}
+				return
+			}
 		}
 	},
 }
+
+func init() {
+	// the zero defaults keep the values of the config file
+	startCmd.Flags().String("listen", "", "listen ip, overrides ip")
+	startCmd.Flags().Int("port", 0, "listen port, overrides port")
+	startCmd.Flags().Int("udp-port", 0, "udp listen port, overrides udp_port. -1: close udp relay. 0: random port")
+	startCmd.Flags().String("udp-relay-server-ip", "", "overrides udp_relay_server_ip")
+	startCmd.Flags().String("user", "", `"username:password" of password auth, overrides username and password`)
+	startCmd.Flags().String("user-file", "", "overrides user_file")
+	startCmd.Flags().Int64("timeout", 0, "timeout of tcp dial in seconds, overrides timeout")
+	startCmd.Flags().Int64("udp-conn-lifetime", 0, "lifetime of udp exchange socket in seconds, overrides udp_conn_lifetime")
+	startCmd.Flags().Int64("handshake-timeout", 0, "seconds from the connection to the reply, overrides handshake_timeout")
+	startCmd.Flags().Int64("idle-timeout", 0, "seconds without data before a relay is closed, overrides idle_timeout")
+	startCmd.Flags().String("metrics-listen", "", "overrides metrics_listen")
+	startCmd.Flags().String("http-listen", "", "address of the http proxy, overrides http_listen")
+	startCmd.Flags().String("mixed-listen", "", "address serving socks5, socks4 and http on the same port, overrides mixed_listen")
+	startCmd.Flags().String("tls-listen", "", "address of socks5 over tls, overrides tls.listen")
+}
+
+// bindStartFlags makes the flags of start override the environment variables and the config file.
+// It is not done in init, so other commands never write the flags into the config file.
+func bindStartFlags(cmd *cobra.Command) error {
+	for key, flag := range map[string]string{
+		"ip":                  "listen",
+		"port":                "port",
+		"udp_port":            "udp-port",
+		"udp_relay_server_ip": "udp-relay-server-ip",
+		"user_file":           "user-file",
+		"timeout":             "timeout",
+		"udp_conn_lifetime":   "udp-conn-lifetime",
+		"handshake_timeout":   "handshake-timeout",
+		"idle_timeout":        "idle-timeout",
+		"metrics_listen":      "metrics-listen",
+		"http_listen":         "http-listen",
+		"mixed_listen":        "mixed-listen",
+		"tls.listen":          "tls-listen",
+	} {
+		if err := viper.BindPFlag(key, cmd.Flags().Lookup(flag)); err != nil {
+			return err
+		}
+	}
+	if user, _ := cmd.Flags().GetString("user"); user != "" {
+		username, password, ok := strings.Cut(user, ":")
+		if !ok || username == "" || password == "" {
+			return fmt.Errorf("invalid --user %q: want username:password", user)
+		}
+		viper.Set("username", username)
+		viper.Set("password", password)
+	}
+	return nil
+}
+
+// newSocks5Config builds the config of the server from the config file.
+// The users are loaded into a new store, so a failed reload never changes the users in use.
+// The usage is counted into usage, which may be nil. The resolver is taken from resolvers, which may be nil.
+func newSocks5Config(configFromFile *ConfigFileStruct, metrics *socks5.Metrics, usage *socks5.UsageStore, resolvers *resolverCache) (socks5.Config, error) {
+	username := configFromFile.username
+	password := configFromFile.password
+
+	var passwordChecker socks5.PasswordCheckerFunc
+	if username != "" && password != "" {
+		passwordChecker = func(uname, pwd string) bool {
+			if username == uname && password == pwd {
+				return true
+			}
+			return false
+		}
+	}
+
+	// hashed users of the users section and the user file
+	users, err := loadUsers(configFromFile)
+	if err != nil {
+		return socks5.Config{}, err
+	}
+	var userStore *socks5.UserStore
+	if len(users) > 0 || configFromFile.user_file != "" {
+		userStore, err = socks5.NewUserStore(users)
+		if err != nil {
+			return socks5.Config{}, err
+		}
+		plainChecker := passwordChecker
+		passwordChecker = func(uname, pwd string) bool {
+			if plainChecker != nil && plainChecker(uname, pwd) {
+				return true
+			}
+			return userStore.CheckPassword(uname, pwd)
+		}
+	}
+
+	var authenticators []socks5.Authenticator
+	// clients with a verified certificate skip the password, unless their user is disabled or expired
+	certAuthenticator, err := certificateAuthenticator(configFromFile.tls, userStore)
+	if err != nil {
+		return socks5.Config{}, err
+	}
+	if certAuthenticator != nil {
+		authenticators = append(authenticators, certAuthenticator)
+	}
+	if passwordChecker != nil {
+		// local clients may skip username/password authentication
+		if configFromFile.loopback_no_auth {
+			authenticators = append(authenticators, socks5.NoAuthAuthenticator{AllowClient: socks5.IsLoopbackClient})
+		}
+		authenticators = append(authenticators, socks5.PasswordAuthenticator{PasswordChecker: passwordChecker})
+	} else {
+		authenticators = append(authenticators, socks5.NoAuthAuthenticator{})
+	}
+
+	var rules *socks5.RuleSet
+	if len(configFromFile.rules) > 0 || configFromFile.rules_default != "" {
+		rules, err = socks5.NewRuleSet(configFromFile.rules, configFromFile.rules_default)
+		if err != nil {
+			return socks5.Config{}, err
+		}
+	}
+
+	resolver, err := resolvers.get(configFromFile.dns)
+	if err != nil {
+		return socks5.Config{}, err
+	}
+
+	return socks5.Config{
+		Authenticators:   authenticators,
+		Timeout:          time.Second * time.Duration(configFromFile.timeout),
+		PasswordChecker:  passwordChecker,
+		UdpRelayServerIp: net.ParseIP(configFromFile.udp_relay_server_ip),
+		UdpPort:          configFromFile.udp_port,
+		UdpConnLifetime:  time.Second * time.Duration(configFromFile.udp_conn_lifetime),
+		HandshakeTimeout: time.Second * time.Duration(configFromFile.handshake_timeout),
+		IdleTimeout:      time.Second * time.Duration(configFromFile.idle_timeout),
+		Upstreams:        configFromFile.upstreams,
+		Resolver:         resolver,
+		DialFamily:       configFromFile.outbound.family,
+		FallbackDelay:    time.Millisecond * time.Duration(configFromFile.outbound.fallbackDelay),
+		Outbound:         configFromFile.outbound.Outbound,
+		RateLimits:       configFromFile.rate_limit,
+		Rules:            rules,
+		Metrics:          metrics,
+		Usage:            usage,
+		Quotas:           configFromFile.usage.quotas,
+		Socks4:           configFromFile.socks4,
+	}, nil
+}
+
+func listenAddress(configFromFile *ConfigFileStruct) string {
+	return net.JoinHostPort(configFromFile.Ip, strconv.Itoa(configFromFile.port))
+}
+
+// httpListenAddress is the address of the http proxy, and empty means disabled.
+func httpListenAddress(configFromFile *ConfigFileStruct) string {
+	return configFromFile.http_listen
+}
+
+// mixedListenAddress is the address serving every protocol on the same port, and empty means disabled.
+func mixedListenAddress(configFromFile *ConfigFileStruct) string {
+	return configFromFile.mixed_listen
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+)
+
+// tlsFileConfig is the tls section of the config file.
+type tlsFileConfig struct {
+	listen             string
+	certFile           string
+	keyFile            string
+	minVersion         string
+	cipherSuites       []string
+	clientCaFile       string
+	clientCertRequired bool
+	clientCertUser     string
+}
+
+// tlsVersions are the values of min_version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1":   tls.VersionTLS10, // YAML decodes an unquoted 1.0 to 1
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsListenAddress is the address of the socks5 over tls listener, and empty means disabled.
+func tlsListenAddress(configFromFile *ConfigFileStruct) string {
+	return configFromFile.tls.listen
+}
+
+// newTLSConfig loads the certificates of the tls section. It returns nil when the tls listener is disabled.
+func newTLSConfig(config tlsFileConfig) (*tls.Config, error) {
+	if config.listen == "" {
+		return nil, nil
+	}
+	if config.certFile == "" || config.keyFile == "" {
+		return nil, fmt.Errorf("tls: cert_file and key_file are required by listen")
+	}
+	certificate, err := tls.LoadX509KeyPair(config.certFile, config.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.minVersion != "" {
+		version, ok := tlsVersions[config.minVersion]
+		if !ok {
+			return nil, fmt.Errorf("tls: min_version: want 1.0, 1.1, 1.2 or 1.3 but got %q", config.minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(config.cipherSuites) > 0 {
+		// only the secure suites of tls 1.2 and lower can be chosen. The suites of tls 1.3 are fixed.
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range config.cipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("tls: cipher_suites: unknown or insecure cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	if config.clientCaFile != "" {
+		pem, err := os.ReadFile(config.clientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		clientCas := x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: client_ca_file: no certificate in %s", config.clientCaFile)
+		}
+		tlsConfig.ClientCAs = clientCas
+		// clients without a certificate use the password
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.clientCertRequired {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.clientCertRequired {
+		return nil, fmt.Errorf("tls: client_cert_required needs client_ca_file")
+	}
+	return tlsConfig, nil
+}
+
+// certificateAuthenticator maps the client certificates to users when mTLS is enabled.
+// The disabled and expired users of userStore, which may be nil, are rejected.
+func certificateAuthenticator(config tlsFileConfig, userStore *socks5.UserStore) (socks5.Authenticator, error) {
+	if config.clientCaFile == "" {
+		return nil, nil
+	}
+	field := socks5.CertificateUserField(config.clientCertUser)
+	switch field {
+	case "", socks5.CertificateUserCommonName, socks5.CertificateUserDnsSan,
+		socks5.CertificateUserEmailSan, socks5.CertificateUserUriSan:
+	default:
+		return nil, fmt.Errorf("tls: client_cert_user: want common_name, dns_san, email_san or uri_san but got %q", field)
+	}
+	return socks5.CertificateAuthenticator{UserField: field, Users: userStore}, nil
+}
+
+// serveTLS serves socks5 over tls. The tls config of every handshake is the latest one, so reloaded certificates apply to new connections.
+func (r *reloader) serveTLS(server *socks5.Socks5Server, l net.Listener) error {
+	return server.Serve(tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.tlsConfig.Load(), nil
+		},
+	}))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var errUsageFileNotSet = errors.New("usage file not set: set usage.file in the config file or use --file")
+
+// usageCmd prints the usage file. A running server saves it every usage.save_interval, so the latest traffic may be missing.
+var usageCmd = &cobra.Command{
+	Use:          "usage",
+	Short:        "Print the traffic of the users in the usage file",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, _ := cmd.Flags().GetString("file")
+		if path == "" {
+			if _, err := readConfigToViper(); err != nil {
+				return errUsageFileNotSet
+			}
+			path = viper.GetString("usage.file")
+		}
+		if path == "" {
+			return errUsageFileNotSet
+		}
+		users, err := socks5.LoadUsage(path)
+		if err != nil {
+			return err
+		}
+
+		period, _ := cmd.Flags().GetString("period")
+		now := time.Now()
+		usages := make(map[string]socks5.Usage, len(users))
+		for username, user := range users {
+			// the daily and monthly usage of another day or month is zero
+			user = user.At(now)
+			switch period {
+			case "total":
+				usages[username] = user.Total
+			case "month":
+				usages[username] = user.Monthly
+			case "day":
+				usages[username] = user.Daily
+			default:
+				return fmt.Errorf("unknown period %q: want total, month or day", period)
+			}
+		}
+		usernames := make([]string, 0, len(usages))
+		for username := range usages {
+			usernames = append(usernames, username)
+		}
+		sort.Strings(usernames)
+
+		writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "USERNAME\tUPLOAD\tDOWNLOAD\tCONNECTIONS")
+		for _, username := range usernames {
+			usage := usages[username]
+			fmt.Fprintf(writer, "%s\t%d\t%d\t%d\n", username, usage.Upload, usage.Download, usage.Connections)
+		}
+		return writer.Flush()
+	},
+}
+
+func init() {
+	usageCmd.Flags().String("file", "", "usage file (default: usage.file of the config file)")
+	usageCmd.Flags().String("period", "total", "total, month or day")
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+var (
+	errUserFileNotSet = errors.New("user file not set: set user_file in the config file or use --file")
+	errUserExists     = errors.New("user already exists")
+	errUserNotFound   = errors.New("user not found")
+	errUserFileLocked = errors.New("user file is locked by another command")
+)
+
+// userFileLockTimeout is how long a command waits for the lock of another one.
+var userFileLockTimeout = time.Second * 10
+
+// userCmd edits the user file. A running server reloads the file when it changes.
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of the user file",
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <username>",
+	Short: "Add a user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return editUsers(cmd, func(users []socks5.User) ([]socks5.User, error) {
+			if findUser(users, args[0]) >= 0 {
+				return nil, fmt.Errorf("%w: %s", errUserExists, args[0])
+			}
+			passwordHash, err := readPasswordHash(cmd)
+			if err != nil {
+				return nil, err
+			}
+			user := socks5.User{Username: args[0], PasswordHash: passwordHash}
+			user.Disabled, _ = cmd.Flags().GetBool("disabled")
+			if expires, _ := cmd.Flags().GetString("expires"); expires != "" {
+				user.Expires, err = socks5.ParseUserExpires(expires)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return append(users, user), nil
+		})
+	},
+}
+
+var userDelCmd = &cobra.Command{
+	Use:   "del <username>",
+	Short: "Delete a user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return editUsers(cmd, func(users []socks5.User) ([]socks5.User, error) {
+			i := findUser(users, args[0])
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", errUserNotFound, args[0])
+			}
+			return append(users[:i], users[i+1:]...), nil
+		})
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd <username>",
+	Short: "Change the password of a user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return editUsers(cmd, func(users []socks5.User) ([]socks5.User, error) {
+			i := findUser(users, args[0])
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", errUserNotFound, args[0])
+			}
+			passwordHash, err := readPasswordHash(cmd)
+			if err != nil {
+				return nil, err
+			}
+			users[i].PasswordHash = passwordHash
+			return users, nil
+		})
+	},
+}
+
+var userDisableCmd = &cobra.Command{
+	Use:   "disable <username>",
+	Short: "Disable a user, or enable it again with --enable",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return editUsers(cmd, func(users []socks5.User) ([]socks5.User, error) {
+			i := findUser(users, args[0])
+			if i < 0 {
+				return nil, fmt.Errorf("%w: %s", errUserNotFound, args[0])
+			}
+			enable, _ := cmd.Flags().GetBool("enable")
+			users[i].Disabled = !enable
+			return users, nil
+		})
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the users without their passwords",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := userFilePath(cmd)
+		if err != nil {
+			return err
+		}
+		users, err := socks5.ReadUserFile(path)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		writer := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "USERNAME\tSTATE\tEXPIRES\tHASH")
+		for _, user := range users {
+			state := "enabled"
+			if user.Disabled {
+				state = "disabled"
+			} else if !user.Active(now) {
+				state = "expired"
+			}
+			expires := "never"
+			if !user.Expires.IsZero() {
+				expires = user.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", user.Username, state, expires, hashAlgorithm(user.PasswordHash))
+		}
+		return writer.Flush()
+	},
+}
+
+func init() {
+	userCmd.PersistentFlags().String("file", "", "user file (default: user_file of the config file)")
+
+	for _, cmd := range []*cobra.Command{userAddCmd, userPasswdCmd} {
+		cmd.Flags().Bool("password-stdin", false, "read the password from stdin instead of prompting")
+		cmd.Flags().String("hash", "bcrypt", "password hash: bcrypt or argon2id")
+	}
+	userAddCmd.Flags().Bool("disabled", false, "add the user disabled")
+	userAddCmd.Flags().String("expires", "", `expiry, such as "2030-01-01" or a RFC 3339 time`)
+	userDisableCmd.Flags().Bool("enable", false, "enable the user again")
+
+	userCmd.AddCommand(userAddCmd, userDelCmd, userPasswdCmd, userListCmd, userDisableCmd)
+	for _, cmd := range userCmd.Commands() {
+		// the errors are not about the usage
+		cmd.SilenceUsage = true
+	}
+}
+
+// userFilePath returns --file, or user_file of the config file.
+func userFilePath(cmd *cobra.Command) (string, error) {
+	if path, _ := cmd.Flags().GetString("file"); path != "" {
+		return path, nil
+	}
+	if _, err := readConfigToViper(); err != nil {
+		return "", errUserFileNotSet
+	}
+	path := viper.GetString("user_file")
+	if path == "" {
+		return "", errUserFileNotSet
+	}
+	return path, nil
+}
+
+// editUsers reads the user file, edits the users and replaces the file atomically.
+// A missing file is treated as empty, so the first user can be added.
+// The file is locked from the read to the write, so concurrent edits never lose an update.
+func editUsers(cmd *cobra.Command, edit func(users []socks5.User) ([]socks5.User, error)) error {
+	path, err := userFilePath(cmd)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockUserFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	users, err := socks5.ReadUserFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	users, err = edit(users)
+	if err != nil {
+		return err
+	}
+	return socks5.WriteUserFile(path, users)
+}
+
+// lockUserFile creates the lock file next to the user file, waiting for another command to remove it.
+// A lock file left by a crashed command must be removed by hand.
+func lockUserFile(path string) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(userFileLockTimeout)
+	for {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lockFile.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: remove %s if no other command is running", errUserFileLocked, lockPath)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func findUser(users []socks5.User, username string) int {
+	for i, user := range users {
+		if user.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
+// readPasswordHash reads the new password, without echo on a terminal, and hashes it.
+func readPasswordHash(cmd *cobra.Command) (string, error) {
+	var password string
+	if passwordStdin, _ := cmd.Flags().GetBool("password-stdin"); passwordStdin || !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	} else {
+		fmt.Fprint(os.Stderr, "Password: ")
+		first, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Retype password: ")
+		second, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(first) != string(second) {
+			return "", errors.New("passwords do not match")
+		}
+		password = string(first)
+	}
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+
+	switch hash, _ := cmd.Flags().GetString("hash"); hash {
+	case "bcrypt":
+		return socks5.HashPassword(password)
+	case "argon2id":
+		return socks5.HashPasswordArgon2id(password)
+	default:
+		return "", fmt.Errorf("unknown hash %q", hash)
+	}
+}
+
+// hashAlgorithm names the algorithm of a password hash, so the hash itself is never printed.
+func hashAlgorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return "bcrypt"
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return "argon2id"
+	case strings.HasPrefix(hash, "$5$"):
+		return "sha256-crypt"
+	case strings.HasPrefix(hash, "$6$"):
+		return "sha512-crypt"
+	}
+	return "unknown"
+}
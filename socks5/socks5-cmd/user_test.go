@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// runUserCmd runs "user args..." with stdin, and returns the output.
+// The flags of the earlier runs are reset, since the commands are shared.
+func runUserCmd(stdin string, args ...string) (string, error) {
+	for _, cmd := range append([]*cobra.Command{userCmd}, userCmd.Commands()...) {
+		for _, flags := range []*pflag.FlagSet{cmd.Flags(), cmd.PersistentFlags()} {
+			flags.VisitAll(func(flag *pflag.Flag) {
+				flag.Value.Set(flag.DefValue)
+				flag.Changed = false
+			})
+		}
+	}
+	var out bytes.Buffer
+	rootCmd.SetArgs(append([]string{"user"}, args...))
+	rootCmd.SetIn(strings.NewReader(stdin))
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(io.Discard)
+	defer rootCmd.SetIn(nil)
+	defer rootCmd.SetOut(nil)
+	defer rootCmd.SetErr(nil)
+	err := rootCmd.Execute()
+	return out.String(), err
+}
+
+func TestUserCmd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("# go-proxy users\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// the steps edit the same file in order
+	tests := []struct {
+		name  string
+		stdin string
+		args  []string
+		err   error // nil means any error when fails is set
+		fails bool
+		check func(t *testing.T, users []socks5.User)
+	}{
+		{"add with the password from stdin", "secret\n", []string{"add", "alice", "--password-stdin"}, nil, false, func(t *testing.T, users []socks5.User) {
+			if len(users) != 1 || users[0].Username != "alice" || !socks5.VerifyPassword(users[0].PasswordHash, "secret") {
+				t.Fatalf("want alice with password secret but got %+v", users)
+			}
+		}},
+		{"reject a duplicate user", "other\n", []string{"add", "alice", "--password-stdin"}, errUserExists, true, func(t *testing.T, users []socks5.User) {
+			if len(users) != 1 || !socks5.VerifyPassword(users[0].PasswordHash, "secret") {
+				t.Fatalf("want alice unchanged but got %+v", users)
+			}
+		}},
+		{"add disabled with expiry and argon2id", "pass\n", []string{"add", "bob", "--password-stdin", "--disabled", "--expires", "2030-01-01", "--hash", "argon2id"}, nil, false, func(t *testing.T, users []socks5.User) {
+			want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)
+			if len(users) != 2 || !users[1].Disabled || !users[1].Expires.Equal(want) || hashAlgorithm(users[1].PasswordHash) != "argon2id" {
+				t.Fatalf("want bob disabled until %s with argon2id but got %+v", want, users)
+			}
+		}},
+		{"reject an empty password", "\n", []string{"add", "carol", "--password-stdin"}, nil, true, func(t *testing.T, users []socks5.User) {
+			if len(users) != 2 {
+				t.Fatalf("want carol not added but got %+v", users)
+			}
+		}},
+		{"change the password", "new\n", []string{"passwd", "alice", "--password-stdin"}, nil, false, func(t *testing.T, users []socks5.User) {
+			if !socks5.VerifyPassword(users[0].PasswordHash, "new") {
+				t.Fatalf("want the new password of alice but got %+v", users[0])
+			}
+		}},
+		{"disable", "", []string{"disable", "alice"}, nil, false, func(t *testing.T, users []socks5.User) {
+			if !users[0].Disabled {
+				t.Fatalf("want alice disabled but got %+v", users[0])
+			}
+		}},
+		{"enable", "", []string{"disable", "alice", "--enable"}, nil, false, func(t *testing.T, users []socks5.User) {
+			if users[0].Disabled {
+				t.Fatalf("want alice enabled but got %+v", users[0])
+			}
+		}},
+		{"delete", "", []string{"del", "bob"}, nil, false, func(t *testing.T, users []socks5.User) {
+			if len(users) != 1 || users[0].Username != "alice" {
+				t.Fatalf("want only alice but got %+v", users)
+			}
+		}},
+		{"reject an unknown user", "", []string{"del", "bob"}, errUserNotFound, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := runUserCmd(test.stdin, append(test.args, "--file", path)...)
+			switch {
+			case test.err != nil && !errors.Is(err, test.err):
+				t.Fatalf("want err = %s but got %v", test.err, err)
+			case test.fails && err == nil:
+				t.Fatalf("want an error but got nil")
+			case !test.fails && err != nil:
+				t.Fatalf("want err = nil but got %s", err)
+			}
+			users, err := socks5.ReadUserFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.check != nil {
+				test.check(t, users)
+			}
+		})
+	}
+
+	t.Run("should keep the comments, the mode and no lock file", func(t *testing.T) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(content), "# go-proxy users\n") {
+			t.Fatalf("want the comment kept but got %q", content)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatalf("want mode 0640 but got %o", info.Mode().Perm())
+		}
+		if _, err := os.Stat(path + ".lock"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("want the lock file removed but got %v", err)
+		}
+	})
+
+	t.Run("should list the users without their hashes", func(t *testing.T) {
+		out, err := runUserCmd("", "list", "--file", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, _ := socks5.ReadUserFile(path)
+		if !strings.Contains(out, "alice") || !strings.Contains(out, "enabled") || strings.Contains(out, users[0].PasswordHash) {
+			t.Fatalf("want alice enabled without the hash but got %q", out)
+		}
+	})
+
+	t.Run("should fail when the file stays locked", func(t *testing.T) {
+		if err := os.WriteFile(path+".lock", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(path + ".lock")
+		lockTimeout := userFileLockTimeout
+		userFileLockTimeout = time.Millisecond * 100
+		defer func() { userFileLockTimeout = lockTimeout }()
+
+		if _, err := runUserCmd("", "disable", "alice", "--file", path); !errors.Is(err, errUserFileLocked) {
+			t.Fatalf("want err = %s but got %v", errUserFileLocked, err)
+		}
+		users, _ := socks5.ReadUserFile(path)
+		if users[0].Disabled {
+			t.Fatalf("want alice unchanged but got %+v", users[0])
+		}
+	})
+}
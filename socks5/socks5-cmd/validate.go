@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/NingYuanLin/go-proxy/socks5"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The exit codes of "config validate".
+const (
+	exitConfigInvalid    = 1
+	exitConfigUnreadable = 2
+)
+
+// exitError makes the process exit with code instead of 1.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// knownConfigKeys are the top level keys of the config file.
+var knownConfigKeys = map[string]bool{
+	"ip": true, "port": true, "username": true, "password": true,
+	"udp_relay_server_ip": true, "udp_port": true, "timeout": true, "udp_conn_lifetime": true,
+	"loopback_no_auth": true, "upstreams": true, "rules": true, "rules_default": true,
+	"metrics_listen": true, "users": true, "user_file": true, "http_listen": true,
+	"mixed_listen": true, "socks4": true, "tls": true, "handshake_timeout": true, "idle_timeout": true,
+	"dns": true, "outbound": true, "rate_limit": true, "usage": true,
+}
+
+// knownConfigSubKeys are the keys of the sections of the config file.
+var knownConfigSubKeys = map[string]map[string]bool{
+	"usage": {
+		"file": true, "save_interval": true, "quota.daily": true, "quota.monthly": true, "users": true,
+	},
+	"rate_limit": {
+		"global.upload": true, "global.download": true, "user.upload": true, "user.download": true,
+		"source.upload": true, "source.download": true, "users": true,
+	},
+	"outbound": {
+		"family": true, "fallback_delay": true, "source_address": true, "interface": true,
+	},
+	"dns": {
+		"upstreams": true, "hosts": true, "prefer_family": true, "timeout": true, "negative_ttl": true, "cache_size": true,
+	},
+	"tls": {
+		"listen": true, "cert_file": true, "key_file": true, "min_version": true, "cipher_suites": true,
+		"client_ca_file": true, "client_cert_required": true, "client_cert_user": true,
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config file",
+	Long: `Check the config file, and print every problem.
+Exit codes: 0 means valid, 1 means invalid, and 2 means the file can not be read.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		configFile, err := readConfigToViper()
+		if err != nil {
+			return &exitError{code: exitConfigUnreadable, err: err}
+		}
+		problems := validateConfigFile()
+		for _, problem := range problems {
+			fmt.Fprintln(cmd.OutOrStdout(), problem)
+		}
+		if len(problems) > 0 {
+			return &exitError{
+				code: exitConfigInvalid,
+				err:  fmt.Errorf("%s is invalid: %d problem(s)", configFile, len(problems)),
+			}
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s is valid\n", configFile)
+		return nil
+	},
+}
+
+// validateConfigFile checks the config in viper, and returns the problems.
+func validateConfigFile() []string {
+	var problems []string
+	problemf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	for _, key := range viper.AllKeys() {
+		topKey, subKey, _ := strings.Cut(key, ".")
+		if !knownConfigKeys[topKey] {
+			problemf("unknown key %q", key)
+		} else if subKeys, ok := knownConfigSubKeys[topKey]; ok && subKey != "" && !subKeys[subKey] {
+			problemf("unknown key %q", key)
+		}
+	}
+	// unknown keys of the items of lists
+	lists := []struct {
+		key   string
+		value interface{}
+	}{
+		{"upstreams", &[]socks5.Upstream{}},
+		{"rules", &[]socks5.Rule{}},
+		{"users", &[]userConfig{}},
+		{"dns.upstreams", &[]socks5.DnsUpstream{}},
+		{"dns.hosts", &[]dnsHostConfig{}},
+		{"rate_limit.users", &[]rateLimitUserConfig{}},
+		{"usage.users", &[]quotaUserConfig{}},
+	}
+	for _, list := range lists {
+		err := viper.UnmarshalKey(list.key, list.value, func(config *mapstructure.DecoderConfig) {
+			config.ErrorUnused = true
+		})
+		var decodeErr *mapstructure.Error
+		if errors.As(err, &decodeErr) {
+			for _, message := range decodeErr.Errors {
+				problemf("%s: %s", list.key, message)
+			}
+		} else if err != nil {
+			problemf("%s: %s", list.key, err)
+		}
+	}
+
+	// the same path as start
+	configFromFile, err := parseConfigFromFile()
+	if err != nil {
+		problemf("%s", err)
+		return problems
+	}
+
+	if configFromFile.port < 1 || configFromFile.port > 65535 {
+		problemf("port: want 1~65535 but got %d", configFromFile.port)
+	}
+	udpPort := configFromFile.udp_port
+	if udpPort < socks5.UdpRelayClose || udpPort > 65535 {
+		problemf("udp_port: want -1 (closed), 0 (random) or 1~65535 but got %d", udpPort)
+	}
+	if configFromFile.Ip != "" && net.ParseIP(configFromFile.Ip) == nil {
+		problemf("ip: invalid ip %q", configFromFile.Ip)
+	}
+	udpRelayServerIp := configFromFile.udp_relay_server_ip
+	if udpRelayServerIp != "" {
+		if ip := net.ParseIP(udpRelayServerIp); ip == nil {
+			problemf("udp_relay_server_ip: invalid ip %q", udpRelayServerIp)
+		} else if ip.IsUnspecified() {
+			problemf("udp_relay_server_ip: %s can not be reached by clients", udpRelayServerIp)
+		}
+	}
+	if configFromFile.timeout < 0 {
+		problemf("timeout: want seconds >= 0 but got %d", configFromFile.timeout)
+	}
+	if configFromFile.udp_conn_lifetime < 0 {
+		problemf("udp_conn_lifetime: want seconds >= 0 but got %d", configFromFile.udp_conn_lifetime)
+	}
+	dialTimeout := configFromFile.timeout
+	if dialTimeout == 0 {
+		dialTimeout = 3 // the default of socks5.Config
+	}
+	if configFromFile.handshake_timeout < -1 {
+		problemf("handshake_timeout: want -1 (none), 0 (timeout + 10) or seconds but got %d", configFromFile.handshake_timeout)
+	} else if configFromFile.handshake_timeout > 0 && configFromFile.handshake_timeout <= dialTimeout {
+		problemf("handshake_timeout: %d includes the dial, so it must be longer than timeout %d", configFromFile.handshake_timeout, dialTimeout)
+	}
+	if configFromFile.idle_timeout < 0 {
+		problemf("idle_timeout: want seconds >= 0 but got %d", configFromFile.idle_timeout)
+	}
+	if configFromFile.dns.timeout < 0 {
+		problemf("dns.timeout: want seconds >= 0 but got %d", configFromFile.dns.timeout)
+	}
+	if configFromFile.dns.negativeTtl < 0 {
+		problemf("dns.negative_ttl: want seconds >= 0 but got %d", configFromFile.dns.negativeTtl)
+	}
+	rateLimits := []struct {
+		key   string
+		limit socks5.RateLimit
+	}{
+		{"rate_limit.global", configFromFile.rate_limit.Global},
+		{"rate_limit.user", configFromFile.rate_limit.User},
+		{"rate_limit.source", configFromFile.rate_limit.Source},
+	}
+	for _, rateLimit := range rateLimits {
+		if rateLimit.limit.Upload < 0 || rateLimit.limit.Download < 0 {
+			problemf("%s: want bytes per second >= 0 but got upload %d and download %d", rateLimit.key, rateLimit.limit.Upload, rateLimit.limit.Download)
+		}
+	}
+	for username, limit := range configFromFile.rate_limit.Users {
+		if username == "" {
+			problemf("rate_limit.users: username is required")
+		}
+		if limit.Upload < 0 || limit.Download < 0 {
+			problemf("rate_limit.users: %s: want bytes per second >= 0 but got upload %d and download %d", username, limit.Upload, limit.Download)
+		}
+	}
+	if configFromFile.usage.saveInterval < 0 {
+		problemf("usage.save_interval: want seconds >= 0 but got %d", configFromFile.usage.saveInterval)
+	}
+	if quota := configFromFile.usage.quotas.User; quota.Daily < 0 || quota.Monthly < 0 {
+		problemf("usage.quota: want bytes >= 0 but got daily %d and monthly %d", quota.Daily, quota.Monthly)
+	}
+	for username, quota := range configFromFile.usage.quotas.Users {
+		if username == "" {
+			problemf("usage.users: username is required")
+		}
+		if quota.Daily < 0 || quota.Monthly < 0 {
+			problemf("usage.users: %s: want bytes >= 0 but got daily %d and monthly %d", username, quota.Daily, quota.Monthly)
+		}
+	}
+	if file := configFromFile.usage.file; file != "" {
+		if _, err := socks5.LoadUsage(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			problemf("usage.file: %s", err)
+		}
+	}
+	switch configFromFile.outbound.family {
+	case "", socks5.DialPreferIpv4, socks5.DialPreferIpv6, socks5.DialIpv4Only, socks5.DialIpv6Only, socks5.DialHappyEyeballs:
+	default:
+		problemf("outbound.family: want prefer_ipv4, prefer_ipv6, ipv4_only, ipv6_only or happy_eyeballs but got %q", configFromFile.outbound.family)
+	}
+	if configFromFile.outbound.fallbackDelay < 0 {
+		problemf("outbound.fallback_delay: want milliseconds >= 0 but got %d", configFromFile.outbound.fallbackDelay)
+	}
+	if address := configFromFile.outbound.SourceAddress; address != "" && net.ParseIP(address) == nil {
+		problemf("outbound.source_address: invalid ip %q", address)
+	}
+	if configFromFile.outbound.SourceAddress != "" && configFromFile.outbound.Interface != "" {
+		problemf("outbound.source_address and outbound.interface can not be set together")
+	}
+	if iface := configFromFile.outbound.Interface; iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			problemf("outbound.interface: %s", err)
+		}
+	}
+	if len(configFromFile.upstreams) > 0 && len(configFromFile.dns.upstreams) > 0 {
+		problemf("dns.upstreams is set, but the domains are resolved by the last of upstreams")
+	}
+	if (configFromFile.username == "") != (configFromFile.password == "") {
+		problemf("username and password must be set together")
+	}
+	hasPassword := configFromFile.username != "" || len(configFromFile.users) > 0 || configFromFile.user_file != ""
+	if configFromFile.socks4 && hasPassword && !configFromFile.loopback_no_auth {
+		problemf("socks4 is set, but socks4 clients can not send a password; set loopback_no_auth to let local clients in")
+	}
+	for _, listen := range [][2]string{
+		{"metrics_listen", configFromFile.metrics_listen},
+		{"http_listen", configFromFile.http_listen},
+		{"mixed_listen", configFromFile.mixed_listen},
+		{"tls.listen", configFromFile.tls.listen},
+	} {
+		if listen[1] == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(listen[1]); err != nil {
+			problemf("%s: %s", listen[0], err)
+		}
+	}
+
+	// contradictory udp settings
+	if udpPort == socks5.UdpRelayClose {
+		if udpRelayServerIp != "" {
+			problemf("udp_relay_server_ip is set, but the udp relay is closed by udp_port -1")
+		}
+	} else {
+		for _, upstream := range configFromFile.upstreams {
+			if upstream.Type == socks5.UpstreamHttp {
+				problemf("the udp relay is open, but upstream %s is http, which does not support udp; set udp_port to -1", upstream.Address)
+			}
+		}
+	}
+
+	if _, err := socks5.NewProxyChain(nil, configFromFile.upstreams); err != nil {
+		problemf("upstreams: %s", err)
+	}
+	// rules, users, the client certificates and the resolver
+	if _, err := newSocks5Config(configFromFile, nil, nil, nil); err != nil {
+		problemf("%s", err)
+	}
+	if configFromFile.tls.listen == "" && configFromFile.tls.certFile != "" {
+		problemf("tls.cert_file is set, but tls.listen is empty")
+	}
+	if _, err := newTLSConfig(configFromFile.tls); err != nil {
+		problemf("%s", err)
+	}
+	return problems
+}
@@ -1,10 +1,14 @@
 package socks5
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +26,16 @@ var (
 
 	ErrUnknownAddr   = errors.New("address not supported")
 	ErrUdpPortListen = errors.New("udp port open failed")
+
+	ErrServerClosed = errors.New("server closed")
+
+	ErrUdpPortChanged  = errors.New("udp port can not be changed by reload")
+	ErrUnknownProtocol = errors.New("unknown protocol")
+
+	ErrBindTimeout      = errors.New("bind: timed out waiting for incoming connection")
+	ErrBindPeerMismatch = errors.New("bind: incoming connection does not match the requested address")
+
+	ErrRelayIdleTimeout = errors.New("relay: no data in either direction within the idle timeout")
 )
 
 const (
@@ -47,19 +61,78 @@ const (
 type PasswordCheckerFunc func(username, password string) bool
 
 type Config struct {
+	// The authentication methods offered to clients, in order of preference.
+	// The server selects the first one which the client supports.
+	// For example, NoAuthAuthenticator{AllowClient: IsLoopbackClient} followed by PasswordAuthenticator
+	// lets local clients in directly and asks remote clients for username and password.
+	// When it is empty, AuthMethod and PasswordChecker are used.
+	Authenticators []Authenticator
+
 	AuthMethod      AuthMethod
-	Timeout         time.Duration       // The timeout of tcp dial.
+	Timeout         time.Duration       // The timeout of tcp dial, including the handshakes with upstreams.
 	PasswordChecker PasswordCheckerFunc // only for username/password authentication
 
 	// The ip of udp relay server
 	// By default, when UdpRelayServerIp == nil, the system will detect it automatically.
 	// If your relay server is under NAT, you may need to set it manually.
 	UdpRelayServerIp net.IP
-	// -1 means close udp relay. 0 means use random port. Concrete number, such as 1080, means use fixed port(not safe).
+	// -1 means close udp relay. 0 means use random port. Concrete number, such as 1080, means use fixed port, shared by all clients.
+	// Either way, datagrams are only accepted from the client of an UDP ASSOCIATE, while its tcp connection is open.
 	// Note: when use random port, you should open your firewall to allow all udp access from any address.
 	UdpPort UdpRelayPort
 	// The lifetime of udp exchange socket.
 	UdpConnLifetime time.Duration
+	// The reassembly timer of fragmented udp datagrams. RFC 1928 requires at least 5 seconds.
+	UdpReassemblyTimeout time.Duration
+	// How long a BIND request waits for the incoming connection.
+	BindTimeout time.Duration
+	// HandshakeTimeout limits a connection from the negotiation to the reply of the request,
+	// including the dial, so it should be longer than Timeout. 0 means Timeout plus 10 seconds,
+	// and a negative value disables it. For http, it limits every request until the destination is reached.
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes a relay when no data is sent in either direction for the duration.
+	// 0 means never.
+	IdleTimeout time.Duration
+	// Socks4 also serves socks4 and socks4a clients on the socks5 listener.
+	// They have no authentication, so they are only allowed when a NoAuthAuthenticator accepts them.
+	// ServeMixed always serves them.
+	Socks4 bool
+
+	// Dialer is used for outbound tcp connections. nil means net.Dialer.
+	// When Upstreams is set, it is used to reach the first upstream.
+	Dialer ContextDialer
+	// DialFamily chooses the ip family of the destinations which have ipv4 and ipv6 addresses,
+	// such as DialPreferIpv4 or DialHappyEyeballs. Empty keeps the order of the Resolver.
+	// Through upstreams, the domains are sent as is, so it is not used.
+	DialFamily DialFamily
+	// FallbackDelay is the delay of DialHappyEyeballs before the next address is dialed. Default is 250ms.
+	FallbackDelay time.Duration
+	// Outbound pins the source of outbound tcp connections and udp sockets, and the rules can override it for tcp.
+	// It is not used by a custom Dialer.
+	Outbound Outbound
+	// Upstreams are the proxies which outbound connections go through, in order.
+	// Udp goes through them only when all of them are socks5. Otherwise, UDP ASSOCIATE is refused.
+	Upstreams []Upstream
+
+	// Resolver resolves the domain destinations, such as a DnsResolver. nil means the resolver of the operating system.
+	// When Upstreams is set, the domains are resolved by the last upstream instead.
+	Resolver Resolver
+
+	// Rules decide which destinations the clients can reach. They check every request and every udp datagram.
+	// nil allows everything.
+	Rules *RuleSet
+
+	// RateLimits limits the bandwidth globally, per user and per client ip. The zero value is unlimited.
+	RateLimits RateLimits
+
+	// Usage counts the traffic of the authenticated users. nil counts nothing.
+	// Keep the same store across reloads.
+	Usage *UsageStore
+	// Quotas limit the traffic of the users per day and per month. They need Usage.
+	Quotas Quotas
+
+	// Metrics collects the counters and gauges of the server. nil disables them.
+	Metrics *Metrics
 }
 
 type Server interface {
@@ -76,7 +149,78 @@ type Socks5Server struct {
 	// The tcp listen port
 	Port int
 	//UdpRelayInfo *UdpRelayInfo
+	// Config is the initial configuration. Reload replaces the configuration of new connections.
 	Config Config
+
+	initOnce        sync.Once
+	mutex           sync.Mutex
+	closed          bool
+	listeners       map[net.Listener]struct{}
+	udpRelayStarted bool
+	udpRelayServer  *UdpRelayServer // only for the fixed udp port
+	udpAssociations udpAssociations // the clients of the fixed udp port
+	bandwidth       bandwidthLimiter
+	conns           map[net.Conn]struct{}
+	initErr         error
+	current         atomic.Pointer[serverConfig]
+}
+
+// serverConfig is Config with the defaults applied and its proxy chain.
+// A connection keeps the serverConfig it started with, so Reload does not affect active relays.
+type serverConfig struct {
+	Config
+	chain *ProxyChain // outbound tcp and udp go through it
+}
+
+func newServerConfig(config Config) (*serverConfig, error) {
+	if len(config.Authenticators) == 0 {
+		if config.AuthMethod == MethodPassword {
+			config.Authenticators = []Authenticator{PasswordAuthenticator{PasswordChecker: config.PasswordChecker}}
+		} else {
+			config.Authenticators = []Authenticator{NoAuthAuthenticator{}}
+		}
+	}
+	if config.UdpConnLifetime == 0 {
+		config.UdpConnLifetime = time.Second * 60
+	}
+	if config.UdpReassemblyTimeout == 0 {
+		config.UdpReassemblyTimeout = time.Second * 5
+	}
+	if config.Timeout == 0 {
+		config.Timeout = time.Second * 3
+	}
+	if config.BindTimeout == 0 {
+		config.BindTimeout = time.Second * 60
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = config.Timeout + time.Second*10
+	}
+
+	if config.FallbackDelay == 0 {
+		config.FallbackDelay = time.Millisecond * 250
+	}
+	switch config.DialFamily {
+	case "", DialPreferIpv4, DialPreferIpv6, DialIpv4Only, DialIpv6Only, DialHappyEyeballs:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownDialFamily, config.DialFamily)
+	}
+	if err := config.Outbound.check(); err != nil {
+		return nil, fmt.Errorf("outbound: %w", err)
+	}
+
+	chain, err := NewProxyChain(config.Dialer, config.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	return &serverConfig{Config: config, chain: chain}, nil
+}
+
+// handshakeDeadline returns the deadline of a handshake which starts now, or zero when there is none.
+func (c *serverConfig) handshakeDeadline() time.Time {
+	if c.HandshakeTimeout < 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.HandshakeTimeout)
 }
 
 func NewSocks5Server(ip string, port int, config Config) *Socks5Server {
@@ -92,58 +236,380 @@ func (s *Socks5Server) SetTimeout(timeout time.Duration) {
 	s.Config.Timeout = timeout
 }
 
-func (s *Socks5Server) init() {
-	if s.Config.UdpConnLifetime == 0 {
-		s.Config.UdpConnLifetime = time.Second * 60
-	}
-	if s.Config.Timeout == 0 {
-		s.Config.Timeout = 3
+func (s *Socks5Server) init() error {
+	config, err := newServerConfig(s.Config)
+	if err != nil {
+		return err
 	}
+	s.Config = config.Config
+	s.bandwidth.setLimits(config.RateLimits)
+	s.current.Store(config)
+	return nil
 }
 
-func (s *Socks5Server) Run() error {
-	s.init()
+// ensureInit runs init once and returns its error.
+func (s *Socks5Server) ensureInit() error {
+	s.initOnce.Do(func() {
+		s.initErr = s.init()
+	})
+	return s.initErr
+}
 
+// Run listens on Ip:Port and serves until the server is closed.
+// After Shutdown or Close, it returns ErrServerClosed.
+func (s *Socks5Server) Run() error {
 	addr := fmt.Sprintf("%s:%d", s.Ip, s.Port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
 
-	// concrete udp listen port
-	if s.Config.UdpPort != UdpRelayClose && s.Config.UdpPort != UdpRelayRandomPort {
-		udpConn, err := NewUdpConn(fmt.Sprintf(":%d", s.Config.UdpPort))
+// Serve accepts connections on l, such as a unix socket or a tls listener, and serves them.
+// It can be called with several listeners at the same time. l is closed when Serve returns.
+// After Shutdown or Close, it returns ErrServerClosed.
+func (s *Socks5Server) Serve(l net.Listener) error {
+	return s.serve(l, true, s.serveConn)
+}
+
+// ServeHttp accepts connections on l and serves them as a http proxy, with the same config as socks5.
+// It handles CONNECT tunnels and forwards the requests with absolute URIs.
+// After Shutdown or Close, it returns ErrServerClosed.
+func (s *Socks5Server) ServeHttp(l net.Listener) error {
+	return s.serve(l, false, s.serveHttpConn)
+}
+
+// ServeMixed accepts connections on l and serves socks5, socks4 and http proxy clients on the same port.
+// The protocol is chosen by the first byte the client sends.
+// After Shutdown or Close, it returns ErrServerClosed.
+func (s *Socks5Server) ServeMixed(l net.Listener) error {
+	return s.serve(l, true, s.serveMixedConn)
+}
+
+// serve accepts connections on l and handles them by handleConn.
+// udp means the udp relay on the fixed port is needed.
+func (s *Socks5Server) serve(l net.Listener, udp bool, handleConn func(conn net.Conn) error) error {
+	if err := s.ensureInit(); err != nil {
+		l.Close()
+		return err
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, l)
+		s.mutex.Unlock()
+		l.Close()
+	}()
+
+	if udp {
+		err := s.startUdpRelay()
 		if err != nil {
 			return err
 		}
-		udpRelayServer := NewUdpRelayServer(s, udpConn, nil)
-		go func() {
-			// udp connection should work through all lifetime of the program
-			for {
-				err := udpRelayServer.HandleConnection()
-				if err != nil {
-					log.Println(err)
-				}
-			}
-		}()
 	}
 
 	// accept tcp connection
+	var retryDelay time.Duration
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("Connection failure from :%s Err message:%s", conn.RemoteAddr(), err.Error())
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// such as too many open files, wait a moment and try again
+			if retryDelay == 0 {
+				retryDelay = time.Millisecond * 5
+			} else if retryDelay < time.Second {
+				retryDelay *= 2
+			}
+			log.Printf("Accept failure: %s, retrying in %s", err, retryDelay)
+			time.Sleep(retryDelay)
+			continue
+		}
+		retryDelay = 0
+
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
 		}
 		go func() {
-			defer conn.Close()
-			tcpRelayServer := TcpRelayServer{
-				Server: s,
-				Conn:   conn.(*net.TCPConn),
-			}
-			err := tcpRelayServer.HandleConnection()
-			if err != nil {
+			defer s.trackConn(conn, false)
+			err := handleConn(conn)
+			if err != nil && !s.isClosed() {
 				log.Printf("Handle connection failure from :%s Err message:%s", conn.RemoteAddr(), err.Error())
 			}
 		}()
 	}
 }
+
+// ServeConn serves a single client connection, such as one end of net.Pipe.
+// It returns when the client is done and closes conn.
+func (s *Socks5Server) ServeConn(conn net.Conn) error {
+	if err := s.ensureInit(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.trackConn(conn, false)
+
+	err := s.startUdpRelay()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return s.serveConn(conn)
+}
+
+func (s *Socks5Server) serveConn(conn net.Conn) error {
+	if s.currentConfig().Socks4 {
+		return s.serveSniffedConn(conn, false)
+	}
+	return s.serveSocks5Conn(conn)
+}
+
+func (s *Socks5Server) serveSocks5Conn(conn net.Conn) error {
+	defer conn.Close()
+	tcpRelayServer := TcpRelayServer{
+		Server: s,
+		Conn:   conn,
+	}
+	return tcpRelayServer.HandleConnection()
+}
+
+func (s *Socks5Server) serveSocks4Conn(conn net.Conn) error {
+	defer conn.Close()
+	tcpRelayServer := TcpRelayServer{
+		Server: s,
+		Conn:   conn,
+	}
+	return tcpRelayServer.HandleSocks4Connection()
+}
+
+func (s *Socks5Server) serveMixedConn(conn net.Conn) error {
+	return s.serveSniffedConn(conn, true)
+}
+
+// serveSniffedConn peeks at the first byte: 0x05 is socks5, 0x04 is socks4,
+// and an uppercase letter is a http method when http is true.
+func (s *Socks5Server) serveSniffedConn(conn net.Conn, http bool) error {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// the handler reads the peeked byte again
+	conn = &bufferedConn{Conn: conn, reader: reader}
+	switch {
+	case first[0] == Socks5Version:
+		return s.serveSocks5Conn(conn)
+	case first[0] == Socks4Version:
+		return s.serveSocks4Conn(conn)
+	case http && first[0] >= 'A' && first[0] <= 'Z':
+		return s.serveHttpConn(conn)
+	}
+	conn.Close()
+	return fmt.Errorf("%w: first byte 0x%02x", ErrUnknownProtocol, first[0])
+}
+
+func (s *Socks5Server) serveHttpConn(conn net.Conn) error {
+	defer conn.Close()
+	httpRelayServer := HttpRelayServer{
+		Server: s,
+		Conn:   conn,
+	}
+	return httpRelayServer.HandleConnection()
+}
+
+// startUdpRelay opens the udp relay when a fixed udp port is used.
+// It only works at the first call.
+func (s *Socks5Server) startUdpRelay() error {
+	// concrete udp listen port
+	if s.Config.UdpPort == UdpRelayClose || s.Config.UdpPort == UdpRelayRandomPort {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.udpRelayStarted {
+		return nil
+	}
+	udpConn, err := NewUdpConn(fmt.Sprintf(":%d", s.Config.UdpPort))
+	if err != nil {
+		return err
+	}
+	s.udpRelayStarted = true
+	go s.serveUdpRelay(udpConn)
+	return nil
+}
+
+// serveUdpRelay serves the udp relay on the fixed port until the server is closed.
+func (s *Socks5Server) serveUdpRelay(udpConn *net.UDPConn) {
+	for {
+		udpRelayServer := NewUdpRelayServer(s, udpConn, nil)
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			udpRelayServer.Close()
+			return
+		}
+		s.udpRelayServer = udpRelayServer
+		s.mutex.Unlock()
+
+		// udp connection should work through all lifetime of the program
+		err := udpRelayServer.HandleConnection()
+		if s.isClosed() {
+			return
+		}
+		log.Println("udp relay failure:", err)
+
+		// HandleConnection has closed the socket, so it must be opened again.
+		for {
+			time.Sleep(time.Second)
+			if s.isClosed() {
+				return
+			}
+			udpConn, err = NewUdpConn(fmt.Sprintf(":%d", s.Config.UdpPort))
+			if err == nil {
+				break
+			}
+			log.Println("udp relay failure:", err)
+		}
+	}
+}
+
+// trackConn adds or removes an accepted connection.
+// It returns false when adding a connection to a closed server.
+func (s *Socks5Server) trackConn(conn net.Conn, add bool) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Socks5Server) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// closeListeners stops accepting tcp connections and closes the udp relay on the fixed port.
+func (s *Socks5Server) closeListeners() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+
+	var err error
+	for listener := range s.listeners {
+		if closeErr := listener.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	if s.udpRelayServer != nil {
+		s.udpRelayServer.Close()
+		s.udpRelayServer = nil
+	}
+	return err
+}
+
+func (s *Socks5Server) closeConns() {
+	s.bandwidthLimiter().close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Socks5Server) activeConns() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections and closes the udp relay on the fixed port.
+// Then it waits for the active connections to finish their relays.
+// When ctx is done before that, the remaining connections are closed and ctx.Err() is returned.
+func (s *Socks5Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	for s.activeConns() > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Reload replaces the configuration of new connections, such as the authenticators, rules and timeouts.
+// The active relays keep the configuration they started with.
+// The old configuration is kept when config is invalid. UdpPort can not be changed.
+func (s *Socks5Server) Reload(config Config) error {
+	if err := s.ensureInit(); err != nil {
+		return err
+	}
+	if config.UdpPort != s.Config.UdpPort {
+		return ErrUdpPortChanged
+	}
+	newConfig, err := newServerConfig(config)
+	if err != nil {
+		return err
+	}
+	s.bandwidth.setLimits(newConfig.RateLimits)
+	s.current.Store(newConfig)
+	return nil
+}
+
+// bandwidthLimiter returns the buckets of the rate limits. s may be nil.
+func (s *Socks5Server) bandwidthLimiter() *bandwidthLimiter {
+	if s == nil {
+		return nil
+	}
+	return &s.bandwidth
+}
+
+// currentConfig returns the configuration of new connections.
+func (s *Socks5Server) currentConfig() *serverConfig {
+	return s.current.Load()
+}
+
+// Close stops the server immediately and closes all active connections.
+func (s *Socks5Server) Close() error {
+	err := s.closeListeners()
+	s.closeConns()
+	return err
+}
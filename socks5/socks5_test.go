@@ -1,7 +1,15 @@
 package socks5
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestSocks5NoAuthServer(t *testing.T) {
@@ -66,3 +74,290 @@ func TestSocks5RandomUdpPortServer(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// runTestServer serves on a random port and returns its address.
+func runTestServer(t *testing.T, server *Socks5Server) (string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Serve(listener)
+	}()
+	return listener.Addr().String(), errCh
+}
+
+func TestSocks5ServerShutdown(t *testing.T) {
+	t.Run("should wait for active relays", func(t *testing.T) {
+		server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+		addr, errCh := runTestServer(t, server)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// wait for the connection to be accepted
+		for server.activeConns() == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- server.Shutdown(context.Background())
+		}()
+
+		if err := <-errCh; err != ErrServerClosed {
+			t.Fatalf("want Run to return %s but got %v", ErrServerClosed, err)
+		}
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Fatalf("want dial error after shutdown but got nil")
+		}
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("want Shutdown to wait for the active connection but got %v", err)
+		case <-time.After(time.Millisecond * 200):
+		}
+
+		conn.Close()
+		if err := <-shutdownErr; err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+	})
+
+	t.Run("should close active relays when context is done", func(t *testing.T) {
+		server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+		addr, errCh := runTestServer(t, server)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		for server.activeConns() == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("want err = %s but got %v", context.DeadlineExceeded, err)
+		}
+		if err := <-errCh; err != ErrServerClosed {
+			t.Fatalf("want Run to return %s but got %v", ErrServerClosed, err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("want io.EOF but got %v", err)
+		}
+	})
+
+	t.Run("should close the udp relay on the fixed port", func(t *testing.T) {
+		// the udp port is fixed, but the tcp port is random
+		server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+		udpConn, err := NewUdpConn("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Config.UdpPort = udpConn.LocalAddr().(*net.UDPAddr).Port
+		udpConn.Close()
+
+		_, errCh := runTestServer(t, server)
+		if err := server.Close(); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if err := <-errCh; err != ErrServerClosed {
+			t.Fatalf("want Run to return %s but got %v", ErrServerClosed, err)
+		}
+
+		// the port can be used again once the relay is closed
+		for i := 0; ; i++ {
+			udpConn, err = NewUdpConn(fmt.Sprintf(":%d", server.Config.UdpPort))
+			if err == nil {
+				udpConn.Close()
+				break
+			}
+			if i == 100 {
+				t.Fatalf("want the udp port to be released but got %s", err)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	})
+}
+
+func TestSocks5ServerServeConn(t *testing.T) {
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destListener.Close()
+	go func() {
+		destConn, err := destListener.Accept()
+		if err != nil {
+			return
+		}
+		defer destConn.Close()
+		io.Copy(destConn, destConn)
+	}()
+
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ServeConn(serverConn)
+	}()
+
+	go clientConn.Write([]byte{Socks5Version, 1, MethodNoAuth})
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	destAddr := destListener.Addr().(*net.TCPAddr)
+	go writeTestRequest(clientConn, CmdConnect, destAddr.IP, uint16(destAddr.Port))
+	reply, _ := readTestReply(t, clientConn)
+	if reply != ReplySuccess {
+		t.Fatalf("want reply %d but got %d", ReplySuccess, reply)
+	}
+
+	go clientConn.Write([]byte("ping"))
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("want ping but got %s", buf)
+	}
+
+	clientConn.Close()
+	if err := <-errCh; err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+}
+
+func TestSocks5ServerReload(t *testing.T) {
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destListener.Close()
+	go func() {
+		for {
+			destConn, err := destListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer destConn.Close()
+				io.Copy(destConn, destConn)
+			}()
+		}
+	}()
+
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	addr, _ := runTestServer(t, server)
+	defer server.Close()
+	client := NewClient(addr, "", "")
+
+	oldConn, err := client.Dial("tcp", destListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldConn.Close()
+
+	t.Run("should apply the new config to new connections", func(t *testing.T) {
+		rules, err := NewRuleSet([]Rule{{Action: RuleDeny, Destinations: []string{"127.0.0.0/8"}}}, RuleAllow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Reload(Config{AuthMethod: MethodNoAuth, UdpPort: UdpRelayClose, Rules: rules}); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+
+		_, err = client.Dial("tcp", destListener.Addr().String())
+		if ReplyFromError(err) != ReplyConnectionNotAllowed {
+			t.Fatalf("want reply %d but got %v", ReplyConnectionNotAllowed, err)
+		}
+	})
+
+	t.Run("should keep the active relays", func(t *testing.T) {
+		oldConn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		oldConn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(oldConn, buf); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		if string(buf) != "ping" {
+			t.Fatalf("want ping but got %s", buf)
+		}
+	})
+
+	t.Run("should keep the old config when the new one is invalid", func(t *testing.T) {
+		err := server.Reload(Config{AuthMethod: MethodNoAuth, UdpPort: 1080})
+		if err != ErrUdpPortChanged {
+			t.Fatalf("want err = %s but got %v", ErrUdpPortChanged, err)
+		}
+		err = server.Reload(Config{AuthMethod: MethodNoAuth, UdpPort: UdpRelayClose, Upstreams: []Upstream{{Type: "unknown", Address: "127.0.0.1:1"}}})
+		if err == nil {
+			t.Fatalf("want an error but got nil")
+		}
+
+		_, err = client.Dial("tcp", destListener.Addr().String())
+		if ReplyFromError(err) != ReplyConnectionNotAllowed {
+			t.Fatalf("want reply %d but got %v", ReplyConnectionNotAllowed, err)
+		}
+	})
+}
+
+func TestSocks5ServerServeMixed(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeMixed(listener)
+	defer server.Close()
+	addr := listener.Addr().String()
+
+	t.Run("should serve socks5", func(t *testing.T) {
+		conn, err := NewClient(addr, "", "").Dial("tcp", origin.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		conn.Close()
+	})
+
+	t.Run("should serve http", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+		response, err := client.Get(origin.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "hello" {
+			t.Fatalf("want hello but got %s", body)
+		}
+	})
+
+	t.Run("should close unknown protocols", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte{0x16, 0x03, 0x01})
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("want io.EOF but got %v", err)
+		}
+	})
+}
@@ -1,18 +1,34 @@
 package socks5
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TcpRelayServer struct {
-	Server *Socks5Server
-	Conn   *net.TCPConn
+	Server   *Socks5Server
+	Conn     net.Conn  // usually *net.TCPConn, but any stream connection works
+	Identity *Identity // set after authentication
+	config   *serverConfig
+	socks4   bool // the replies are written in socks4
 }
 
 func (t *TcpRelayServer) HandleConnection() error {
+	// keep the configuration through the connection, even when the server is reloaded
+	t.config = t.Server.currentConfig()
+	t.config.Metrics.addTcpRelays(1)
+	defer t.config.Metrics.addTcpRelays(-1)
+	// slow clients can not hold the connection before the reply
+	t.Conn.SetDeadline(t.config.handshakeDeadline())
+
 	// negotiation and sub-negotiation
 	err := t.auth()
 	if err != nil {
@@ -34,16 +50,10 @@ func (t *TcpRelayServer) auth() error {
 		return err
 	}
 
-	// check if the auth method is supported
-	acceptable := false
-	for _, method := range clientMessage.Methods {
-		if method == t.Server.Config.AuthMethod {
-			acceptable = true
-			break
-		}
-	}
-
-	if !acceptable {
+	// select the first configured method which the client supports
+	authenticator := selectAuthenticator(t.config.Authenticators, clientMessage.Methods, t.Conn)
+	if authenticator == nil {
+		t.config.Metrics.addAuth(MethodNoAcceptable, false)
 		err := WriteServerAuthMessage(t.Conn, MethodNoAcceptable)
 		if err != nil {
 			return err
@@ -51,31 +61,51 @@ func (t *TcpRelayServer) auth() error {
 		return ErrAuthMethodNotSupport
 	}
 
-	err = WriteServerAuthMessage(t.Conn, t.Server.Config.AuthMethod)
+	err = WriteServerAuthMessage(t.Conn, authenticator.Method())
 	if err != nil {
 		return err
 	}
 
-	if t.Server.Config.AuthMethod == MethodPassword {
-		message, err := NewClientPasswordAuthMessage(t.Conn)
-		if err != nil {
-			return err
-		}
-		ok := t.Server.Config.PasswordChecker(message.Username, message.Password)
+	identity, err := authenticator.Authenticate(t.Conn, t.Conn.RemoteAddr())
+	t.config.Metrics.addAuth(authenticator.Method(), err == nil)
+	if err != nil {
+		return err
+	}
+	t.Identity = identity
 
-		if !ok {
-			// There is no need to return error because the link will be closed anyway.
-			WriteServerPasswordMessage(t.Conn, PasswordAuthFailure)
-			return ErrPasswordAuthFailure
-		}
+	return nil
+}
 
-		err = WriteServerPasswordMessage(t.Conn, PasswordAuthSuccess)
-		if err != nil {
-			return err
-		}
+// HandleSocks4Connection serves a socks4 or socks4a client, with the same dialing and rules as socks5.
+// socks4 has no authentication, so the client is only allowed when a NoAuthAuthenticator accepts it.
+func (t *TcpRelayServer) HandleSocks4Connection() error {
+	// keep the configuration through the connection, even when the server is reloaded
+	t.config = t.Server.currentConfig()
+	t.config.Metrics.addTcpRelays(1)
+	defer t.config.Metrics.addTcpRelays(-1)
+	t.Conn.SetDeadline(t.config.handshakeDeadline())
+	t.socks4 = true
+
+	requestMessage, err := NewSocks4RequestMessage(t.Conn)
+	if err != nil {
+		return err
+	}
+	authenticator := selectAuthenticator(t.config.Authenticators, []AuthMethod{MethodNoAuth}, t.Conn)
+	if authenticator == nil {
+		t.config.Metrics.addAuth(MethodNoAcceptable, false)
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return ErrAuthMethodNotSupport
+	}
+	// a CertificateAuthenticator finds the user of the client certificate
+	identity, err := authenticator.Authenticate(t.Conn, t.Conn.RemoteAddr())
+	t.config.Metrics.addAuth(MethodNoAuth, err == nil)
+	if err != nil {
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return err
 	}
+	t.Identity = identity
 
-	return nil
+	return t.handleRequest(requestMessage.clientRequestMessage())
 }
 
 func (t *TcpRelayServer) requestAndForward() error {
@@ -83,12 +113,21 @@ func (t *TcpRelayServer) requestAndForward() error {
 	if err != nil {
 		return err
 	}
+	return t.handleRequest(requestMessage)
+}
+
+// handleRequest serves the request of socks5 or socks4.
+func (t *TcpRelayServer) handleRequest(requestMessage *ClientRequestMessage) error {
+	t.config.Metrics.addCommand(requestMessage.Cmd)
+	if err := t.config.checkQuota(t.Identity); err != nil {
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return err
+	}
 
 	// check if command is supported
 	switch requestMessage.Cmd {
 	case CmdConnect:
-		host := fmt.Sprintf("%s:%d", requestMessage.Address, requestMessage.Port)
-		tcpDestConn, err := t.handleTcpRequest(host)
+		tcpDestConn, err := t.handleTcpRequest(requestMessage)
 		if err != nil {
 			return err
 		}
@@ -96,8 +135,17 @@ func (t *TcpRelayServer) requestAndForward() error {
 		if err != nil {
 			return err
 		}
+	case CmdBind:
+		peerConn, err := t.handleBindRequest(requestMessage)
+		if err != nil {
+			return err
+		}
+		err = t.forward(peerConn)
+		if err != nil {
+			return err
+		}
 	case cmdUdp:
-		udpRelayServer, err := t.handleUdpRequest()
+		udpRelayServer, err := t.handleUdpRequest(requestMessage)
 		if err != nil {
 			return err
 		}
@@ -108,77 +156,374 @@ func (t *TcpRelayServer) requestAndForward() error {
 			}
 		}
 	default:
-		WriteRequestFailureReply(t.Conn, ReplyCommandNotSupported)
+		t.writeFailureReply(ReplyCommandNotSupported)
 		return ErrCommandNotSupport
 	}
 	return nil
 }
 
+// ruleRequest describes the request of the client for the rules.
+func (t *TcpRelayServer) ruleRequest(requestMessage *ClientRequestMessage) *RuleRequest {
+	return &RuleRequest{
+		Cmd:        requestMessage.Cmd,
+		ClientAddr: t.Conn.RemoteAddr(),
+		Identity:   t.Identity,
+		Address:    requestMessage.Address,
+		Port:       requestMessage.Port,
+	}
+}
+
 // handleTcpRequest
-// host: similar to "x.x.x.x:x"
-func (t *TcpRelayServer) handleTcpRequest(host string) (io.ReadWriteCloser, error) {
-	// access destination address
-	destConn, err := net.DialTimeout("tcp", host, t.Server.Config.Timeout)
+func (t *TcpRelayServer) handleTcpRequest(requestMessage *ClientRequestMessage) (io.ReadWriteCloser, error) {
+	// access destination address, directly or through the upstreams
+	ctx, cancel := context.WithTimeout(context.Background(), t.config.Timeout)
+	defer cancel()
+	dialStart := time.Now()
+	destConn, err := t.config.dialTcp(ctx, t.ruleRequest(requestMessage))
+	if err != ErrRuleDenied {
+		t.config.Metrics.observeDial(time.Since(dialStart), err)
+	}
 	if err != nil {
-		WriteRequestFailureReply(t.Conn, ReplyNetworkUnreachable)
+		t.writeFailureReply(ReplyFromError(err))
 		return nil, err
 	}
 
 	// send success reply
-	tcpAddr := destConn.LocalAddr().(*net.TCPAddr)
-	err = WriteRequestSuccessReply(t.Conn, tcpAddr.IP, uint16(tcpAddr.Port))
+	ip, port := addrIpPort(destConn.LocalAddr())
+	err = t.writeSuccessReply(ip, port)
 	if err != nil {
-		WriteRequestFailureReply(t.Conn, ReplyServerFailure)
+		destConn.Close()
+		t.writeFailureReply(ReplyServerFailure)
 		return nil, err
 	}
 
 	return destConn, nil
 }
 
+// handleBindRequest
+// It opens a listener on the address the client reached us on and sends it in the first reply.
+// Then it waits for one incoming connection, checks the peer against the requested address
+// and sends the peer address in the second reply.
+// Only the ip of the peer is checked, because the peer usually connects from another port,
+// such as the data port of an active-mode ftp server.
+func (t *TcpRelayServer) handleBindRequest(requestMessage *ClientRequestMessage) (io.ReadWriteCloser, error) {
+	if !t.config.Rules.Allow(t.ruleRequest(requestMessage)) {
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return nil, ErrRuleDenied
+	}
+
+	// When the client does not come from an ip network, such as a unix socket, listen on all addresses.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addrIp(t.Conn.LocalAddr())})
+	if err != nil {
+		t.writeFailureReply(ReplyServerFailure)
+		return nil, err
+	}
+	defer listener.Close()
+
+	allowedIps, err := t.config.bindAllowedIps(requestMessage)
+	if err != nil {
+		t.writeFailureReply(ReplyFromError(err))
+		return nil, err
+	}
+
+	// first reply: the address the peer should connect to
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	err = t.writeSuccessReply(bindAddr.IP, uint16(bindAddr.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	err = listener.SetDeadline(time.Now().Add(t.config.BindTimeout))
+	if err != nil {
+		t.writeFailureReply(ReplyServerFailure)
+		return nil, err
+	}
+	peerConn, err := listener.AcceptTCP()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.writeFailureReply(ReplyTTLExpired)
+		return nil, ErrBindTimeout
+	} else if err != nil {
+		t.writeFailureReply(ReplyServerFailure)
+		return nil, err
+	}
+
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+	if !bindPeerAllowed(peerAddr.IP, allowedIps) {
+		peerConn.Close()
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return nil, ErrBindPeerMismatch
+	}
+
+	// second reply: the address of the connected peer
+	err = t.writeSuccessReply(peerAddr.IP, uint16(peerAddr.Port))
+	if err != nil {
+		peerConn.Close()
+		return nil, err
+	}
+
+	return peerConn, nil
+}
+
+// bindAllowedIps returns the ips the incoming connection of BIND may come from.
+// nil means any ip is allowed, which happens when the client sends an unspecified address.
+// A domain is resolved within c.Timeout, so a dead dns server can not hang the handshake.
+func (c *serverConfig) bindAllowedIps(requestMessage *ClientRequestMessage) ([]net.IP, error) {
+	if requestMessage.AddressType == AddressTypeDomain {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		defer cancel()
+		return c.resolver().LookupIP(ctx, requestMessage.Address)
+	}
+	ip := net.ParseIP(requestMessage.Address)
+	if ip == nil {
+		return nil, ErrUnknownAddr
+	}
+	if ip.IsUnspecified() {
+		return nil, nil
+	}
+	return []net.IP{ip}, nil
+}
+
+// addrIp returns the ip of addr.
+// It returns nil when addr is not an ip address, such as the address of a unix socket or net.Pipe.
+func addrIp(addr net.Addr) net.IP {
+	ip, _ := addrIpPort(addr)
+	return ip
+}
+
+// addrIpPort returns the ip and port of addr, or nil and 0 when addr is not an ip address.
+func addrIpPort(addr net.Addr) (net.IP, uint16) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, uint16(addr.Port)
+	case *net.UDPAddr:
+		return addr.IP, uint16(addr.Port)
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, 0
+	}
+	portInt, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), uint16(portInt)
+}
+
+func bindPeerAllowed(peerIp net.IP, allowedIps []net.IP) bool {
+	if allowedIps == nil {
+		return true
+	}
+	for _, ip := range allowedIps {
+		if ip.Equal(peerIp) {
+			return true
+		}
+	}
+	return false
+}
+
 // When udp relay is not opened, it will return nil and ErrCommandNotSupport.
-// When t.Server.Config.UdpPort is UdpRelayRandomPort, it will reply a successful udp associate request and return a new *UdpRelayServer and nil.
-// When use concrete udp relay port, it will reply a successful udp associate request and return nil and nil.
-func (t *TcpRelayServer) handleUdpRequest() (*UdpRelayServer, error) {
-	if t.Server.Config.UdpPort == UdpRelayClose {
-		WriteRequestFailureReply(t.Conn, ReplyConnectionNotAllowed)
+// When t.config.UdpPort is UdpRelayRandomPort, it will reply a successful udp associate request and return a new *UdpRelayServer and nil.
+// When use concrete udp relay port, it will reply a successful udp associate request, and return nil and nil
+// after the tcp connection has been closed.
+// The rules check the request here and every datagram later.
+// Datagrams are only accepted from the client address of the request, see udpAssociation.
+func (t *TcpRelayServer) handleUdpRequest(requestMessage *ClientRequestMessage) (*UdpRelayServer, error) {
+	if !t.config.Rules.Allow(t.ruleRequest(requestMessage)) {
+		t.writeFailureReply(ReplyConnectionNotAllowed)
+		return nil, ErrRuleDenied
+	}
+	if t.config.UdpPort == UdpRelayClose {
+		t.writeFailureReply(ReplyConnectionNotAllowed)
 		return nil, ErrCommandNotSupport
-	} else if t.Server.Config.UdpPort == UdpRelayRandomPort {
+	} else if !t.config.chain.SupportsUdp() {
+		t.writeFailureReply(ReplyCommandNotSupported)
+		return nil, ErrUdpNotSupportedByUpstream
+	}
+	// DST.ADDR is resolved only when the relay is open
+	association, err := newUdpAssociation(t.Conn, t.Identity, t.config, requestMessage)
+	if err != nil {
+		t.writeFailureReply(ReplyFromError(err))
+		return nil, err
+	}
+
+	if t.config.UdpPort == UdpRelayRandomPort {
 		conn, err := NewUdpConn(":0")
 		if err != nil {
+			t.writeFailureReply(ReplyServerFailure)
 			return nil, err
 		}
 
-		udpRelayServerIp := t.Server.Config.UdpRelayServerIp
+		udpRelayServerIp := t.config.UdpRelayServerIp
 		if udpRelayServerIp == nil {
 			// use ip of tcp connection
-			udpRelayServerIp = t.Conn.LocalAddr().(*net.TCPAddr).IP
+			udpRelayServerIp = addrIp(t.Conn.LocalAddr())
 		}
 
 		port := conn.LocalAddr().(*net.UDPAddr).Port
-		err = WriteRequestSuccessReply(t.Conn, udpRelayServerIp, uint16(port))
+		err = t.writeSuccessReply(udpRelayServerIp, uint16(port))
 		if err != nil {
+			conn.Close()
 			return nil, err
 		}
 
 		udpRelayServer := NewUdpRelayServer(t.Server, conn, t.Conn)
+		udpRelayServer.Identity = t.Identity
+		udpRelayServer.config = t.config
+		udpRelayServer.associations = &udpAssociations{list: []*udpAssociation{association}}
 		return udpRelayServer, nil
 	} else {
-		udpRelayServerIp := t.Server.Config.UdpRelayServerIp
+		udpRelayServerIp := t.config.UdpRelayServerIp
 		if udpRelayServerIp == nil {
-			udpRelayServerIp = t.Conn.LocalAddr().(*net.TCPAddr).IP
+			udpRelayServerIp = addrIp(t.Conn.LocalAddr())
 		}
 
-		err := WriteRequestSuccessReply(t.Conn, udpRelayServerIp, uint16(t.Server.Config.UdpPort))
+		err := t.writeSuccessReply(udpRelayServerIp, uint16(t.config.UdpPort))
 		if err != nil {
 			return nil, err
 		}
+		t.holdUdpAssociation(association)
 		return nil, nil
 	}
 }
 
+// holdUdpAssociation lets the client use the shared relay on the fixed port until the tcp connection is closed.
+func (t *TcpRelayServer) holdUdpAssociation(association *udpAssociation) {
+	t.config.Metrics.addUdpAssociations(1)
+	defer t.config.Metrics.addUdpAssociations(-1)
+	t.Server.udpAssociations.add(association)
+	defer t.Server.udpAssociations.remove(association)
+	io.Copy(io.Discard, t.Conn)
+}
+
+// writeSuccessReply sends a success reply and counts it.
+// The handshake is over after the success reply, so its deadline is removed.
+func (t *TcpRelayServer) writeSuccessReply(ip net.IP, port uint16) error {
+	t.config.Metrics.addReply(ReplySuccess)
+	var err error
+	if t.socks4 {
+		err = WriteSocks4Reply(t.Conn, Socks4ReplyGranted, ip, port)
+	} else {
+		err = WriteRequestSuccessReply(t.Conn, ip, port)
+	}
+	if err != nil {
+		return err
+	}
+	return t.Conn.SetDeadline(time.Time{})
+}
+
+// writeFailureReply sends a failure reply and counts it.
+// socks4 has a single failure reply, so all failures are rejected.
+func (t *TcpRelayServer) writeFailureReply(reply ReplyType) error {
+	t.config.Metrics.addReply(reply)
+	if t.socks4 {
+		return WriteSocks4Reply(t.Conn, Socks4ReplyRejected, nil, 0)
+	}
+	return WriteRequestFailureReply(t.Conn, reply)
+}
+
 func (t *TcpRelayServer) forward(destConn io.ReadWriteCloser) error {
+	limiter := t.Server.bandwidthLimiter().acquire(t.Identity, addrIp(t.Conn.RemoteAddr()))
+	defer limiter.release()
+	return relay(t.Conn, destConn, t.config.IdleTimeout, relayMeter{
+		metrics: t.config.Metrics,
+		limiter: limiter,
+		usage:   t.config.Usage.account(t.Identity),
+	})
+}
+
+// relayMeter counts and limits the bytes of a relay.
+type relayMeter struct {
+	metrics *Metrics
+	limiter *connRateLimiter
+	usage   *usageAccount
+}
+
+// writer meters the bytes written to w in the direction, "up" or "down".
+func (m relayMeter) writer(w io.Writer, direction string) io.Writer {
+	upload := direction == "up"
+	return m.metrics.meteredWriter(m.usage.writer(m.limiter.writer(w, upload), upload), direction, "tcp")
+}
+
+// relay copies data between the client and the destination until the destination is done.
+func relay(clientConn io.ReadWriteCloser, destConn io.ReadWriteCloser, idleTimeout time.Duration, meter relayMeter) error {
 	defer destConn.Close()
-	go io.Copy(destConn, t.Conn)
-	_, err := io.Copy(t.Conn, destConn)
+	var clientReader, destReader io.Reader = clientConn, destConn
+	var idle *idleTimer
+	if idleTimeout > 0 {
+		idle = newIdleTimer(idleTimeout, func() {
+			clientConn.Close()
+			destConn.Close()
+			meter.limiter.interrupt()
+		})
+		defer idle.stop()
+		clientReader = idle.reader(clientConn)
+		destReader = idle.reader(destConn)
+	}
+	go func() {
+		_, err := io.Copy(meter.writer(destConn, "up"), clientReader)
+		// When the client finishes sending, pass the EOF on and keep receiving.
+		// When the client connection fails, such as being closed by Socks5Server.Close, stop both sides.
+		if closeWriter, ok := destConn.(interface{ CloseWrite() error }); ok && err == nil {
+			closeWriter.CloseWrite()
+		} else {
+			destConn.Close()
+			meter.limiter.interrupt()
+		}
+	}()
+	_, err := io.Copy(meter.writer(clientConn, "down"), destReader)
+	if idle != nil && idle.expired.Load() {
+		return ErrRelayIdleTimeout
+	}
 	return err
 }
+
+// idleTimer calls onIdle when nothing has been read by its readers for timeout.
+// Reading only records the time, and the timer checks it when it fires.
+type idleTimer struct {
+	timeout    time.Duration
+	lastActive atomic.Int64 // unix nano
+	expired    atomic.Bool
+	mu         sync.Mutex // guards timer, which is set after the callback is scheduled
+	timer      *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	idle := &idleTimer{timeout: timeout}
+	idle.lastActive.Store(time.Now().UnixNano())
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	idle.timer = time.AfterFunc(timeout, func() {
+		remaining := idle.timeout - time.Since(time.Unix(0, idle.lastActive.Load()))
+		if remaining > 0 {
+			idle.mu.Lock()
+			idle.timer.Reset(remaining)
+			idle.mu.Unlock()
+			return
+		}
+		idle.expired.Store(true)
+		onIdle()
+	})
+	return idle
+}
+
+func (idle *idleTimer) reader(r io.Reader) io.Reader {
+	return readerFunc(func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		if n > 0 {
+			idle.lastActive.Store(time.Now().UnixNano())
+		}
+		return n, err
+	})
+}
+
+func (idle *idleTimer) stop() {
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	idle.timer.Stop()
+}
+
+type readerFunc func(b []byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
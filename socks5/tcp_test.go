@@ -1,3 +1,252 @@
 package socks5
 
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
 
+// newTestTcpRelay returns the client side of a loopback connection whose server side
+// is handled by a TcpRelayServer. The error of HandleConnection is sent to the channel.
+func newTestTcpRelay(t *testing.T, config Config) (net.Conn, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	server := NewSocks5Server("127.0.0.1", 0, config)
+	if err := server.init(); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		tcpRelayServer := TcpRelayServer{
+			Server: server,
+			Conn:   serverConn,
+		}
+		errCh <- tcpRelayServer.HandleConnection()
+	}()
+
+	// no-auth negotiation
+	clientConn.Write([]byte{Socks5Version, 1, MethodNoAuth})
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(clientConn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[1] != MethodNoAuth {
+		t.Fatalf("want method %d but got %d", MethodNoAuth, buf[1])
+	}
+	return clientConn, errCh
+}
+
+func writeTestRequest(conn io.Writer, cmd Command, ip net.IP, port uint16) {
+	buf := []byte{Socks5Version, cmd, ReversedField, AddressTypeIpv4}
+	buf = append(buf, ip.To4()...)
+	buf = binary.BigEndian.AppendUint16(buf, port)
+	conn.Write(buf)
+}
+
+// readTestReply reads a reply with an ipv4 address.
+func readTestReply(t *testing.T, conn io.Reader) (ReplyType, *net.TCPAddr) {
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[3] != AddressTypeIpv4 {
+		t.Fatalf("want address type %d but got %d", AddressTypeIpv4, buf[3])
+	}
+	addr := &net.TCPAddr{IP: net.IP(buf[4:8]), Port: int(binary.BigEndian.Uint16(buf[8:]))}
+	return buf[1], addr
+}
+
+func TestTcpRelayServerBind(t *testing.T) {
+	t.Run("should relay the incoming connection", func(t *testing.T) {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth})
+		writeTestRequest(clientConn, CmdBind, net.IPv4(127, 0, 0, 1), 0)
+
+		reply, bindAddr := readTestReply(t, clientConn)
+		if reply != ReplySuccess {
+			t.Fatalf("want first reply %d but got %d", ReplySuccess, reply)
+		}
+
+		peerConn, err := net.DialTCP("tcp", nil, bindAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peerConn.Close()
+
+		reply, peerAddr := readTestReply(t, clientConn)
+		if reply != ReplySuccess {
+			t.Fatalf("want second reply %d but got %d", ReplySuccess, reply)
+		}
+		if peerAddr.String() != peerConn.LocalAddr().String() {
+			t.Fatalf("want peer address %s but got %s", peerConn.LocalAddr(), peerAddr)
+		}
+
+		peerConn.Write([]byte("from peer"))
+		buf := make([]byte, 9)
+		if _, err := io.ReadFull(clientConn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, []byte("from peer")) {
+			t.Fatalf("want %q but got %q", "from peer", buf)
+		}
+
+		clientConn.Write([]byte("from client"))
+		buf = make([]byte, 11)
+		if _, err := io.ReadFull(peerConn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, []byte("from client")) {
+			t.Fatalf("want %q but got %q", "from client", buf)
+		}
+
+		peerConn.Close()
+		if err := <-errCh; err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+	})
+
+	t.Run("should reject a peer from another address", func(t *testing.T) {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth})
+		writeTestRequest(clientConn, CmdBind, net.IPv4(127, 0, 0, 2), 0)
+
+		_, bindAddr := readTestReply(t, clientConn)
+		peerConn, err := net.DialTCP("tcp", nil, bindAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peerConn.Close()
+
+		reply, _ := readTestReply(t, clientConn)
+		if reply != ReplyConnectionNotAllowed {
+			t.Fatalf("want second reply %d but got %d", ReplyConnectionNotAllowed, reply)
+		}
+		if err := <-errCh; err != ErrBindPeerMismatch {
+			t.Fatalf("want err = %s but got %v", ErrBindPeerMismatch, err)
+		}
+	})
+
+	t.Run("should time out resolving the domain of the peer", func(t *testing.T) {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, Resolver: testHangingResolver{}, Timeout: time.Millisecond * 200})
+		domain := "peer.test"
+		request := []byte{Socks5Version, CmdBind, ReversedField, AddressTypeDomain, byte(len(domain))}
+		request = append(request, domain...)
+		request = binary.BigEndian.AppendUint16(request, 0)
+		clientConn.Write(request)
+
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("want err = %s but got %v", context.DeadlineExceeded, err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("want the lookup to time out but it is still running")
+		}
+		if reply, _ := readTestReply(t, clientConn); reply == ReplySuccess {
+			t.Fatalf("want a failure reply but got %d", reply)
+		}
+	})
+
+	t.Run("should time out without incoming connection", func(t *testing.T) {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, BindTimeout: time.Millisecond * 100})
+		writeTestRequest(clientConn, CmdBind, net.IPv4(127, 0, 0, 1), 0)
+
+		readTestReply(t, clientConn)
+		reply, _ := readTestReply(t, clientConn)
+		if reply != ReplyTTLExpired {
+			t.Fatalf("want second reply %d but got %d", ReplyTTLExpired, reply)
+		}
+		if err := <-errCh; err != ErrBindTimeout {
+			t.Fatalf("want err = %s but got %v", ErrBindTimeout, err)
+		}
+	})
+}
+
+func TestTcpRelayServerRules(t *testing.T) {
+	rules, err := NewRuleSet([]Rule{{Action: RuleDeny, Destinations: []string{"127.0.0.0/8"}}}, RuleAllow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []Command{CmdConnect, CmdBind} {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, Rules: rules})
+		writeTestRequest(clientConn, cmd, net.IPv4(127, 0, 0, 1), 80)
+
+		reply, _ := readTestReply(t, clientConn)
+		if reply != ReplyConnectionNotAllowed {
+			t.Fatalf("command %d: want reply %d but got %d", cmd, ReplyConnectionNotAllowed, reply)
+		}
+		if err := <-errCh; err != ErrRuleDenied {
+			t.Fatalf("command %d: want err = %s but got %v", cmd, ErrRuleDenied, err)
+		}
+	}
+}
+
+func TestTcpRelayServerTimeouts(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	echoTcpAddr, _ := net.ResolveTCPAddr("tcp", echoAddr)
+
+	t.Run("should close a slow handshake", func(t *testing.T) {
+		_, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, HandshakeTimeout: time.Millisecond * 200})
+		// the request is never sent
+		select {
+		case err := <-errCh:
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Fatalf("want a timeout error but got %v", err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("want the handshake to time out but it is still running")
+		}
+	})
+
+	t.Run("should not limit the relay by the handshake timeout", func(t *testing.T) {
+		clientConn, _ := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, HandshakeTimeout: time.Millisecond * 200})
+		writeTestRequest(clientConn, CmdConnect, echoTcpAddr.IP, uint16(echoTcpAddr.Port))
+		if reply, _ := readTestReply(t, clientConn); reply != ReplySuccess {
+			t.Fatalf("want reply %d but got %d", ReplySuccess, reply)
+		}
+		time.Sleep(time.Millisecond * 400)
+		testEcho(t, clientConn)
+	})
+
+	t.Run("should close an idle relay", func(t *testing.T) {
+		clientConn, errCh := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, IdleTimeout: time.Millisecond * 300})
+		writeTestRequest(clientConn, CmdConnect, echoTcpAddr.IP, uint16(echoTcpAddr.Port))
+		if reply, _ := readTestReply(t, clientConn); reply != ReplySuccess {
+			t.Fatalf("want reply %d but got %d", ReplySuccess, reply)
+		}
+		// the traffic keeps the relay longer than the idle timeout
+		for i := 0; i < 6; i++ {
+			testEcho(t, clientConn)
+			time.Sleep(time.Millisecond * 100)
+		}
+		select {
+		case err := <-errCh:
+			if err != ErrRelayIdleTimeout {
+				t.Fatalf("want err = %s but got %v", ErrRelayIdleTimeout, err)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("want the idle relay to be closed but it is still running")
+		}
+	})
+}
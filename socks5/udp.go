@@ -1,40 +1,163 @@
 package socks5
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const MaxUdpBufLength = 65507
 
-var ErrOpenUdpConnection = errors.New("open udp port failed")
+var (
+	ErrOpenUdpConnection = errors.New("open udp port failed")
+	ErrUdpNotAssociated  = errors.New("udp source does not match any association")
+)
+
+// udpAssociation is a UDP ASSOCIATE request, which lives as long as its tcp connection.
+// Datagrams are only accepted from the client which has sent it: the ip of the tcp connection,
+// or the DST.ADDR of the request. The first accepted datagram pins the source port,
+// unless DST.PORT has chosen it.
+type udpAssociation struct {
+	tcpConn      net.Conn
+	identity     *Identity
+	config       *serverConfig // nil means the config of the relay
+	allowedIps   []net.IP
+	declaredIps  []net.IP
+	declaredPort uint16
+	clientAddr   *net.UDPAddr // the pinned source, guarded by udpAssociations.mutex
+	closed       atomic.Bool
+}
+
+// newUdpAssociation creates the association of the request received on tcpConn.
+// The request may be nil when the client address is unknown.
+func newUdpAssociation(tcpConn net.Conn, identity *Identity, config *serverConfig, requestMessage *ClientRequestMessage) (*udpAssociation, error) {
+	association := &udpAssociation{
+		tcpConn:  tcpConn,
+		identity: identity,
+		config:   config,
+	}
+	if ip := addrIp(tcpConn.RemoteAddr()); ip != nil {
+		association.allowedIps = append(association.allowedIps, ip)
+	}
+	if requestMessage != nil {
+		// an unspecified address means the client does not know it yet
+		declaredIps, err := config.bindAllowedIps(requestMessage)
+		if err != nil {
+			return nil, err
+		}
+		association.declaredIps = declaredIps
+		association.declaredPort = requestMessage.Port
+		association.allowedIps = append(association.allowedIps, declaredIps...)
+	}
+	return association, nil
+}
+
+// accept reports whether the datagram from addr belongs to the association.
+func (a *udpAssociation) accept(addr *net.UDPAddr) bool {
+	if a.closed.Load() {
+		return false
+	}
+	if a.clientAddr != nil {
+		return a.clientAddr.IP.Equal(addr.IP) && a.clientAddr.Port == addr.Port
+	}
+	if !ipInList(a.allowedIps, addr.IP) {
+		return false
+	}
+	// behind a nat, the datagrams come from the ip of the tcp connection with another port
+	if a.declaredPort != 0 && ipInList(a.declaredIps, addr.IP) && int(a.declaredPort) != addr.Port {
+		return false
+	}
+	a.clientAddr = addr
+	return true
+}
+
+func ipInList(ips []net.IP, ip net.IP) bool {
+	for _, item := range ips {
+		if item.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// udpAssociations finds the association of a datagram by its source.
+type udpAssociations struct {
+	mutex sync.Mutex
+	list  []*udpAssociation
+}
+
+func (s *udpAssociations) add(association *udpAssociation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = append(s.list, association)
+}
+
+// remove closes the association, and its exchanges are closed by the relay later.
+func (s *udpAssociations) remove(association *udpAssociation) {
+	association.closed.Store(true)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, item := range s.list {
+		if item == association {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// find returns the association of addr, or nil. A pinned source is preferred to a new one.
+func (s *udpAssociations) find(addr *net.UDPAddr) *udpAssociation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, association := range s.list {
+		if association.clientAddr != nil && association.accept(addr) {
+			return association
+		}
+	}
+	for _, association := range s.list {
+		if association.clientAddr == nil && association.accept(addr) {
+			return association
+		}
+	}
+	return nil
+}
 
 type UdpExchange struct {
 	ExpiredTime    time.Time
-	DConn          *net.UDPConn // connection with destination
+	DConn          net.PacketConn // connection with destination, directly or through the upstreams
 	UdpRelayServer *UdpRelayServer
 	ClientAddr     *net.UDPAddr
-	Closed         chan struct{} // prepare for closing
-	ClosedOk       chan struct{} // have closed
+	association    *udpAssociation
+	limiter        *connRateLimiter
+	usage          *usageAccount
+	datagrams      chan *UdpClientForwardMessage // the datagrams of the client waiting to be sent by send
+	Closed         chan struct{}                 // prepare for closing
+	ClosedOk       chan struct{}                 // have closed
+	closeOnce      sync.Once
+	expiredMutex   sync.Mutex // ExpiredTime is refreshed and checked by different goroutines
 }
 
-func NewUdpExchange(conn *net.UDPConn, lifetime time.Duration, udpRelayServer *UdpRelayServer, clientAddr *net.UDPAddr) *UdpExchange {
+func NewUdpExchange(conn net.PacketConn, lifetime time.Duration, udpRelayServer *UdpRelayServer, clientAddr *net.UDPAddr) *UdpExchange {
 	udpExchange := &UdpExchange{}
 	udpExchange.ExpiredTime = time.Now().Add(lifetime)
 	udpExchange.DConn = conn
 	udpExchange.UdpRelayServer = udpRelayServer
 	udpExchange.ClientAddr = clientAddr
+	udpExchange.datagrams = make(chan *UdpClientForwardMessage, maxPendingDatagrams)
 	udpExchange.Closed = make(chan struct{})
 	udpExchange.ClosedOk = make(chan struct{})
 	return udpExchange
 }
 
 func (u *UdpExchange) IsExpired() bool {
+	u.expiredMutex.Lock()
+	defer u.expiredMutex.Unlock()
 	if time.Now().Unix() > u.ExpiredTime.Unix() {
 		return true
 	}
@@ -42,24 +165,33 @@ func (u *UdpExchange) IsExpired() bool {
 }
 
 func (u *UdpExchange) Refresh(lifetime time.Duration) {
+	u.expiredMutex.Lock()
+	defer u.expiredMutex.Unlock()
 	u.ExpiredTime = time.Now().Add(lifetime)
 }
 
+// Close can be called more than once, and also after Handle has returned.
 func (u *UdpExchange) Close() {
-	u.Closed <- struct{}{}
+	u.closeOnce.Do(func() {
+		close(u.Closed)
+	})
 	<-u.ClosedOk // waiting for all work to be completed
 }
 
 func (u *UdpExchange) Handle() error {
+	metrics := u.UdpRelayServer.serverConfig().Metrics
+	metrics.addUdpExchanges(1)
 	buf := make([]byte, MaxUdpBufLength)
 	defer func() {
+		metrics.addUdpExchanges(-1)
+		u.limiter.release()
 		u.DConn.Close()
+		close(u.ClosedOk)
 	}()
 
 	for {
 		select {
 		case <-u.Closed:
-			u.ClosedOk <- struct{}{}
 			return nil
 		default:
 			err := u.DConn.SetReadDeadline(time.Now().Add(time.Second * 3))
@@ -74,7 +206,11 @@ func (u *UdpExchange) Handle() error {
 				return err
 			}
 
-			u.Refresh(u.UdpRelayServer.Server.Config.UdpConnLifetime)
+			u.Refresh(u.UdpRelayServer.serverConfig().UdpConnLifetime)
+			if !u.limiter.allow(n, false) {
+				// over the rate limit, dropped as a router does
+				continue
+			}
 
 			toClientBytes, err := NewUdpServerForwardBytes(addr, buf[:n])
 			if err != nil {
@@ -85,6 +221,8 @@ func (u *UdpExchange) Handle() error {
 			if err != nil {
 				return err
 			}
+			metrics.addBytes("down", "udp", n)
+			u.usage.add(Usage{Download: int64(n)})
 		}
 	}
 }
@@ -92,46 +230,99 @@ func (u *UdpExchange) Handle() error {
 type UdpRelayServer struct {
 	Server            *Socks5Server
 	Conn              *net.UDPConn            // connection with client
-	TcpConn           *net.TCPConn            // may be nil
+	TcpConn           net.Conn                // may be nil
+	Identity          *Identity               // the client authenticated on TcpConn, nil when TcpConn is nil
 	UdpExchanges      map[string]*UdpExchange // host to connection with destination
 	UdpExchangesMutex sync.Mutex
+	Reassembler       *UdpReassembler
+	config            *serverConfig // nil means the current config of Server, for the shared relay on the fixed port
+	closeOnce         sync.Once
+	closeErr          error
+	// associations accept the datagrams. nil means the association of TcpConn,
+	// or the associations of Server for the shared relay on the fixed port.
+	associations *udpAssociations
+	// the exchanges being opened, guarded by UdpExchangesMutex
+	pendingExchanges map[string]*pendingUdpExchange
+	closed           bool // guarded by UdpExchangesMutex
+}
+
+// maxPendingDatagrams is the number of datagrams of a source kept while its exchange is being opened,
+// or while their destinations are being resolved. The datagrams over it are dropped.
+const maxPendingDatagrams = 16
+
+// pendingUdpExchange keeps the datagrams of a source while its exchange is being opened,
+// which may take a handshake with an upstream proxy.
+type pendingUdpExchange struct {
+	association *udpAssociation
+	datagrams   []*UdpClientForwardMessage
 }
 
 // NewUdpRelayServer is defined to Create a new UdpRelayServer.
 // TcpConn present the tcp connection during auth and request
 // When tcpConn closed, the udp connection will be closed.
-func NewUdpRelayServer(server *Socks5Server, conn *net.UDPConn, tcpConn *net.TCPConn) *UdpRelayServer {
+func NewUdpRelayServer(server *Socks5Server, conn *net.UDPConn, tcpConn net.Conn) *UdpRelayServer {
 	udpRelayServer := &UdpRelayServer{}
 	udpRelayServer.Server = server
 	udpRelayServer.Conn = conn
 	udpRelayServer.TcpConn = tcpConn
 
 	udpRelayServer.UdpExchanges = make(map[string]*UdpExchange)
+	udpRelayServer.pendingExchanges = make(map[string]*pendingUdpExchange)
+	udpRelayServer.Reassembler = NewUdpReassembler(udpRelayServer.serverConfig().UdpReassemblyTimeout)
 
 	return udpRelayServer
 }
 
-func (u *UdpRelayServer) Close() error {
-	// step1. close the connection to the destination
-	u.UdpExchangesMutex.Lock()
-	for _, udpExchange := range u.UdpExchanges {
-		udpExchange.Close()
+// serverConfig returns the config of the tcp connection, or the current config of Server.
+func (u *UdpRelayServer) serverConfig() *serverConfig {
+	if u.config != nil {
+		return u.config
 	}
-	u.UdpExchangesMutex.Unlock()
+	return u.Server.currentConfig()
+}
 
-	// step2. close the udp connection to the client
-	err := u.Conn.Close()
+// Close can be called more than once. Only the first call does the work.
+func (u *UdpRelayServer) Close() error {
+	u.closeOnce.Do(func() {
+		// step1. close the connection to the destination
+		u.UdpExchangesMutex.Lock()
+		u.closed = true
+		for host, udpExchange := range u.UdpExchanges {
+			udpExchange.Close()
+			delete(u.UdpExchanges, host)
+		}
+		u.UdpExchangesMutex.Unlock()
 
-	// step3. close the tcp connection to the client
-	if u.TcpConn != nil {
-		err = u.TcpConn.Close()
-	}
+		// step2. close the udp connection to the client
+		u.closeErr = u.Conn.Close()
 
-	return err
+		// step3. close the tcp connection to the client
+		if u.TcpConn != nil {
+			u.closeErr = u.TcpConn.Close()
+		}
+	})
+
+	return u.closeErr
 }
 
 func (u *UdpRelayServer) HandleConnection() error {
 	defer u.Close()
+	if u.associations == nil {
+		if u.TcpConn == nil {
+			u.associations = &u.Server.udpAssociations
+		} else {
+			association, err := newUdpAssociation(u.TcpConn, u.Identity, u.config, nil)
+			if err != nil {
+				return err
+			}
+			u.associations = &udpAssociations{list: []*udpAssociation{association}}
+		}
+	}
+	// the relay on the fixed port is shared, so only the relays of a tcp connection are associations
+	if u.TcpConn != nil {
+		u.serverConfig().Metrics.addUdpAssociations(1)
+		defer u.serverConfig().Metrics.addUdpAssociations(-1)
+	}
 	tcpDone := make(chan struct{})
 	handleDone := make(chan struct{})
 	defer close(handleDone)
@@ -157,12 +348,14 @@ func (u *UdpRelayServer) HandleConnection() error {
 			case <-time.After(time.Second * 2):
 				u.UdpExchangesMutex.Lock()
 				for host, udpExchange := range u.UdpExchanges {
-					if udpExchange.IsExpired() {
+					// the tcp connection of the association has been closed
+					if udpExchange.IsExpired() || udpExchange.association.closed.Load() {
 						udpExchange.Close()
 						delete(u.UdpExchanges, host)
 					}
 				}
 				u.UdpExchangesMutex.Unlock()
+				u.Reassembler.RemoveExpired()
 			case <-handleDone:
 				return
 			}
@@ -187,52 +380,151 @@ func (u *UdpRelayServer) HandleConnection() error {
 			}
 
 			host := fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
-			//fmt.Println(host)
+
+			// only the clients with an association can send datagrams
+			// Anyone can send to the relay, so the drops are counted instead of logged.
+			association := u.associations.find(addr)
+			if association == nil {
+				u.serverConfig().Metrics.addUdpDrop("not_associated")
+				continue
+			}
+			config := association.config
+			if config == nil {
+				config = u.serverConfig()
+			}
+
+			// A malformed datagram is dropped, and the association keeps working.
+			udpClientForwardMessage, err := NewUdpClientForwardMessage(buf[:n])
+			if err != nil {
+				log.Printf("drop udp datagram from %s: %s", host, err)
+				continue
+			}
+			udpClientForwardMessage = u.Reassembler.Add(host, udpClientForwardMessage)
+			if udpClientForwardMessage == nil {
+				// waiting for the rest fragments
+				continue
+			}
+			// buf is read again before the datagram is sent
+			udpClientForwardMessage.Data = append([]byte(nil), udpClientForwardMessage.Data...)
+
 			u.UdpExchangesMutex.Lock()
 			udpExchange, ok := u.UdpExchanges[host]
+			if ok && udpExchange.association != association {
+				// the source has a new association, after the old one has been closed
+				udpExchange.Close()
+				delete(u.UdpExchanges, host)
+				ok = false
+			}
 			if !ok {
-				// create a new udp conn and start to handle
-				dConn, err := NewUdpConn(":0")
-				if err != nil {
-					return ErrOpenUdpConnection
+				// open the exchange in the background, so the other clients of the relay never wait for it
+				pending, opening := u.pendingExchanges[host]
+				if !opening {
+					pending = &pendingUdpExchange{association: association}
+					u.pendingExchanges[host] = pending
+					go u.openExchange(host, addr, config, pending)
 				}
-				//fmt.Println(u.Server.Config.UdpConnLifetime)
-				udpExchange = NewUdpExchange(dConn, u.Server.Config.UdpConnLifetime, u, addr)
-				u.UdpExchanges[host] = udpExchange
-				go func() {
-					host := host
-					err := udpExchange.Handle()
-					if err != nil {
-						u.UdpExchangesMutex.Lock()
-						if _, ok := u.UdpExchanges[host]; ok {
-							delete(u.UdpExchanges, host)
-						}
-						u.UdpExchangesMutex.Unlock()
-						log.Println("udp exchange error: ", err)
-					}
-				}()
+				if pending.association == association && len(pending.datagrams) < maxPendingDatagrams {
+					pending.datagrams = append(pending.datagrams, udpClientForwardMessage)
+				} else {
+					config.Metrics.addUdpDrop("queue_full")
+				}
+				u.UdpExchangesMutex.Unlock()
+				continue
 			}
 			u.UdpExchangesMutex.Unlock()
 
-			udpClientForwardMessage, err := NewUdpClientForwardMessage(buf[:n])
-			if err != nil {
-				return err
+			// the destination is resolved by the exchange, so a slow lookup never blocks the other clients of the relay
+			select {
+			case udpExchange.datagrams <- udpClientForwardMessage:
+			default:
+				config.Metrics.addUdpDrop("queue_full")
 			}
+		}
+	}
+}
 
-			// resolve addr
-			udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", udpClientForwardMessage.Address, udpClientForwardMessage.Port))
-			if err != nil {
-				return err
+// openExchange opens the exchange of a source, and forwards the datagrams kept while it was being opened.
+func (u *UdpRelayServer) openExchange(host string, addr *net.UDPAddr, config *serverConfig, pending *pendingUdpExchange) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	dConn, err := config.chain.ListenPacket(contextWithOutbound(ctx, &config.Outbound))
+	cancel()
+
+	u.UdpExchangesMutex.Lock()
+	delete(u.pendingExchanges, host)
+	if err != nil {
+		u.UdpExchangesMutex.Unlock()
+		log.Printf("drop udp datagram from %s: %s", host, err)
+		return
+	}
+	if u.closed {
+		u.UdpExchangesMutex.Unlock()
+		dConn.Close()
+		return
+	}
+	association := pending.association
+	udpExchange := NewUdpExchange(dConn, config.UdpConnLifetime, u, addr)
+	udpExchange.association = association
+	udpExchange.limiter = u.Server.bandwidthLimiter().acquire(association.identity, addr.IP)
+	udpExchange.usage = config.Usage.account(association.identity)
+	for _, datagram := range pending.datagrams {
+		udpExchange.datagrams <- datagram
+	}
+	u.UdpExchanges[host] = udpExchange
+	u.UdpExchangesMutex.Unlock()
+
+	go func() {
+		err := udpExchange.Handle()
+		if err != nil {
+			u.UdpExchangesMutex.Lock()
+			if u.UdpExchanges[host] == udpExchange {
+				delete(u.UdpExchanges, host)
 			}
+			u.UdpExchangesMutex.Unlock()
+			log.Println("udp exchange error: ", err)
+		}
+	}()
+	go udpExchange.send(config, host)
+}
 
-			udpExchange.Refresh(u.Server.Config.UdpConnLifetime)
-			_, err = udpExchange.DConn.WriteTo(udpClientForwardMessage.Data, udpAddr)
+// send resolves the destinations of the datagrams of the client, checks the rules and sends them, until u is closed.
+// A datagram which is denied or can not be sent is dropped, and the association keeps working.
+func (u *UdpExchange) send(config *serverConfig, host string) {
+	for {
+		select {
+		case <-u.Closed:
+			return
+		case message := <-u.datagrams:
+			ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+			addr, err := config.udpDestAddr(ctx, &RuleRequest{
+				Cmd:        cmdUdp,
+				ClientAddr: u.ClientAddr,
+				Identity:   u.association.identity,
+				Address:    message.Address,
+				Port:       message.Port,
+			})
+			cancel()
+			if err == nil {
+				err = u.forward(config, message.Data, addr)
+			}
 			if err != nil {
-				return err
+				log.Printf("drop udp datagram from %s: %s", host, err)
 			}
 		}
 	}
+}
 
+// forward sends a datagram of the client to addr.
+func (u *UdpExchange) forward(config *serverConfig, data []byte, addr net.Addr) error {
+	u.Refresh(config.UdpConnLifetime)
+	if !u.limiter.allow(len(data), true) {
+		return nil
+	}
+	_, err := u.DConn.WriteTo(data, addr)
+	if err != nil {
+		return err
+	}
+	config.Metrics.addBytes("up", "udp", len(data))
+	u.usage.add(Usage{Upload: int64(len(data))})
 	return nil
 }
 
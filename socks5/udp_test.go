@@ -1,2 +1,322 @@
 package socks5
 
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUdpAssociation(t *testing.T) {
+	newAssociation := func(t *testing.T, tcpIp string, declared string, port uint16) *udpAssociation {
+		conn := &testAddrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP(tcpIp), Port: 1234}}
+		association, err := newUdpAssociation(conn, nil, nil, &ClientRequestMessage{
+			Cmd:         cmdUdp,
+			AddressType: AddressTypeIpv4,
+			Address:     declared,
+			Port:        port,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return association
+	}
+	udpAddr := func(ip string, port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+	}
+
+	tests := []struct {
+		name     string
+		tcpIp    string
+		declared string
+		port     uint16
+		// the sources are tried in order, and the first accepted one is pinned
+		sources []*net.UDPAddr
+		want    []bool
+	}{
+		{
+			"should only accept the declared address",
+			"10.0.0.1", "10.0.0.1", 5000,
+			[]*net.UDPAddr{udpAddr("10.0.0.2", 5000), udpAddr("10.0.0.1", 5001), udpAddr("10.0.0.1", 5000)},
+			[]bool{false, false, true},
+		},
+		{
+			"should pin the first source when the address is unknown",
+			"10.0.0.1", "0.0.0.0", 0,
+			[]*net.UDPAddr{udpAddr("10.0.0.2", 5000), udpAddr("10.0.0.1", 5000), udpAddr("10.0.0.1", 5001), udpAddr("10.0.0.1", 5000)},
+			[]bool{false, true, false, true},
+		},
+		{
+			"should accept the ip of the tcp connection behind a nat",
+			"1.2.3.4", "192.168.1.5", 5000,
+			[]*net.UDPAddr{udpAddr("1.2.3.4", 40000), udpAddr("192.168.1.5", 5000)},
+			[]bool{true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			association := newAssociation(t, test.tcpIp, test.declared, test.port)
+			for i, source := range test.sources {
+				if got := association.accept(source); got != test.want[i] {
+					t.Fatalf("%s: want accepted = %v but got %v", source, test.want[i], got)
+				}
+			}
+		})
+	}
+
+	t.Run("should not accept after it is removed", func(t *testing.T) {
+		var associations udpAssociations
+		association := newAssociation(t, "10.0.0.1", "0.0.0.0", 0)
+		associations.add(association)
+		if associations.find(udpAddr("10.0.0.1", 5000)) != association {
+			t.Fatalf("want the association to be found but got nil")
+		}
+		associations.remove(association)
+		if found := associations.find(udpAddr("10.0.0.1", 5000)); found != nil {
+			t.Fatalf("want nil after remove but got %v", found)
+		}
+	})
+}
+
+// associateTestUdp opens a udp socket and associates it by a tcp connection
+func associateTestUdp(t *testing.T, proxyAddr string) (*net.UDPConn, net.Conn, *net.UDPAddr) {
+	clientConn, err := NewUdpConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+	tcpConn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpConn.Close() })
+	tcpConn.Write([]byte{Socks5Version, 1, MethodNoAuth})
+	if _, err := io.ReadFull(tcpConn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	localAddr := clientConn.LocalAddr().(*net.UDPAddr)
+	writeTestRequest(tcpConn, cmdUdp, localAddr.IP, uint16(localAddr.Port))
+	reply, relayAddr := readTestReply(t, tcpConn)
+	if reply != ReplySuccess {
+		t.Fatalf("want reply %d but got %d", ReplySuccess, reply)
+	}
+	return clientConn, tcpConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relayAddr.Port}
+}
+
+// echoTestUdp reports whether the datagram comes back through the relay
+func echoTestUdp(t *testing.T, clientConn *net.UDPConn, relayAddr *net.UDPAddr, echoAddr string) bool {
+	datagram, err := NewUdpClientForwardBytes(echoAddr, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn.WriteToUDP(datagram, relayAddr)
+	clientConn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	buf := make([]byte, MaxUdpBufLength)
+	n, _, err := clientConn.ReadFromUDP(buf)
+	return err == nil && n > 4 && string(buf[n-4:n]) == "ping"
+}
+
+// runTestFixedPortServer runs server with the udp relay on a fixed port.
+func runTestFixedPortServer(t *testing.T, server *Socks5Server) string {
+	udpConn, err := NewUdpConn("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.UdpPort = udpConn.LocalAddr().(*net.UDPAddr).Port
+	udpConn.Close()
+	proxyAddr, _ := runTestServer(t, server)
+	t.Cleanup(func() { server.Close() })
+	return proxyAddr
+}
+
+func TestUdpRelayServerFixedPort(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	server.Config.Metrics = NewMetrics()
+	proxyAddr := runTestFixedPortServer(t, server)
+
+	associate := func(t *testing.T) (*net.UDPConn, net.Conn, *net.UDPAddr) {
+		return associateTestUdp(t, proxyAddr)
+	}
+	echo := func(t *testing.T, clientConn *net.UDPConn, relayAddr *net.UDPAddr) bool {
+		return echoTestUdp(t, clientConn, relayAddr, echoAddr)
+	}
+
+	clientConn, tcpConn, relayAddr := associate(t)
+	t.Run("should relay the datagrams of the association", func(t *testing.T) {
+		if !echo(t, clientConn, relayAddr) {
+			t.Fatalf("want the echo through the relay but got none")
+		}
+	})
+
+	t.Run("should drop the datagrams without an association", func(t *testing.T) {
+		otherConn, err := NewUdpConn("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer otherConn.Close()
+		if echo(t, otherConn, relayAddr) {
+			t.Fatalf("want the datagram to be dropped but got the echo")
+		}
+		var b strings.Builder
+		server.Config.Metrics.WriteTo(&b)
+		if want := `go_proxy_udp_dropped_total{reason="not_associated"} 1`; !strings.Contains(b.String(), want) {
+			t.Fatalf("want %s in the metrics but got %s", want, b.String())
+		}
+	})
+
+	t.Run("should keep relaying after a datagram fails to be sent", func(t *testing.T) {
+		// sending to port 0 fails
+		datagram, err := NewUdpClientForwardBytes("127.0.0.1:0", []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConn.WriteToUDP(datagram, relayAddr)
+		if !echo(t, clientConn, relayAddr) {
+			t.Fatalf("want the echo through the relay but got none")
+		}
+	})
+
+	t.Run("should end the association with the tcp connection", func(t *testing.T) {
+		tcpConn.Close()
+		// the server notices the closed connection asynchronously
+		deadline := time.Now().Add(time.Second * 3)
+		for echo(t, clientConn, relayAddr) {
+			if time.Now().After(deadline) {
+				t.Fatalf("want the datagrams to be dropped after the tcp connection is closed")
+			}
+		}
+	})
+}
+
+func TestUdpRelayServerSlowExchange(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	upstream := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	upstream.Config.UdpPort = UdpRelayRandomPort
+	upstreamAddr, _ := runTestServer(t, upstream)
+	t.Cleanup(func() { upstream.Close() })
+
+	// the gate forwards to the upstream, or hangs the new connections when hang is set
+	gate, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gate.Close() })
+	var hang atomic.Bool
+	go func() {
+		for {
+			conn, err := gate.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			if hang.Load() {
+				continue
+			}
+			go func() {
+				upstreamConn, err := net.Dial("tcp", upstreamAddr)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				t.Cleanup(func() { upstreamConn.Close() })
+				go io.Copy(upstreamConn, conn)
+				io.Copy(conn, upstreamConn)
+			}()
+		}
+	}()
+
+	server := NewSocks5NoAuthServer("127.0.0.1", 0, false)
+	server.Config.Upstreams = []Upstream{{Type: UpstreamSocks5, Address: gate.Addr().String()}}
+	server.Config.Timeout = time.Second * 5
+	proxyAddr := runTestFixedPortServer(t, server)
+
+	clientConn, _, relayAddr := associateTestUdp(t, proxyAddr)
+	if !echoTestUdp(t, clientConn, relayAddr, echoAddr) {
+		t.Fatal("want the echo through the upstream but got none")
+	}
+
+	// the exchange of the other client waits for the upstream, and the first client goes on
+	hang.Store(true)
+	otherConn, _, _ := associateTestUdp(t, proxyAddr)
+	datagram, err := NewUdpClientForwardBytes(echoAddr, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConn.WriteToUDP(datagram, relayAddr)
+	time.Sleep(time.Millisecond * 100)
+	if !echoTestUdp(t, clientConn, relayAddr, echoAddr) {
+		t.Fatal("want the echo while the other exchange is being opened but got none")
+	}
+}
+
+// testHangingResolver never resolves, until ctx is done.
+type testHangingResolver struct{}
+
+func (testHangingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUdpRelayServerSlowResolver(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	server := NewSocks5Server("127.0.0.1", 0, Config{
+		AuthMethod: MethodNoAuth,
+		Resolver:   testHangingResolver{},
+		Timeout:    time.Second * 5,
+		Metrics:    NewMetrics(),
+	})
+	proxyAddr := runTestFixedPortServer(t, server)
+
+	// the datagrams of the other client wait for the resolver, and the first client goes on
+	clientConn, _, relayAddr := associateTestUdp(t, proxyAddr)
+	otherConn, _, _ := associateTestUdp(t, proxyAddr)
+	datagram, err := NewUdpClientForwardBytes("slow.test:53", []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxPendingDatagrams*2; i++ {
+		otherConn.WriteToUDP(datagram, relayAddr)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if !echoTestUdp(t, clientConn, relayAddr, echoAddr) {
+		t.Fatal("want the echo while the other client is being resolved but got none")
+	}
+
+	var b strings.Builder
+	server.Config.Metrics.WriteTo(&b)
+	if want := `go_proxy_udp_dropped_total{reason="queue_full"}`; !strings.Contains(b.String(), want) {
+		t.Fatalf("want %s in the metrics but got %s", want, b.String())
+	}
+}
+
+// testCountingResolver counts the lookups, and resolves nothing.
+type testCountingResolver struct {
+	lookups atomic.Int32
+}
+
+func (r *testCountingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestUdpRequestRelayClosed(t *testing.T) {
+	resolver := &testCountingResolver{}
+	clientConn, _ := newTestTcpRelay(t, Config{AuthMethod: MethodNoAuth, UdpPort: UdpRelayClose, Resolver: resolver})
+	domain := "client.test"
+	request := []byte{Socks5Version, cmdUdp, ReversedField, AddressTypeDomain, byte(len(domain))}
+	request = append(request, domain...)
+	request = binary.BigEndian.AppendUint16(request, 5000)
+	clientConn.Write(request)
+	if reply, _ := readTestReply(t, clientConn); reply != ReplyConnectionNotAllowed {
+		t.Fatalf("want reply %d but got %d", ReplyConnectionNotAllowed, reply)
+	}
+	if lookups := resolver.lookups.Load(); lookups != 0 {
+		t.Fatalf("want DST.ADDR not resolved but got %d lookups", lookups)
+	}
+}
@@ -0,0 +1,280 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Usage is the traffic of a user.
+type Usage struct {
+	Upload   int64 `json:"upload"`   // bytes from the client to the destinations
+	Download int64 `json:"download"` // bytes from the destinations to the client
+	// Connections are the tcp relays, BINDs and udp associations of socks, and the requests of the http proxy.
+	Connections int64 `json:"connections"`
+}
+
+func (u *Usage) add(other Usage) {
+	u.Upload += other.Upload
+	u.Download += other.Download
+	u.Connections += other.Connections
+}
+
+// UserUsage is the traffic of a user in total, in the current day and in the current month, in local time.
+type UserUsage struct {
+	Total   Usage  `json:"total"`
+	Day     string `json:"day"` // such as "2006-01-02"
+	Daily   Usage  `json:"daily"`
+	Month   string `json:"month"` // such as "2006-01"
+	Monthly Usage  `json:"monthly"`
+}
+
+// At returns the usage at now, whose Daily or Monthly is zero when now is in another day or month.
+func (u UserUsage) At(now time.Time) UserUsage {
+	u.roll(now)
+	return u
+}
+
+// roll starts a new day or month when now is in another one.
+func (u *UserUsage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.Daily = Usage{}
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.Monthly = Usage{}
+	}
+}
+
+// Quota is the traffic a user can use, upload and download together, in bytes. 0 means unlimited.
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// Quotas are the quotas of the authenticated users. A user over the quota can not start new requests,
+// which are answered with ReplyConnectionNotAllowed. Anonymous clients have no quota.
+type Quotas struct {
+	// User is the quota of each user.
+	User Quota
+	// Users overrides User for some usernames.
+	Users map[string]Quota
+}
+
+func (q *Quotas) userQuota(username string) Quota {
+	if quota, ok := q.Users[username]; ok {
+		return quota
+	}
+	return q.User
+}
+
+// UsageStore counts the traffic of the authenticated users. It is safe for concurrent use.
+// Keep the same store across reloads, so the counters go on.
+type UsageStore struct {
+	path  string
+	mutex sync.Mutex
+	users map[string]*UserUsage
+	dirty bool
+	now   func() time.Time
+}
+
+// NewUsageStore loads the usage saved at path. An empty path keeps the usage in memory only,
+// and a missing file starts from zero.
+func NewUsageStore(path string) (*UsageStore, error) {
+	store := &UsageStore{path: path, users: make(map[string]*UserUsage), now: time.Now}
+	if path == "" {
+		return store, nil
+	}
+	users, err := LoadUsage(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for username, usage := range users {
+		usage := usage
+		store.users[username] = &usage
+	}
+	return store, nil
+}
+
+// LoadUsage reads the usage saved by a UsageStore, by username.
+func LoadUsage(path string) (map[string]UserUsage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]UserUsage
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *UsageStore) add(username string, usage Usage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		user = &UserUsage{}
+		s.users[username] = user
+	}
+	user.roll(s.now())
+	user.Total.add(usage)
+	user.Daily.add(usage)
+	user.Monthly.add(usage)
+	s.dirty = true
+}
+
+// Users returns the usage of every user, in the current day and month.
+func (s *UsageStore) Users() map[string]UserUsage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := make(map[string]UserUsage, len(s.users))
+	now := s.now()
+	for username, user := range s.users {
+		user.roll(now)
+		users[username] = *user
+	}
+	return users
+}
+
+// exceeded reports whether the user has used up the quota of the day or the month.
+func (s *UsageStore) exceeded(username string, quota Quota) bool {
+	if quota.Daily <= 0 && quota.Monthly <= 0 {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return false
+	}
+	user.roll(s.now())
+	if quota.Daily > 0 && user.Daily.Upload+user.Daily.Download >= quota.Daily {
+		return true
+	}
+	return quota.Monthly > 0 && user.Monthly.Upload+user.Monthly.Download >= quota.Monthly
+}
+
+// Save writes the usage to the path of the store when it has changed.
+// The file is replaced at once, so a crash never leaves a broken file.
+func (s *UsageStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	if !s.dirty {
+		s.mutex.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	s.dirty = false
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return s.saveFailed(err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return s.saveFailed(err)
+	}
+	return nil
+}
+
+// saveFailed keeps the store dirty, so the next Save tries again.
+func (s *UsageStore) saveFailed(err error) error {
+	s.mutex.Lock()
+	s.dirty = true
+	s.mutex.Unlock()
+	return err
+}
+
+// Run saves the usage every interval until ctx is done, and then saves it once more.
+// The errors of saving are passed to onError, which may be nil.
+func (s *UsageStore) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	save := func() {
+		if err := s.Save(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+	for {
+		select {
+		case <-ticker.C:
+			save()
+		case <-ctx.Done():
+			save()
+			return
+		}
+	}
+}
+
+// usageAccount counts the traffic of a user into a store. A nil account counts nothing.
+type usageAccount struct {
+	store    *UsageStore
+	username string
+}
+
+// account returns the account of identity, or nil when the client is anonymous or nothing is counted.
+func (s *UsageStore) account(identity *Identity) *usageAccount {
+	if s == nil || identity == nil || identity.Username == "" {
+		return nil
+	}
+	return &usageAccount{store: s, username: identity.Username}
+}
+
+func (a *usageAccount) add(usage Usage) {
+	if a == nil {
+		return
+	}
+	a.store.add(a.username, usage)
+}
+
+// writer counts the bytes written to w in the direction.
+func (a *usageAccount) writer(w io.Writer, upload bool) io.Writer {
+	if a == nil {
+		return w
+	}
+	return writerFunc(func(b []byte) (int, error) {
+		n, err := w.Write(b)
+		if upload {
+			a.add(Usage{Upload: int64(n)})
+		} else {
+			a.add(Usage{Download: int64(n)})
+		}
+		return n, err
+	})
+}
+
+// checkQuota counts a new request of identity, or returns ErrQuotaExceeded when the user has used up its quota.
+func (c *serverConfig) checkQuota(identity *Identity) error {
+	account := c.Usage.account(identity)
+	if account == nil {
+		return nil
+	}
+	if c.Usage.exceeded(account.username, c.Quotas.userQuota(account.username)) {
+		return ErrQuotaExceeded
+	}
+	account.add(Usage{Connections: 1})
+	return nil
+}
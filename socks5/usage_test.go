@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+	newStore := func(t *testing.T, path string) *UsageStore {
+		store, err := NewUsageStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.now = func() time.Time { return now }
+		return store
+	}
+
+	t.Run("should start a new day and month", func(t *testing.T) {
+		store := newStore(t, "")
+		store.add("alice", Usage{Upload: 10, Download: 20, Connections: 1})
+		now = now.Add(time.Hour * 2)
+		store.add("alice", Usage{Upload: 1, Download: 2, Connections: 1})
+
+		alice := store.Users()["alice"]
+		want := UserUsage{
+			Total:   Usage{Upload: 11, Download: 22, Connections: 2},
+			Day:     "2026-02-01",
+			Daily:   Usage{Upload: 1, Download: 2, Connections: 1},
+			Month:   "2026-02",
+			Monthly: Usage{Upload: 1, Download: 2, Connections: 1},
+		}
+		if alice != want {
+			t.Fatalf("want %+v but got %+v", want, alice)
+		}
+	})
+
+	t.Run("should check the daily and monthly quotas", func(t *testing.T) {
+		store := newStore(t, "")
+		store.add("alice", Usage{Upload: 60, Download: 40})
+		tests := []struct {
+			quota    Quota
+			exceeded bool
+		}{
+			{Quota{}, false},
+			{Quota{Daily: 101}, false},
+			{Quota{Daily: 100}, true},
+			{Quota{Monthly: 100}, true},
+			{Quota{Daily: 1000, Monthly: 50}, true},
+		}
+		for _, test := range tests {
+			if exceeded := store.exceeded("alice", test.quota); exceeded != test.exceeded {
+				t.Fatalf("quota %+v: want exceeded = %v but got %v", test.quota, test.exceeded, exceeded)
+			}
+		}
+		if store.exceeded("bob", Quota{Daily: 1}) {
+			t.Fatal("want a user without traffic under the quota")
+		}
+
+		// the next day starts from zero, and the month goes on
+		now = now.Add(time.Hour * 24)
+		if store.exceeded("alice", Quota{Daily: 100}) || !store.exceeded("alice", Quota{Monthly: 100}) {
+			t.Fatal("want the daily quota reset and the monthly one kept")
+		}
+	})
+
+	t.Run("should save and load the usage", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "usage.json")
+		store := newStore(t, path)
+		store.add("alice", Usage{Upload: 1, Download: 2, Connections: 3})
+		if err := store.Save(); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded := newStore(t, path)
+		if alice := loaded.Users()["alice"]; alice.Total != (Usage{Upload: 1, Download: 2, Connections: 3}) {
+			t.Fatalf("want the saved usage but got %+v", alice)
+		}
+		users, err := LoadUsage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 {
+			t.Fatalf("want 1 user but got %d", len(users))
+		}
+		entries, _ := os.ReadDir(filepath.Dir(path))
+		if len(entries) != 1 {
+			t.Fatalf("want only the usage file but got %d files", len(entries))
+		}
+
+		if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewUsageStore(path); err == nil {
+			t.Fatal("want an error of the broken file but got nil")
+		}
+	})
+}
+
+func TestUsageQuota(t *testing.T) {
+	echoAddr := runTestEchoServer(t)
+	store, err := NewUsageStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocks5Server("127.0.0.1", 0, Config{
+		AuthMethod: MethodPassword,
+		PasswordChecker: func(username, password string) bool {
+			return password == "pass"
+		},
+		UdpPort: UdpRelayClose,
+		Usage:   store,
+		// every echo is 4 bytes up and 4 bytes down
+		Quotas: Quotas{User: Quota{Daily: 10}, Users: map[string]Quota{"bob": {}}},
+	})
+	addr, _ := runTestServer(t, server)
+
+	echo := func(t *testing.T, username string) error {
+		client := &Client{ProxyAddr: addr, Username: username, Password: "pass"}
+		conn, err := client.Dial("tcp", echoAddr)
+		if err != nil {
+			return err
+		}
+		testEcho(t, conn)
+		conn.Close()
+		return nil
+	}
+
+	t.Run("should count the traffic and reject the user over the quota", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := echo(t, "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the relay counts the bytes after the client has them
+		deadline := time.Now().Add(time.Second * 2)
+		for store.Users()["alice"].Total.Download < 8 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		want := Usage{Upload: 8, Download: 8, Connections: 2}
+		if alice := store.Users()["alice"]; alice.Daily != want {
+			t.Fatalf("want %+v but got %+v", want, alice.Daily)
+		}
+
+		err := echo(t, "alice")
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Reply != ReplyConnectionNotAllowed {
+			t.Fatalf("want reply %d but got %v", ReplyConnectionNotAllowed, err)
+		}
+		if connections := store.Users()["alice"].Total.Connections; connections != 2 {
+			t.Fatalf("want the rejected request not counted but got %d connections", connections)
+		}
+	})
+
+	t.Run("should not limit the users without a quota", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if err := echo(t, "bob"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
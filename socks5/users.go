@@ -0,0 +1,357 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnknownPasswordHash = errors.New("unknown password hash")
+	ErrInvalidUser         = errors.New("invalid user")
+)
+
+// User is an account of username/password authentication.
+type User struct {
+	Username string
+	// PasswordHash is a bcrypt ($2a$, $2b$, $2y$), argon2id ($argon2id$) or SHA-crypt ($5$, $6$) hash.
+	// The plain password is never stored.
+	PasswordHash string
+	Disabled     bool
+	// Expires is the moment the account stops working. Zero means never.
+	Expires time.Time
+}
+
+// Active reports whether the user can log in at now.
+func (u *User) Active(now time.Time) bool {
+	return !u.Disabled && (u.Expires.IsZero() || now.Before(u.Expires))
+}
+
+// UserStore checks passwords against hashed users. It is safe for concurrent use,
+// and the users can be replaced while the server is running.
+type UserStore struct {
+	mutex sync.RWMutex
+	users map[string]User
+}
+
+func NewUserStore(users []User) (*UserStore, error) {
+	store := &UserStore{}
+	err := store.SetUsers(users)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// SetUsers replaces all users. The old users are kept when users is invalid.
+func (s *UserStore) SetUsers(users []User) error {
+	userMap := make(map[string]User, len(users))
+	for _, user := range users {
+		if err := validateUser(user); err != nil {
+			return err
+		}
+		if _, ok := userMap[user.Username]; ok {
+			return fmt.Errorf("%w: duplicate username %q", ErrInvalidUser, user.Username)
+		}
+		userMap[user.Username] = user
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users = userMap
+	return nil
+}
+
+// Users returns all users sorted by username.
+func (s *UserStore) Users() []User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// CheckPassword is a PasswordCheckerFunc. Disabled and expired users are rejected.
+func (s *UserStore) CheckPassword(username, password string) bool {
+	s.mutex.RLock()
+	user, ok := s.users[username]
+	s.mutex.RUnlock()
+	if !ok {
+		// spend about the same time as a known user, so usernames can not be probed by timing
+		VerifyPassword(dummyPasswordHash, password)
+		return false
+	}
+	if !VerifyPassword(user.PasswordHash, password) {
+		return false
+	}
+	return user.Active(time.Now())
+}
+
+// Revoked reports whether username is a disabled or expired user of the store.
+// An unknown username is not revoked, such as a user who only has a client certificate.
+func (s *UserStore) Revoked(username string) bool {
+	s.mutex.RLock()
+	user, ok := s.users[username]
+	s.mutex.RUnlock()
+	return ok && !user.Active(time.Now())
+}
+
+// userLine formats user as a line of the user file.
+func userLine(user User) string {
+	line := user.Username + ":" + user.PasswordHash
+	if user.Disabled || !user.Expires.IsZero() {
+		state := "enabled"
+		if user.Disabled {
+			state = "disabled"
+		}
+		line += ":" + state
+	}
+	if !user.Expires.IsZero() {
+		line += ":" + user.Expires.UTC().Format(time.RFC3339)
+	}
+	return line + "\n"
+}
+
+// dummyPasswordHash is a bcrypt hash with the default cost.
+const dummyPasswordHash = "$2a$10$QppMFvFL93..110mqWddJO0qVsGh.KxZ7oaoT6mql0oRIldBDAXJK"
+
+func validateUser(user User) error {
+	if user.Username == "" || len(user.Username) > 255 || strings.ContainsAny(user.Username, ":\r\n") {
+		return fmt.Errorf("%w: invalid username %q", ErrInvalidUser, user.Username)
+	}
+	if !isKnownPasswordHash(user.PasswordHash) {
+		return fmt.Errorf("%w: user %q: %s", ErrInvalidUser, user.Username, ErrUnknownPasswordHash)
+	}
+	return nil
+}
+
+func isKnownPasswordHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$5$", "$6$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HashPassword hashes password with bcrypt.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// HashPasswordArgon2id hashes password with argon2id in the PHC string format.
+func HashPasswordArgon2id(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	const memory, iterations, threads, keyLength = 64 * 1024, 3, 4, 32
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, keyLength)
+	return "$argon2id$v=19$m=" + strconv.Itoa(memory) + ",t=" + strconv.Itoa(iterations) + ",p=" + strconv.Itoa(threads) +
+		"$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+// VerifyPassword reports whether password matches a bcrypt, argon2id or SHA-crypt hash.
+func VerifyPassword(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, shaCrypt256.prefix):
+		computed, _ = shaCrypt(shaCrypt256, password, hash)
+	case strings.HasPrefix(hash, shaCrypt512.prefix):
+		computed, _ = shaCrypt(shaCrypt512, password, hash)
+	default:
+		return false
+	}
+	return computed != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// verifyArgon2id checks the PHC string format, such as "$argon2id$v=19$m=65536,t=3,p=4$salt$hash".
+func verifyArgon2id(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil || iterations == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	computed := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// ReadUserFile reads users from an htpasswd-style file. Every line is
+//
+//	username:hash[:disabled[:expires]]
+//
+// where disabled is "enabled" or "disabled", and expires is a date like "2006-01-02" or a RFC 3339 time.
+// Empty lines and lines starting with "#" are ignored.
+func ReadUserFile(path string) ([]User, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users []User
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, err := parseUserLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		users = append(users, user)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func parseUserLine(line string) (User, error) {
+	// the expiry time may contain ":"
+	fields := strings.SplitN(line, ":", 4)
+	if len(fields) < 2 {
+		return User{}, fmt.Errorf("%w: want username:hash", ErrInvalidUser)
+	}
+	user := User{Username: fields[0], PasswordHash: fields[1]}
+	if len(fields) > 2 {
+		switch fields[2] {
+		case "", "enabled":
+		case "disabled":
+			user.Disabled = true
+		default:
+			return User{}, fmt.Errorf("%w: unknown state %q", ErrInvalidUser, fields[2])
+		}
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		expires, err := ParseUserExpires(fields[3])
+		if err != nil {
+			return User{}, err
+		}
+		user.Expires = expires
+	}
+	return user, validateUser(user)
+}
+
+// ParseUserExpires parses a date like "2006-01-02", which expires at the end of the day in UTC, or a RFC 3339 time.
+func ParseUserExpires(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date.AddDate(0, 0, 1), nil
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid expiry %q", ErrInvalidUser, value)
+	}
+	return expires, nil
+}
+
+// WriteUserFile writes users to an htpasswd-style file atomically.
+// The comments, empty lines and the order of an existing file are kept: the line of a user is replaced,
+// the lines of the other usernames are dropped, and the new users are appended.
+// The file is replaced by a temporary file in the same directory, so readers never see a partial file.
+func WriteUserFile(path string, users []User) error {
+	userLines := make(map[string]string, len(users))
+	for _, user := range users {
+		if err := validateUser(user); err != nil {
+			return err
+		}
+		if _, ok := userLines[user.Username]; ok {
+			return fmt.Errorf("%w: duplicate username %q", ErrInvalidUser, user.Username)
+		}
+		userLines[user.Username] = userLine(user)
+	}
+
+	var b strings.Builder
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(existing)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			b.WriteString(scanner.Text() + "\n")
+			continue
+		}
+		username, _, _ := strings.Cut(line, ":")
+		if formatted, ok := userLines[username]; ok {
+			b.WriteString(formatted)
+			delete(userLines, username)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if formatted, ok := userLines[user.Username]; ok {
+			b.WriteString(formatted)
+		}
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	// the file holds password hashes, so a new file is readable by the owner only, and an existing one keeps its mode
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = tempFile.Chmod(mode)
+	if err == nil {
+		_, err = tempFile.WriteString(b.String())
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
@@ -0,0 +1,192 @@
+package socks5
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := HashPasswordArgon2id("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", string(bcryptHash), "secret", true},
+		{"bcrypt wrong password", string(bcryptHash), "wrong", false},
+		{"argon2id", argon2Hash, "secret", true},
+		{"argon2id wrong password", argon2Hash, "wrong", false},
+		// generated by "openssl passwd -5" and "openssl passwd -6"
+		{"sha256-crypt", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!", true},
+		{"sha256-crypt rounds", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!", true},
+		{"sha512-crypt", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!", true},
+		{"sha512-crypt rounds", "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1", "a very much longer text to encrypt.  This one even stretches over morethan one line.", true},
+		{"sha512-crypt wrong password", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world", false},
+		{"plaintext", "secret", "secret", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := VerifyPassword(test.hash, test.password); ok != test.ok {
+				t.Fatalf("want %t but got %t", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestUserStore(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewUserStore([]User{
+		{Username: "alice", PasswordHash: string(hash)},
+		{Username: "bob", PasswordHash: string(hash), Disabled: true},
+		{Username: "carol", PasswordHash: string(hash), Expires: time.Now().Add(-time.Hour)},
+		{Username: "dave", PasswordHash: string(hash), Expires: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"dave", "secret", true},
+		{"eve", "secret", false},
+	}
+	for _, test := range tests {
+		if ok := store.CheckPassword(test.username, test.password); ok != test.ok {
+			t.Fatalf("user %s: want %t but got %t", test.username, test.ok, ok)
+		}
+	}
+
+	t.Run("invalid users should keep the old users", func(t *testing.T) {
+		err := store.SetUsers([]User{{Username: "alice", PasswordHash: "secret"}})
+		if !errors.Is(err, ErrInvalidUser) {
+			t.Fatalf("want err = %s but got %v", ErrInvalidUser, err)
+		}
+		err = store.SetUsers([]User{{Username: "alice", PasswordHash: string(hash)}, {Username: "alice", PasswordHash: string(hash)}})
+		if !errors.Is(err, ErrInvalidUser) {
+			t.Fatalf("want err = %s but got %v", ErrInvalidUser, err)
+		}
+		if !store.CheckPassword("alice", "secret") {
+			t.Fatalf("want alice kept")
+		}
+	})
+}
+
+func TestUserFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	users := []User{
+		{Username: "alice", PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{Username: "bob", PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", Disabled: true},
+		{Username: "carol", PasswordHash: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", Expires: expires},
+	}
+	if err := WriteUserFile(path, users); err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("want mode 0600 but got %o", info.Mode().Perm())
+	}
+
+	readUsers, err := ReadUserFile(path)
+	if err != nil {
+		t.Fatalf("want err = nil but got %s", err)
+	}
+	if !reflect.DeepEqual(readUsers, users) {
+		t.Fatalf("want %+v but got %+v", users, readUsers)
+	}
+
+	t.Run("should keep the mode of an existing file", func(t *testing.T) {
+		if err := os.Chmod(path, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteUserFile(path, users); err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatalf("want mode 0640 but got %o", info.Mode().Perm())
+		}
+	})
+
+	t.Run("should keep the comments and the order of an existing file", func(t *testing.T) {
+		hash := users[0].PasswordHash
+		content := "# admins\nbob:" + hash + "\n\n# others\nalice:" + hash + "\n"
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// bob is removed, alice is disabled and dave is new
+		err := WriteUserFile(path, []User{{Username: "dave", PasswordHash: hash}, {Username: "alice", PasswordHash: hash, Disabled: true}})
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "# admins\n\n# others\nalice:" + hash + ":disabled\ndave:" + hash + "\n"
+		if string(written) != want {
+			t.Fatalf("want %q but got %q", want, written)
+		}
+	})
+
+	t.Run("should reject duplicate usernames", func(t *testing.T) {
+		if err := WriteUserFile(path, []User{users[0], users[0]}); !errors.Is(err, ErrInvalidUser) {
+			t.Fatalf("want err = %s but got %v", ErrInvalidUser, err)
+		}
+	})
+
+	t.Run("should parse dates and comments", func(t *testing.T) {
+		content := "# comment\n\nalice:$6$salt$hash:enabled:2030-01-02\n"
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		users, err := ReadUserFile(path)
+		if err != nil {
+			t.Fatalf("want err = nil but got %s", err)
+		}
+		want := time.Date(2030, 1, 3, 0, 0, 0, 0, time.UTC)
+		if len(users) != 1 || !users[0].Expires.Equal(want) {
+			t.Fatalf("want expires %s but got %+v", want, users)
+		}
+	})
+
+	t.Run("should reject a plaintext password", func(t *testing.T) {
+		if err := os.WriteFile(path, []byte("alice:secret\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadUserFile(path); !errors.Is(err, ErrInvalidUser) {
+			t.Fatalf("want err = %s but got %v", ErrInvalidUser, err)
+		}
+	})
+}